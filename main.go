@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 
 	"github.com/johanneswuerbach/jaeger-s3/plugin"
 	pConfig "github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/metrics"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore"
 	"github.com/ory/viper"
 	"github.com/spf13/pflag"
 
@@ -36,7 +40,13 @@ func main() {
 	})
 
 	var configPath string
+	var replayDeadLetters bool
+	var compact bool
+	var aggregateDependencies bool
 	pflag.StringVar(&configPath, "config", "", "A path to the s3 plugin's configuration file")
+	pflag.BoolVar(&replayDeadLetters, "replay-dead-letters", false, "Upload all files from the dead letter queue and exit")
+	pflag.BoolVar(&compact, "compact", false, "Compact the span files of closed partitions and exit")
+	pflag.BoolVar(&aggregateDependencies, "aggregate-dependencies", false, "Aggregate the dependency files of closed partitions and exit")
 	pflag.Parse()
 	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
 		log.Fatalf("unable bind flags, %v", err)
@@ -72,14 +82,142 @@ func main() {
 
 	logger.Debug("plugin configured")
 
+	if replayDeadLetters {
+		if err := runReplayDeadLetters(ctx, logger, s3Svc, configuration.S3); err != nil {
+			log.Fatalf("unable to replay dead letters, %v", err)
+		}
+		return
+	}
+
+	if compact {
+		if err := runCompaction(ctx, logger, s3Svc, configuration.S3); err != nil {
+			log.Fatalf("unable to compact span files, %v", err)
+		}
+		return
+	}
+
+	if aggregateDependencies {
+		if err := runDependencyAggregation(ctx, logger, s3Svc, athenaSvc, configuration); err != nil {
+			log.Fatalf("unable to aggregate dependency files, %v", err)
+		}
+		return
+	}
+
 	s3Plugin, err := plugin.NewS3Plugin(ctx, logger, s3Svc, configuration.S3, athenaSvc, configuration.Athena)
 	if err != nil {
 		log.Fatalf("unable to create plugin, %v", err)
 	}
 
+	// Handlers by listen address and path, metrics and API can share an address
+	servers := map[string]map[string]http.Handler{}
+	if configuration.Metrics.ListenAddress != "" {
+		servers[configuration.Metrics.ListenAddress] = map[string]http.Handler{
+			metricsPath(configuration.Metrics): metrics.DefaultRegistry.Handler(),
+		}
+	}
+
+	if configuration.API.ListenAddress != "" && configuration.Athena.TagKeysTableName != "" {
+		if servers[configuration.API.ListenAddress] == nil {
+			servers[configuration.API.ListenAddress] = map[string]http.Handler{}
+		}
+		servers[configuration.API.ListenAddress]["/api/tag-keys"] = s3Plugin.TagKeysHandler()
+	}
+
+	for address, handlers := range servers {
+		go serveHTTP(logger, address, handlers)
+	}
+
 	logger.Debug("plugin created")
 	grpc.Serve(&shared.PluginServices{
 		Store:               s3Plugin,
 		StreamingSpanWriter: s3Plugin,
 	})
 }
+
+func runReplayDeadLetters(ctx context.Context, logger hclog.Logger, s3Svc *s3.Client, s3Config pConfig.S3) error {
+	retryOptions, err := s3spanstore.NewRetryOptions(s3Config)
+	if err != nil {
+		return err
+	}
+
+	objectOptions, err := s3spanstore.NewObjectOptions(s3Config)
+	if err != nil {
+		return err
+	}
+
+	deadLetterQueue, err := s3spanstore.NewDeadLetterQueue(s3Svc, s3Config)
+	if err != nil {
+		return err
+	}
+
+	if deadLetterQueue == nil {
+		return fmt.Errorf("no dead letter queue configured")
+	}
+
+	notifier, err := s3spanstore.NewFileNotifier(ctx, s3Config)
+	if err != nil {
+		return err
+	}
+
+	replayed, err := s3spanstore.ReplayDeadLetters(ctx, logger, s3Svc, s3Config.BucketName, retryOptions, objectOptions, s3Config.ManifestsPrefix, notifier, deadLetterQueue)
+	logger.Info("dead letters replayed", "files", replayed)
+
+	return err
+}
+
+func runCompaction(ctx context.Context, logger hclog.Logger, s3Svc *s3.Client, s3Config pConfig.S3) error {
+	compactorOptions, err := s3spanstore.NewCompactorOptions(s3Config)
+	if err != nil {
+		return err
+	}
+
+	return s3spanstore.NewCompactor(logger, s3Svc, s3Config.BucketName, s3Config.SpansPrefix, compactorOptions).Run(ctx)
+}
+
+func runDependencyAggregation(ctx context.Context, logger hclog.Logger, s3Svc *s3.Client, athenaSvc *athena.Client, configuration pConfig.Configuration) error {
+	if configuration.S3.DependenciesPrefix == "" {
+		return fmt.Errorf("no dependencies prefix configured")
+	}
+
+	compactorOptions, err := s3spanstore.NewCompactorOptions(configuration.S3)
+	if err != nil {
+		return err
+	}
+
+	// The reader is only used to run the queries
+	athenaConfig := configuration.Athena
+	athenaConfig.DependenciesPrefetch = false
+
+	reader, err := s3spanstore.NewReader(ctx, logger, athenaSvc, athenaConfig, compactorOptions.PartitionScheme, nil)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	compactorOptions.PartitionScheme = compactorOptions.PartitionScheme.WithoutServicePartitioning()
+
+	return s3spanstore.NewDependencyAggregator(logger, s3Svc, reader, configuration.S3.BucketName, configuration.S3.DependenciesPrefix, compactorOptions).Run(ctx)
+}
+
+func metricsPath(metricsConfig pConfig.Metrics) string {
+	if metricsConfig.Path == "" {
+		return "/metrics"
+	}
+
+	return metricsConfig.Path
+}
+
+// serveHTTP serves the handlers by path on address.
+func serveHTTP(logger hclog.Logger, address string, handlers map[string]http.Handler) {
+	mux := http.NewServeMux()
+	paths := []string{}
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+		paths = append(paths, path)
+	}
+
+	logger.Debug("serving http", "address", address, "paths", paths)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logger.Error("failed to serve http", "address", address, "error", err)
+	}
+}
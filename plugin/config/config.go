@@ -4,27 +4,148 @@ type S3 struct {
 	BucketName                            string
 	SpansPrefix                           string
 	OperationsPrefix                      string
+	EventsPrefix                          string
+	TagKeysPrefix                         string
+	DependenciesPrefix                    string
+	ManifestsPrefix                       string
+	InstanceID                            string
+	NotifyWebhookURL                      string
+	NotifyFile                            string
+	NotifySQSQueueURL                     string
+	NotifySQSRegion                       string
+	ServerSideEncryption                  string
+	SSEKMSKeyID                           string
+	SSEBucketKeyEnabled                   bool
+	StorageClass                          string
+	ObjectTags                            []ObjectTag
 	BufferDuration                        string
+	PayloadCodec                          string
+	PartitionGranularity                  string
+	PartitionLayout                       string
+	ServicePartitioning                   string
+	ServicePartitionBuckets               int
+	WriteQueueSize                        int
+	WriteQueueWorkers                     int
+	WriteQueueBatchSize                   int
+	WriteQueueFullPolicy                  string
+	BufferMaxBytes                        int64
+	BufferMaxRows                         int64
+	SpoolDirectory                        string
+	SpoolSyncInterval                     string
+	BufferDirectory                       string
+	ParquetCompression                    string
+	ParquetRowGroupSize                   int64
+	ParquetPageSize                       int64
+	ParquetParallelism                    int64
+	PromotedTags                          []PromotedTag
+	LegacyTagsMap                         bool
+	SpanFilters                           []SpanFilter
+	RedactionRules                        []RedactionRule
+	RedactionHashKey                      string
+	MaxTagValueLength                     int
+	MaxLogs                               int
+	MaxPayloadSize                        int
+	SizeLimitPolicy                       string
+	UploadMaxAttempts                     int
+	UploadInitialBackoff                  string
+	UploadMaxBackoff                      string
+	DeadLetterDirectory                   string
+	DeadLetterPrefix                      string
+	CompactionMinAge                      string
+	CompactionLookback                    string
+	CompactionTargetFileSize              int64
 	EmptyBucket                           bool
+	ShutdownTimeout                       string
 	OperationsDedupeDuration              string
 	OperationsDedupeRewriteBufferDuration string
 	OperationsDedupeCacheSize             int
+	OperationsDedupeStatePrefix           string
+	OperationsDedupeStateInterval         string
+	TagKeysMaxValues                      int
+	TagKeysDedupeCacheSize                int
+	DependenciesSpanCacheSize             int
+	DependenciesLinkTimeout               string
+}
+
+// PromotedTag is a tag key written into its own column, Type is one of string,
+// int64, double or bool
+type PromotedTag struct {
+	Key  string
+	Type string
+}
+
+// SpanFilter drops or samples the spans matching all of its non-empty fields
+// before they are written. Action is one of keep, drop or sample.
+type SpanFilter struct {
+	Service          string
+	Operation        string
+	OperationPattern string
+	SpanKind         string
+	Tags             []TagMatch
+	MinDuration      string
+	MaxDuration      string
+	Action           string
+	// SampleRate is the fraction of matching traces kept by the sample action
+	SampleRate float64
+}
+
+// ObjectTag is added to every uploaded object, e.g. for cost allocation
+type ObjectTag struct {
+	Key   string
+	Value string
+}
+
+type TagMatch struct {
+	Key   string
+	Value string
+}
+
+// RedactionRule scrubs span tags, process tags and log fields matching Keys or
+// KeyPattern, or all fields if both are empty. Action is one of drop, mask or hash.
+type RedactionRule struct {
+	Keys       []string
+	KeyPattern string
+	// ValuePattern limits mask to the matching parts of the value
+	ValuePattern string
+	Action       string
+	// Replacement of masked values, defaults to [REDACTED]
+	Replacement string
 }
 
 type Athena struct {
-	DatabaseName         string
-	SpansTableName       string
-	OperationsTableName  string
-	WorkGroup            string
-	OutputLocation       string
-	MaxSpanAge           string
-	DependenciesQueryTTL string
-	ServicesQueryTTL     string
-	MaxTraceDuration     string
-	DependenciesPrefetch bool
+	DatabaseName          string
+	SpansTableName        string
+	OperationsTableName   string
+	TagKeysTableName      string
+	DependenciesTableName string
+	WorkGroup             string
+	OutputLocation        string
+	MaxSpanAge            string
+	DependenciesQueryTTL  string
+	ServicesQueryTTL      string
+	MaxTraceDuration      string
+	DependenciesPrefetch  bool
+	// PromotedTagsFallback additionally searches the tag maps for promoted
+	// tags, e.g. until spans written before the tags were promoted are compacted
+	PromotedTagsFallback bool
+}
+
+// Metrics exposes Prometheus metrics on ListenAddress, e.g. :9090, if set
+type Metrics struct {
+	ListenAddress string
+	// Path defaults to /metrics
+	Path string
+}
+
+// API serves the additional HTTP endpoints of the query service, e.g. the tag
+// keys catalog, on ListenAddress, e.g. :9091, if set
+type API struct {
+	ListenAddress string
 }
 
 type Configuration struct {
-	S3     S3
-	Athena Athena
+	S3      S3
+	Athena  Athena
+	Metrics Metrics
+	API     API
 }
@@ -0,0 +1,394 @@
+// Package metrics implements counters, gauges and histograms, which are exposed
+// in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultRegistry holds the metrics of the plugin
+var DefaultRegistry = NewRegistry()
+
+// DefaultBuckets are histogram buckets in seconds suitable for most latencies
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// labelSeparator can't be part of valid UTF-8 label values
+const labelSeparator = "\xff"
+
+// Registry renders all its metrics in the Prometheus text format.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]*vec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]*vec{}}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value atomicFloat
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increases the counter by v, negative values are ignored.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.value.add(v)
+}
+
+func (c *Counter) Value() float64 {
+	return c.value.load()
+}
+
+// Gauge is a value, which can go up and down.
+type Gauge struct {
+	value atomicFloat
+}
+
+func (g *Gauge) Set(v float64) {
+	g.value.store(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.value.add(v)
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.value.load()
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bucket := range h.buckets {
+		if v <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) Count() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.count
+}
+
+func (h *Histogram) Sum() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.sum
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	vec *vec
+}
+
+// With returns the counter of the given label values, which need to be passed
+// in the order of the label names.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.vec.with(labelValues).(*Counter)
+}
+
+// GaugeVec is a set of gauges partitioned by label values.
+type GaugeVec struct {
+	vec *vec
+}
+
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return v.vec.with(labelValues).(*Gauge)
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	vec *vec
+}
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.vec.with(labelValues).(*Histogram)
+}
+
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{vec: r.register(name, help, typeCounter, labelNames, func() interface{} {
+		return &Counter{}
+	})}
+}
+
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{vec: r.register(name, help, typeGauge, labelNames, func() interface{} {
+		return &Gauge{}
+	})}
+}
+
+// NewHistogram creates a histogram with the given upper bounds of its buckets,
+// which need to be sorted in increasing order.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{vec: r.register(name, help, typeHistogram, labelNames, func() interface{} {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})}
+}
+
+// register panics on duplicate names, as metrics are registered once on startup.
+func (r *Registry) register(name string, help string, metricType string, labelNames []string, newMetric func() interface{}) *vec {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+
+	v := &vec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		newMetric:  newMetric,
+		children:   map[string]interface{}{},
+	}
+	r.metrics[name] = v
+
+	return v
+}
+
+// WriteTo writes all metrics in the Prometheus text format to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	vecs := make([]*vec, 0, len(r.metrics))
+	for _, v := range r.metrics {
+		vecs = append(vecs, v)
+	}
+	r.mutex.Unlock()
+
+	sort.Slice(vecs, func(i, j int) bool {
+		return vecs[i].name < vecs[j].name
+	})
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, v := range vecs {
+		v.writeTo(cw)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+
+	return cw.n, cw.w.(*bufio.Writer).Flush()
+}
+
+// Handler serves all metrics in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type vec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	newMetric  func() interface{}
+
+	mutex    sync.RWMutex
+	children map[string]interface{}
+}
+
+func (v *vec) with(labelValues []string) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, labelSeparator)
+
+	v.mutex.RLock()
+	child, ok := v.children[key]
+	v.mutex.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if child, ok := v.children[key]; ok {
+		return child
+	}
+
+	child = v.newMetric()
+	v.children[key] = child
+
+	return child
+}
+
+func (v *vec) writeTo(w *countingWriter) {
+	v.mutex.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	v.mutex.RUnlock()
+
+	// Metrics without labels are always exposed
+	if len(keys) == 0 && len(v.labelNames) == 0 {
+		v.with(nil)
+		keys = append(keys, "")
+	}
+
+	sort.Strings(keys)
+
+	w.printf("# HELP %s %s\n", v.name, escapeHelp(v.help))
+	w.printf("# TYPE %s %s\n", v.name, v.metricType)
+
+	for _, key := range keys {
+		var labelValues []string
+		if len(v.labelNames) > 0 {
+			labelValues = strings.Split(key, labelSeparator)
+		}
+		labels := formatLabels(v.labelNames, labelValues)
+
+		v.mutex.RLock()
+		child := v.children[key]
+		v.mutex.RUnlock()
+
+		switch metric := child.(type) {
+		case *Counter:
+			w.printf("%s%s %s\n", v.name, labels, formatValue(metric.Value()))
+		case *Gauge:
+			w.printf("%s%s %s\n", v.name, labels, formatValue(metric.Value()))
+		case *Histogram:
+			bucketLabelNames := append(append([]string{}, v.labelNames...), "le")
+			bucketLabelValues := append(append([]string{}, labelValues...), "")
+
+			metric.mutex.Lock()
+			for i, bucket := range metric.buckets {
+				bucketLabelValues[len(labelValues)] = formatValue(bucket)
+				w.printf("%s_bucket%s %d\n", v.name, formatLabels(bucketLabelNames, bucketLabelValues), metric.counts[i])
+			}
+			bucketLabelValues[len(labelValues)] = "+Inf"
+			w.printf("%s_bucket%s %d\n", v.name, formatLabels(bucketLabelNames, bucketLabelValues), metric.count)
+			w.printf("%s_sum%s %s\n", v.name, labels, formatValue(metric.sum))
+			w.printf("%s_count%s %d\n", v.name, labels, metric.count)
+			metric.mutex.Unlock()
+		}
+	}
+}
+
+func formatLabels(labelNames []string, labelValues []string) string {
+	if len(labelNames) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		pairs[i] = labelName + `="` + escapeLabelValue(labelValues[i]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// atomicFloat is a float64 which can be updated concurrently.
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func (f *atomicFloat) store(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, updated) {
+			return
+		}
+	}
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+
+	n, err := fmt.Fprintf(w.w, format, args...)
+	w.n += int64(n)
+	w.err = err
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("test_requests_total", "Handled requests", "method", "status")
+	requests.With("GET", "200").Inc()
+	requests.With("GET", "200").Add(2)
+	requests.With("POST", "500").Inc()
+	requests.With("POST", "500").Add(-1)
+
+	inflight := registry.NewGauge("test_inflight", "Requests in flight")
+	inflight.With().Inc()
+	inflight.With().Inc()
+	inflight.With().Dec()
+
+	duration := registry.NewHistogram("test_duration_seconds", "Request duration", []float64{0.1, 1}, "path")
+	duration.With(`/a"b`).Observe(0.0625)
+	duration.With(`/a"b`).Observe(0.5)
+	duration.With(`/a"b`).Observe(4)
+
+	registry.NewCounter("test_errors_total", "Errors\nby type", "type")
+
+	output := &strings.Builder{}
+	_, err := registry.WriteTo(output)
+	assert.NoError(err)
+
+	assert.Equal(`# HELP test_duration_seconds Request duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{path="/a\"b",le="0.1"} 1
+test_duration_seconds_bucket{path="/a\"b",le="1"} 2
+test_duration_seconds_bucket{path="/a\"b",le="+Inf"} 3
+test_duration_seconds_sum{path="/a\"b"} 4.5625
+test_duration_seconds_count{path="/a\"b"} 3
+# HELP test_errors_total Errors\nby type
+# TYPE test_errors_total counter
+# HELP test_inflight Requests in flight
+# TYPE test_inflight gauge
+test_inflight 1
+# HELP test_requests_total Handled requests
+# TYPE test_requests_total counter
+test_requests_total{method="GET",status="200"} 3
+test_requests_total{method="POST",status="500"} 1
+`, output.String())
+}
+
+func TestRegistryHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := NewRegistry()
+	registry.NewCounter("test_requests_total", "Handled requests").With().Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(200, recorder.Code)
+	assert.Contains(recorder.Header().Get("Content-Type"), "version=0.0.4")
+	assert.Contains(recorder.Body.String(), "test_requests_total 1\n")
+}
+
+func TestRegistryPanicsOnInvalidUse(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := NewRegistry()
+	requests := registry.NewCounter("test_requests_total", "Handled requests", "method")
+
+	assert.Panics(func() { registry.NewGauge("test_requests_total", "Duplicate") })
+	assert.Panics(func() { requests.With() })
+}
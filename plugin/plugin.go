@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/athena"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -28,23 +30,45 @@ func NewS3Plugin(ctx context.Context, logger hclog.Logger, s3Svc *s3.Client, s3C
 		return nil, fmt.Errorf("failed to create span writer, %v", err)
 	}
 
-	spanReader, err := s3spanstore.NewReader(ctx, logger, athenaSvc, athenaConfig)
+	partitionScheme, err := s3spanstore.NewPartitionScheme(s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse partition scheme, %v", err)
+	}
+
+	promotedTags, err := s3spanstore.NewPromotedTagColumns(s3Config.PromotedTags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse promoted tags, %v", err)
+	}
+
+	spanReader, err := s3spanstore.NewReader(ctx, logger, athenaSvc, athenaConfig, partitionScheme, promotedTags)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create span reader, %v", err)
 	}
 
+	shutdownTimeout := defaultShutdownTimeout
+	if s3Config.ShutdownTimeout != "" {
+		if shutdownTimeout, err = time.ParseDuration(s3Config.ShutdownTimeout); err != nil {
+			return nil, fmt.Errorf("failed to parse shutdown timeout, %v", err)
+		}
+	}
+
 	return &S3Plugin{
-		spanWriter: spanWriter,
-		spanReader: spanReader,
-		logger:     logger,
+		spanWriter:      spanWriter,
+		spanReader:      spanReader,
+		logger:          logger,
+		shutdownTimeout: shutdownTimeout,
 	}, nil
 }
 
+// defaultShutdownTimeout stays below the default Kubernetes termination grace period of 30s
+const defaultShutdownTimeout = time.Second * 25
+
 type S3Plugin struct {
 	spanWriter *s3spanstore.Writer
 	spanReader *s3spanstore.Reader
 
-	logger hclog.Logger
+	logger          hclog.Logger
+	shutdownTimeout time.Duration
 }
 
 func (h *S3Plugin) SpanWriter() spanstore.Writer {
@@ -63,10 +87,26 @@ func (h *S3Plugin) StreamingSpanWriter() spanstore.Writer {
 	return h.spanWriter
 }
 
+// TagKeysHandler serves the tag key catalog for tooling.
+func (h *S3Plugin) TagKeysHandler() http.Handler {
+	return s3spanstore.NewTagKeysHandler(h.logger, h.spanReader)
+}
+
 func (h *S3Plugin) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.shutdownTimeout)
+	defer cancel()
+
+	return h.Shutdown(ctx)
+}
+
+// Shutdown flushes all buffered spans until ctx is done, afterwards running
+// uploads are aborted.
+func (h *S3Plugin) Shutdown(ctx context.Context) error {
 	g := errgroup.Group{}
 
-	g.Go(h.spanWriter.Close)
+	g.Go(func() error {
+		return h.spanWriter.Shutdown(ctx)
+	})
 	g.Go(h.spanReader.Close)
 
 	return g.Wait()
@@ -129,5 +129,11 @@ func (c *AthenaQueryCache) Lookup(ctx context.Context, key string, ttl time.Dura
 		return nil, err
 	}
 
+	if latestQueryExecution != nil {
+		athenaQueryCacheLookupsTotal.With(metricsResultHit).Inc()
+	} else {
+		athenaQueryCacheLookupsTotal.With(metricsResultMiss).Inc()
+	}
+
 	return latestQueryExecution, nil
 }
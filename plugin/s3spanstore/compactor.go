@@ -0,0 +1,642 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+var errIncompatibleParquetFile = errors.New("incompatible parquet file")
+
+// compactionMarkerPrefix names the markers of running compactions. Athena
+// ignores files starting with an underscore, so they are kept next to the
+// compacted files.
+const compactionMarkerPrefix = "_compaction-"
+
+// compactionMarker is written before a compacted file is uploaded and removed
+// once all merged files are deleted, so the next run can complete an
+// interrupted compaction instead of merging the same spans twice.
+type compactionMarker struct {
+	Key     string   `json:"key"`
+	Sources []string `json:"sources"`
+	// Manifest of the compacted file, nil unless manifests are enabled
+	Manifest *FileManifest `json:"manifest,omitempty"`
+}
+
+var (
+	defaultCompactionMinAge         = time.Hour * 2
+	defaultCompactionLookback       = time.Hour * 24
+	defaultCompactionTargetFileSize = int64(256 * 1024 * 1024)
+)
+
+// CompactorOptions controls which partitions and files are compacted.
+type CompactorOptions struct {
+	// MinAge is the time after a partition ended until it is considered closed
+	MinAge time.Duration
+	// Lookback limits how far back closed partitions are compacted
+	Lookback time.Duration
+	// TargetFileSize is the maximum size of compacted files, larger files are left untouched
+	TargetFileSize int64
+	// PartitionScheme is the layout of the compacted files
+	PartitionScheme PartitionScheme
+	// BufferDirectory holds compacted files until they are uploaded, defaults to a temporary directory
+	BufferDirectory string
+	RetryOptions    RetryOptions
+	ObjectOptions   ObjectOptions
+	ParquetOptions  ParquetOptions
+	// PromotedTags are recomputed from the tags map of the compacted records, nil disables them
+	PromotedTags *PromotedTagColumns
+	// InstanceID identifies the compactor in object keys, defaults to the hostname
+	InstanceID string
+	// ManifestsPrefix enables manifests of compacted files, empty disables manifests
+	ManifestsPrefix string
+}
+
+func NewCompactorOptions(s3Config config.S3) (CompactorOptions, error) {
+	minAge, err := parseDurationWithDefault(s3Config.CompactionMinAge, defaultCompactionMinAge)
+	if err != nil {
+		return CompactorOptions{}, fmt.Errorf("failed to parse compaction min age: %w", err)
+	}
+
+	lookback, err := parseDurationWithDefault(s3Config.CompactionLookback, defaultCompactionLookback)
+	if err != nil {
+		return CompactorOptions{}, fmt.Errorf("failed to parse compaction lookback: %w", err)
+	}
+
+	targetFileSize := defaultCompactionTargetFileSize
+	if s3Config.CompactionTargetFileSize > 0 {
+		targetFileSize = s3Config.CompactionTargetFileSize
+	}
+
+	retryOptions, err := NewRetryOptions(s3Config)
+	if err != nil {
+		return CompactorOptions{}, fmt.Errorf("failed to parse upload retry options: %w", err)
+	}
+
+	partitionScheme, err := NewPartitionScheme(s3Config)
+	if err != nil {
+		return CompactorOptions{}, fmt.Errorf("failed to parse partition scheme: %w", err)
+	}
+
+	parquetOptions, err := NewParquetOptions(s3Config)
+	if err != nil {
+		return CompactorOptions{}, fmt.Errorf("failed to parse parquet options: %w", err)
+	}
+
+	promotedTags, err := NewPromotedTagColumns(s3Config.PromotedTags)
+	if err != nil {
+		return CompactorOptions{}, fmt.Errorf("failed to parse promoted tags: %w", err)
+	}
+
+	objectOptions, err := NewObjectOptions(s3Config)
+	if err != nil {
+		return CompactorOptions{}, fmt.Errorf("failed to parse object options: %w", err)
+	}
+
+	return CompactorOptions{
+		MinAge:          minAge,
+		Lookback:        lookback,
+		TargetFileSize:  targetFileSize,
+		PartitionScheme: partitionScheme,
+		BufferDirectory: s3Config.BufferDirectory,
+		RetryOptions:    retryOptions,
+		ObjectOptions:   objectOptions,
+		ParquetOptions:  parquetOptions,
+		PromotedTags:    promotedTags,
+		InstanceID:      s3Config.InstanceID,
+		ManifestsPrefix: s3Config.ManifestsPrefix,
+	}, nil
+}
+
+// Compactor merges the small span files of closed partitions into fewer large
+// files sorted by trace id.
+//
+// The compacted file is uploaded before the merged files are deleted, so readers
+// never miss spans, while some spans are present twice for a short time. All
+// queries reading spans select distinct rows or spans, so these duplicates are
+// neither returned nor counted.
+// A marker listing the merged files is written first, so a compaction
+// interrupted before all of them were deleted is completed by the next run.
+// Compacted files are named like collector files and the manifests of merged
+// files point to the compacted file. Only a single compactor should run at a time.
+type Compactor struct {
+	logger     hclog.Logger
+	svc        S3API
+	bucketName string
+	prefix     string
+	opts       CompactorOptions
+	uploader   *ParquetUploader
+
+	instanceID string
+	startedAt  time.Time
+	sequence   uint64
+
+	// skippedFiles counts files which can't be compacted due to their schema
+	skippedFiles int
+}
+
+func NewCompactor(logger hclog.Logger, svc S3API, bucketName string, prefix string, opts CompactorOptions) *Compactor {
+	return &Compactor{
+		logger:     logger,
+		svc:        svc,
+		bucketName: bucketName,
+		prefix:     prefix,
+		opts:       opts,
+		uploader:   NewParquetUploader(logger, svc, bucketName, opts.RetryOptions, opts.ObjectOptions, nil),
+		instanceID: NewInstanceID(opts.InstanceID),
+		startedAt:  time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+// Run compacts all closed partitions within the lookback window.
+func (c *Compactor) Run(ctx context.Context) error {
+	interval := c.opts.PartitionScheme.Interval()
+	newest := c.opts.PartitionScheme.Truncate(time.Now().Add(-c.opts.MinAge)).Add(-interval)
+	oldest := newest.Add(-c.opts.Lookback)
+
+	for partitionTime := newest; partitionTime.After(oldest); partitionTime = partitionTime.Add(-interval) {
+		if err := c.CompactPartition(ctx, c.opts.PartitionScheme.TimeKey(partitionTime)); err != nil {
+			return fmt.Errorf("failed to compact partition: %w", err)
+		}
+	}
+
+	if c.skippedFiles > 0 {
+		c.logger.Warn("skipped files with incompatible schema, they are never compacted", "files", c.skippedFiles)
+	}
+
+	return nil
+}
+
+// CompactPartition merges all small files of a single time partition. Files of
+// different service partitions below it are never merged.
+func (c *Compactor) CompactPartition(ctx context.Context, datehour string) error {
+	objects, markerKeys, err := c.listFiles(ctx, datehour)
+	if err != nil {
+		return err
+	}
+
+	// Files of interrupted compactions are either deleted or compacted again
+	objects, err = c.recoverCompactions(ctx, objects, markerKeys)
+	if err != nil {
+		return err
+	}
+
+	partitionKeys := []string{}
+	partitionObjects := map[string][]types.Object{}
+	for _, object := range objects {
+		if object.Size >= c.opts.TargetFileSize {
+			continue
+		}
+
+		partitionKey := strings.TrimPrefix(path.Dir(*object.Key), strings.TrimSuffix(c.prefix, "/"))
+		partitionKey = strings.TrimPrefix(partitionKey, "/")
+		if _, ok := partitionObjects[partitionKey]; !ok {
+			partitionKeys = append(partitionKeys, partitionKey)
+		}
+		partitionObjects[partitionKey] = append(partitionObjects[partitionKey], object)
+	}
+
+	for _, partitionKey := range partitionKeys {
+		for _, batch := range c.batchFiles(partitionObjects[partitionKey]) {
+			if len(batch) < 2 {
+				continue
+			}
+
+			if err := c.compactFiles(ctx, partitionKey, batch); err != nil {
+				return fmt.Errorf("failed to compact %s: %w", partitionKey, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// listFiles returns all parquet files and compaction markers of the partition.
+func (c *Compactor) listFiles(ctx context.Context, datehour string) ([]types.Object, []string, error) {
+	paginator := s3.NewListObjectsV2Paginator(c.svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucketName),
+		Prefix: aws.String(c.prefix + datehour + "/"),
+	})
+
+	objects := []types.Object{}
+	markerKeys := []string{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed fetch page: %w", err)
+		}
+
+		for _, object := range output.Contents {
+			if strings.HasPrefix(path.Base(*object.Key), compactionMarkerPrefix) {
+				markerKeys = append(markerKeys, *object.Key)
+				continue
+			}
+
+			if strings.HasSuffix(*object.Key, ".parquet") {
+				objects = append(objects, object)
+			}
+		}
+	}
+
+	return objects, markerKeys, nil
+}
+
+// recoverCompactions completes compactions whose compacted file was uploaded
+// by deleting their remaining merged files. Markers of compactions which never
+// uploaded their file are removed, their files are compacted again.
+func (c *Compactor) recoverCompactions(ctx context.Context, objects []types.Object, markerKeys []string) ([]types.Object, error) {
+	if len(markerKeys) == 0 {
+		return objects, nil
+	}
+
+	existing := map[string]bool{}
+	for _, object := range objects {
+		existing[*object.Key] = true
+	}
+
+	merged := map[string]bool{}
+	for _, markerKey := range markerKeys {
+		marker, err := getCompactionMarker(ctx, c.svc, c.bucketName, markerKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if !existing[marker.Key] {
+			if err := c.deleteObject(ctx, markerKey); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := c.finishCompaction(ctx, markerKey, marker); err != nil {
+			return nil, err
+		}
+
+		for _, source := range marker.Sources {
+			merged[source] = true
+		}
+
+		c.logger.Info("completed interrupted compaction", "key", marker.Key, "files", len(marker.Sources))
+	}
+
+	remaining := make([]types.Object, 0, len(objects))
+	for _, object := range objects {
+		if !merged[*object.Key] {
+			remaining = append(remaining, object)
+		}
+	}
+
+	return remaining, nil
+}
+
+func (c *Compactor) markerKey(key string) string {
+	return path.Join(path.Dir(key), compactionMarkerPrefix+strings.TrimSuffix(path.Base(key), ".parquet")+".json")
+}
+
+func putCompactionMarker(ctx context.Context, svc S3API, bucketName string, objectOptions ObjectOptions, markerKey string, marker *compactionMarker) error {
+	body, err := json.Marshal(marker)
+	if err != nil {
+		return fmt.Errorf("failed to serialize compaction marker: %w", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(markerKey),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	objectOptions.Apply(input)
+
+	if _, err := svc.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("failed to put compaction marker: %w", err)
+	}
+
+	return nil
+}
+
+func getCompactionMarker(ctx context.Context, svc S3API, bucketName string, markerKey string) (*compactionMarker, error) {
+	output, err := svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(markerKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get compaction marker: %w", err)
+	}
+	defer output.Body.Close()
+
+	marker := &compactionMarker{}
+	if err := json.NewDecoder(output.Body).Decode(marker); err != nil {
+		return nil, fmt.Errorf("failed to decode compaction marker %s: %w", markerKey, err)
+	}
+
+	return marker, nil
+}
+
+// finishCompaction writes the manifests and deletes the merged files and the
+// marker, once the compacted file is in place.
+func (c *Compactor) finishCompaction(ctx context.Context, markerKey string, marker *compactionMarker) error {
+	if c.opts.ManifestsPrefix != "" && marker.Manifest != nil {
+		if err := putFileManifest(ctx, c.svc, c.bucketName, c.opts.ManifestsPrefix, c.opts.ObjectOptions, marker.Manifest); err != nil {
+			return err
+		}
+
+		for _, source := range marker.Sources {
+			if err := c.supersedeManifest(ctx, source, marker.Key); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, source := range marker.Sources {
+		if err := c.deleteObject(ctx, source); err != nil {
+			return err
+		}
+	}
+
+	return c.deleteObject(ctx, markerKey)
+}
+
+// supersedeManifest marks the manifest of a merged file as compacted into key.
+// The manifest is kept, so the sequence numbers of its writer stay complete.
+func (c *Compactor) supersedeManifest(ctx context.Context, source string, key string) error {
+	manifest, err := getFileManifest(ctx, c.svc, c.bucketName, c.opts.ManifestsPrefix, source)
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil || manifest.CompactedInto == key {
+		return nil
+	}
+
+	manifest.CompactedInto = key
+	return putFileManifest(ctx, c.svc, c.bucketName, c.opts.ManifestsPrefix, c.opts.ObjectOptions, manifest)
+}
+
+func (c *Compactor) deleteObject(ctx context.Context, key string) error {
+	if _, err := c.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(key),
+	}); err != nil {
+		return fmt.Errorf("failed to delete compacted object: %w", err)
+	}
+
+	return nil
+}
+
+// batchFiles groups files, so every batch stays below the target file size.
+func (c *Compactor) batchFiles(objects []types.Object) [][]types.Object {
+	batches := [][]types.Object{}
+	batch := []types.Object{}
+	var batchSize int64
+
+	for _, object := range objects {
+		if len(batch) > 0 && batchSize+object.Size > c.opts.TargetFileSize {
+			batches = append(batches, batch)
+			batch = []types.Object{}
+			batchSize = 0
+		}
+
+		batch = append(batch, object)
+		batchSize += object.Size
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+func (c *Compactor) compactFiles(ctx context.Context, datehour string, objects []types.Object) error {
+	records := []SpanRecord{}
+	compactedObjects := []types.Object{}
+	for _, object := range objects {
+		objectRecords, err := c.readFile(ctx, *object.Key)
+		if errors.Is(err, errIncompatibleParquetFile) {
+			c.logger.Warn("skipping file with incompatible schema", "key", *object.Key, "error", err)
+			c.skippedFiles++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		records = append(records, objectRecords...)
+		compactedObjects = append(compactedObjects, object)
+	}
+
+	if len(compactedObjects) < 2 {
+		return nil
+	}
+	objects = compactedObjects
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].TraceID == records[j].TraceID {
+			return records[i].StartTime < records[j].StartTime
+		}
+		return records[i].TraceID < records[j].TraceID
+	})
+
+	c.sequence++
+	key := S3ParquetKey(c.prefix, FileName(c.instanceID, c.startedAt, c.sequence), datehour)
+
+	localPath, err := c.writeFile(records)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+
+	marker := &compactionMarker{Key: key, Sources: make([]string, len(objects))}
+	for i, object := range objects {
+		marker.Sources[i] = *object.Key
+	}
+
+	if c.opts.ManifestsPrefix != "" {
+		if marker.Manifest, err = c.newFileManifest(key, datehour, localPath, marker.Sources, records); err != nil {
+			return err
+		}
+	}
+
+	markerKey := c.markerKey(key)
+	if err := putCompactionMarker(ctx, c.svc, c.bucketName, c.opts.ObjectOptions, markerKey, marker); err != nil {
+		return err
+	}
+
+	if err := c.uploader.Upload(ctx, key, localPath); err != nil {
+		// The next run removes the marker, if this fails as well
+		if deleteErr := c.deleteObject(ctx, markerKey); deleteErr != nil {
+			c.logger.Warn("failed to delete compaction marker", "key", markerKey, "error", deleteErr)
+		}
+		return fmt.Errorf("failed to upload compacted file: %w", err)
+	}
+
+	// Only remove the merged files once the compacted file is in place
+	if err := c.finishCompaction(ctx, markerKey, marker); err != nil {
+		return err
+	}
+
+	c.logger.Info("compacted partition", "datehour", datehour, "files", len(objects), "rows", len(records), "key", key)
+
+	return nil
+}
+
+func (c *Compactor) readFile(ctx context.Context, key string) ([]SpanRecord, error) {
+	output, err := c.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer output.Body.Close()
+
+	// Stream the object to disk, so only the decoded records are kept in memory
+	localPath := filepath.Join(c.bufferDirectory(), RandStringBytes(32)+".parquet")
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local parquet file: %w", err)
+	}
+	defer os.Remove(localPath)
+
+	_, err = io.Copy(localFile, output.Body)
+	if closeErr := localFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object: %w", err)
+	}
+
+	readFile, err := local.NewLocalFileReader(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local parquet file: %w", err)
+	}
+	defer readFile.Close()
+
+	pr, err := reader.NewParquetReader(readFile, new(SpanRecord), PARQUET_CONCURRENCY)
+	if err != nil {
+		// Files written before a column was added can't be read with the current schema
+		return nil, fmt.Errorf("%w: %v", errIncompatibleParquetFile, err)
+	}
+	defer pr.ReadStop()
+
+	records := make([]SpanRecord, pr.GetNumRows())
+	if err := pr.Read(&records); err != nil {
+		return nil, fmt.Errorf("failed to read parquet file %s: %w", key, err)
+	}
+
+	return records, nil
+}
+
+func (c *Compactor) bufferDirectory() string {
+	if c.opts.BufferDirectory == "" {
+		return os.TempDir()
+	}
+
+	return c.opts.BufferDirectory
+}
+
+func (c *Compactor) newFileManifest(key string, partition string, localPath string, sources []string, records []SpanRecord) (*FileManifest, error) {
+	fileInfo, err := os.Stat(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat compacted file: %w", err)
+	}
+
+	manifest := &FileManifest{
+		Key:        key,
+		Partition:  partition,
+		InstanceID: c.instanceID,
+		StartedAt:  c.startedAt,
+		Sequence:   c.sequence,
+		Rows:       int64(len(records)),
+		Bytes:      fileInfo.Size(),
+		Services:   []string{},
+		Sources:    sources,
+	}
+
+	services := map[string]bool{}
+	for i, record := range records {
+		startTime := recordTime(record.StartTime).UTC()
+		if i == 0 || startTime.Before(manifest.MinStartTime) {
+			manifest.MinStartTime = startTime
+		}
+		if startTime.After(manifest.MaxStartTime) {
+			manifest.MaxStartTime = startTime
+		}
+
+		if !services[record.ServiceName] {
+			services[record.ServiceName] = true
+			manifest.Services = append(manifest.Services, record.ServiceName)
+		}
+	}
+	sort.Strings(manifest.Services)
+
+	return manifest, nil
+}
+
+// writeFile writes the records into a local parquet file and returns its path.
+func (c *Compactor) writeFile(records []SpanRecord) (string, error) {
+	localPath := filepath.Join(c.bufferDirectory(), RandStringBytes(32)+".parquet")
+	writeFile, err := local.NewLocalFileWriter(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create local parquet file: %w", err)
+	}
+
+	var rowType interface{} = new(SpanRecord)
+	if c.opts.PromotedTags != nil {
+		rowType = c.opts.PromotedTags.RowType()
+	}
+
+	parquetWriter, err := c.opts.ParquetOptions.NewWriter(writeFile, rowType)
+	if err != nil {
+		writeFile.Close()
+		os.Remove(localPath)
+		return "", fmt.Errorf("failed to create parquet writer: %w", err)
+	}
+
+	for i := range records {
+		var row interface{} = &records[i]
+		if c.opts.PromotedTags != nil {
+			if row, err = c.opts.PromotedTags.MapRow(row); err != nil {
+				writeFile.Close()
+				os.Remove(localPath)
+				return "", fmt.Errorf("failed to map row: %w", err)
+			}
+		}
+
+		if err := parquetWriter.Write(row); err != nil {
+			writeFile.Close()
+			os.Remove(localPath)
+			return "", fmt.Errorf("failed to write row: %w", err)
+		}
+	}
+
+	if err := parquetWriter.WriteStop(); err != nil {
+		writeFile.Close()
+		os.Remove(localPath)
+		return "", fmt.Errorf("parquet write stop error: %w", err)
+	}
+
+	if err := writeFile.Close(); err != nil {
+		os.Remove(localPath)
+		return "", fmt.Errorf("parquet file write close error: %w", err)
+	}
+
+	return localPath, nil
+}
@@ -0,0 +1,309 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+func newTestParquetBytes(assert *assert.Assertions, records []SpanRecord) []byte {
+	bufferFile := buffer.NewBufferFile()
+	parquetWriter, err := writer.NewParquetWriter(bufferFile, new(SpanRecord), PARQUET_CONCURRENCY)
+	assert.NoError(err)
+
+	for i := range records {
+		records[i].Tags = map[string]string{}
+		records[i].References = []SpanRecordReferences{}
+		assert.NoError(parquetWriter.Write(&records[i]))
+	}
+	assert.NoError(parquetWriter.WriteStop())
+
+	return bufferFile.Bytes()
+}
+
+func TestCompactorCompactPartition(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	files := map[string][]byte{
+		"spans/2021/01/30/06/a.parquet": newTestParquetBytes(assert, []SpanRecord{
+			{TraceID: "0000000000000003", SpanID: "1", StartTime: 1},
+			{TraceID: "0000000000000001", SpanID: "2", StartTime: 2},
+		}),
+		"spans/2021/01/30/06/b.parquet": newTestParquetBytes(assert, []SpanRecord{
+			{TraceID: "0000000000000002", SpanID: "3", StartTime: 3},
+		}),
+	}
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			assert.Equal("spans/2021/01/30/06/", *input.Prefix)
+
+			return &s3.ListObjectsV2Output{
+				Contents: []types.Object{
+					{Key: aws.String("spans/2021/01/30/06/a.parquet"), Size: int64(len(files["spans/2021/01/30/06/a.parquet"]))},
+					{Key: aws.String("spans/2021/01/30/06/b.parquet"), Size: int64(len(files["spans/2021/01/30/06/b.parquet"]))},
+					{Key: aws.String("spans/2021/01/30/06/large.parquet"), Size: 1024 * 1024},
+				},
+			}, nil
+		}).Times(1)
+	mockSvc.EXPECT().GetObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(files[*input.Key]))}, nil
+		}).Times(2)
+
+	var marker compactionMarker
+	var markerKey string
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			markerKey = *input.Key
+			return &s3.PutObjectOutput{}, json.NewDecoder(input.Body).Decode(&marker)
+		}).Times(1)
+
+	var compactedKey string
+	var compactedBody []byte
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			compactedKey = *input.Key
+			body, err := io.ReadAll(input.Body)
+			compactedBody = body
+			return &s3.PutObjectOutput{}, err
+		}).Times(1)
+
+	deletedKeys := []string{}
+	mockSvc.EXPECT().DeleteObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deletedKeys = append(deletedKeys, *input.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		}).Times(3)
+
+	compactor := NewCompactor(hclog.NewNullLogger(), mockSvc, "jaeger-spans", "spans/", CompactorOptions{
+		TargetFileSize:  512 * 1024,
+		BufferDirectory: t.TempDir(),
+		RetryOptions:    testRetryOptions,
+		InstanceID:      "compactor-0",
+	})
+
+	assert.NoError(compactor.CompactPartition(ctx, "2021/01/30/06"))
+
+	assert.Regexp(`^spans/2021/01/30/06/compactor-0-\d{8}T\d{6}Z-000001\.parquet$`, compactedKey)
+	assert.Regexp(`^spans/2021/01/30/06/_compaction-compactor-0-\d{8}T\d{6}Z-000001\.json$`, markerKey)
+	assert.Nil(marker.Manifest)
+	assert.Equal(compactedKey, marker.Key)
+	assert.Equal([]string{"spans/2021/01/30/06/a.parquet", "spans/2021/01/30/06/b.parquet"}, marker.Sources)
+	assert.Equal([]string{"spans/2021/01/30/06/a.parquet", "spans/2021/01/30/06/b.parquet", markerKey}, deletedKeys)
+
+	pr, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(compactedBody), new(SpanRecord), PARQUET_CONCURRENCY)
+	assert.NoError(err)
+	defer pr.ReadStop()
+
+	records := make([]SpanRecord, pr.GetNumRows())
+	assert.NoError(pr.Read(&records))
+
+	traceIDs := []string{}
+	for _, record := range records {
+		traceIDs = append(traceIDs, record.TraceID)
+	}
+	assert.Equal([]string{"0000000000000001", "0000000000000002", "0000000000000003"}, traceIDs)
+}
+
+func TestCompactorSkipsSingleFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("spans/2021/01/30/06/a.parquet"), Size: 100},
+			},
+		}, nil).Times(1)
+
+	compactor := NewCompactor(hclog.NewNullLogger(), mockSvc, "jaeger-spans", "spans/", CompactorOptions{
+		TargetFileSize: 512 * 1024,
+		RetryOptions:   testRetryOptions,
+	})
+
+	assert.NoError(compactor.CompactPartition(ctx, "2021/01/30/06"))
+}
+
+func TestCompactorKeepsServicePartitionsSeparate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("spans/2021/01/30/06/backend/a.parquet"), Size: 100},
+				{Key: aws.String("spans/2021/01/30/06/frontend/b.parquet"), Size: 100},
+			},
+		}, nil).Times(1)
+
+	compactor := NewCompactor(hclog.NewNullLogger(), mockSvc, "jaeger-spans", "spans/", CompactorOptions{
+		TargetFileSize: 512 * 1024,
+		RetryOptions:   testRetryOptions,
+	})
+
+	assert.NoError(compactor.CompactPartition(ctx, "2021/01/30/06"))
+}
+
+func TestCompactorCompletesInterruptedCompaction(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	marker, err := json.Marshal(&compactionMarker{
+		Key:     "spans/2021/01/30/06/compacted-a.parquet",
+		Sources: []string{"spans/2021/01/30/06/a.parquet", "spans/2021/01/30/06/b.parquet"},
+	})
+	assert.NoError(err)
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("spans/2021/01/30/06/_compaction-compacted-a.json"), Size: 100},
+				{Key: aws.String("spans/2021/01/30/06/b.parquet"), Size: 100},
+				{Key: aws.String("spans/2021/01/30/06/compacted-a.parquet"), Size: 200},
+				{Key: aws.String("spans/2021/01/30/06/_compaction-compacted-c.json"), Size: 100},
+			},
+		}, nil).Times(1)
+	mockSvc.EXPECT().GetObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if *input.Key == "spans/2021/01/30/06/_compaction-compacted-a.json" {
+				return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(marker))}, nil
+			}
+
+			// The compacted file of this marker was never uploaded
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(
+				`{"key":"spans/2021/01/30/06/compacted-c.parquet","sources":["spans/2021/01/30/06/b.parquet"]}`))}, nil
+		}).Times(2)
+
+	deletedKeys := []string{}
+	mockSvc.EXPECT().DeleteObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deletedKeys = append(deletedKeys, *input.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		}).Times(4)
+
+	compactor := NewCompactor(hclog.NewNullLogger(), mockSvc, "jaeger-spans", "spans/", CompactorOptions{
+		TargetFileSize: 512 * 1024,
+		RetryOptions:   testRetryOptions,
+	})
+
+	// Only the compacted file is left, so nothing is compacted again
+	assert.NoError(compactor.CompactPartition(ctx, "2021/01/30/06"))
+
+	assert.Equal([]string{
+		"spans/2021/01/30/06/a.parquet",
+		"spans/2021/01/30/06/b.parquet",
+		"spans/2021/01/30/06/_compaction-compacted-a.json",
+		"spans/2021/01/30/06/_compaction-compacted-c.json",
+	}, deletedKeys)
+}
+
+func TestCompactorWritesManifests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	files := map[string][]byte{
+		"spans/2021/01/30/06/a.parquet": newTestParquetBytes(assert, []SpanRecord{
+			{TraceID: "0000000000000001", SpanID: "1", StartTime: 1611988440000, ServiceName: "frontend"},
+		}),
+		"spans/2021/01/30/06/b.parquet": newTestParquetBytes(assert, []SpanRecord{
+			{TraceID: "0000000000000002", SpanID: "2", StartTime: 1611988500000, ServiceName: "backend"},
+		}),
+		"manifests/spans/2021/01/30/06/a.json": []byte(`{"key":"spans/2021/01/30/06/a.parquet","instance_id":"collector-0","sequence":7}`),
+	}
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("spans/2021/01/30/06/a.parquet"), Size: int64(len(files["spans/2021/01/30/06/a.parquet"]))},
+				{Key: aws.String("spans/2021/01/30/06/b.parquet"), Size: int64(len(files["spans/2021/01/30/06/b.parquet"]))},
+			},
+		}, nil).Times(1)
+	mockSvc.EXPECT().GetObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body, ok := files[*input.Key]
+			if !ok {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+		}).Times(4)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.PutObjectOutput{}, nil).Times(1)
+
+	manifests := map[string]*FileManifest{}
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			manifest := &FileManifest{}
+			manifests[*input.Key] = manifest
+			return &s3.PutObjectOutput{}, json.NewDecoder(input.Body).Decode(manifest)
+		}).Times(3)
+	mockSvc.EXPECT().DeleteObject(gomock.Any(), gomock.Any()).
+		Return(&s3.DeleteObjectOutput{}, nil).Times(3)
+
+	compactor := NewCompactor(hclog.NewNullLogger(), mockSvc, "jaeger-spans", "spans/", CompactorOptions{
+		TargetFileSize:  512 * 1024,
+		BufferDirectory: t.TempDir(),
+		RetryOptions:    testRetryOptions,
+		InstanceID:      "compactor-0",
+		ManifestsPrefix: "manifests/",
+	})
+
+	assert.NoError(compactor.CompactPartition(ctx, "2021/01/30/06"))
+
+	var compacted *FileManifest
+	for key, manifest := range manifests {
+		if strings.HasPrefix(key, "manifests/spans/2021/01/30/06/compactor-0-") {
+			compacted = manifest
+		}
+	}
+	assert.NotNil(compacted)
+	assert.Equal("compactor-0", compacted.InstanceID)
+	assert.Equal(uint64(1), compacted.Sequence)
+	assert.Equal(int64(2), compacted.Rows)
+	assert.Equal([]string{"backend", "frontend"}, compacted.Services)
+	assert.Equal([]string{"spans/2021/01/30/06/a.parquet", "spans/2021/01/30/06/b.parquet"}, compacted.Sources)
+	assert.True(time.UnixMilli(1611988440000).Equal(compacted.MinStartTime))
+	assert.True(time.UnixMilli(1611988500000).Equal(compacted.MaxStartTime))
+
+	// The collector manifest points to the compacted file, b had no manifest
+	superseded := manifests["manifests/spans/2021/01/30/06/a.json"]
+	assert.NotNil(superseded)
+	assert.Equal(uint64(7), superseded.Sequence)
+	assert.Equal(compacted.Key, superseded.CompactedInto)
+}
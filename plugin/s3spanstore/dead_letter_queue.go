@@ -0,0 +1,336 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+// DeadLetterQueue keeps parquet files, which could not be uploaded after all
+// retries, until they are replayed.
+type DeadLetterQueue interface {
+	// Put stores the local parquet file at path, which should have been uploaded
+	// to key, and its manifest, which may be nil
+	Put(ctx context.Context, key string, path string, manifest *FileManifest) error
+	// Replay calls fn for every stored file and removes it if fn succeeds. The
+	// manifest is nil for files stored without one.
+	Replay(ctx context.Context, fn func(key string, body io.ReadSeeker, manifest *FileManifest) error) error
+}
+
+// deadLetterManifestSuffix names the manifest stored next to a dead letter, so
+// the file can be committed like any other file once it is replayed
+const deadLetterManifestSuffix = ".manifest.json"
+
+var (
+	_ DeadLetterQueue = (*LocalDeadLetterQueue)(nil)
+	_ DeadLetterQueue = (*S3DeadLetterQueue)(nil)
+)
+
+// NewDeadLetterQueue returns the configured dead letter queue or nil if none is configured.
+func NewDeadLetterQueue(svc S3API, s3Config config.S3) (DeadLetterQueue, error) {
+	if s3Config.DeadLetterDirectory != "" && s3Config.DeadLetterPrefix != "" {
+		return nil, fmt.Errorf("only one of dead letter directory and dead letter prefix can be configured")
+	}
+
+	if s3Config.DeadLetterDirectory != "" {
+		return NewLocalDeadLetterQueue(s3Config.DeadLetterDirectory)
+	}
+
+	if s3Config.DeadLetterPrefix != "" {
+		objectOptions, err := NewObjectOptions(s3Config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse object options: %w", err)
+		}
+
+		return NewS3DeadLetterQueue(svc, s3Config.BucketName, s3Config.DeadLetterPrefix, objectOptions, s3Config.BufferDirectory), nil
+	}
+
+	return nil, nil
+}
+
+// LocalDeadLetterQueue stores failed files in a local directory, preserving their key as path.
+type LocalDeadLetterQueue struct {
+	dir string
+}
+
+func NewLocalDeadLetterQueue(dir string) (*LocalDeadLetterQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+
+	return &LocalDeadLetterQueue{dir: dir}, nil
+}
+
+func (q *LocalDeadLetterQueue) Put(ctx context.Context, key string, path string, manifest *FileManifest) error {
+	target := filepath.Join(q.dir, filepath.FromSlash(key))
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+
+	if err := moveFile(path, target); err != nil {
+		return fmt.Errorf("failed to move file to dead letter directory: %w", err)
+	}
+
+	if manifest == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to serialize manifest: %w", err)
+	}
+
+	if err := os.WriteFile(target+deadLetterManifestSuffix, body, 0644); err != nil {
+		return fmt.Errorf("failed to write dead letter manifest: %w", err)
+	}
+
+	return nil
+}
+
+func (q *LocalDeadLetterQueue) Replay(ctx context.Context, fn func(key string, body io.ReadSeeker, manifest *FileManifest) error) error {
+	return filepath.Walk(q.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasSuffix(path, deadLetterManifestSuffix) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(q.dir, path)
+		if err != nil {
+			return fmt.Errorf("failed to get dead letter key: %w", err)
+		}
+
+		manifest, err := q.readManifest(path)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open dead letter file: %w", err)
+		}
+
+		if err := fn(filepath.ToSlash(relPath), file, manifest); err != nil {
+			file.Close()
+			return err
+		}
+		file.Close()
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove dead letter file: %w", err)
+		}
+
+		if err := os.Remove(path + deadLetterManifestSuffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove dead letter manifest: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (q *LocalDeadLetterQueue) readManifest(path string) (*FileManifest, error) {
+	body, err := os.ReadFile(path + deadLetterManifestSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letter manifest: %w", err)
+	}
+
+	return decodeDeadLetterManifest(body)
+}
+
+func decodeDeadLetterManifest(body []byte) (*FileManifest, error) {
+	manifest := &FileManifest{}
+	if err := json.Unmarshal(body, manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode dead letter manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// S3DeadLetterQueue stores failed files under a separate prefix in a bucket.
+// Replayed files are downloaded into bufferDirectory, the default temporary
+// directory if empty.
+type S3DeadLetterQueue struct {
+	svc             S3API
+	bucketName      string
+	prefix          string
+	objectOptions   ObjectOptions
+	bufferDirectory string
+}
+
+func NewS3DeadLetterQueue(svc S3API, bucketName string, prefix string, objectOptions ObjectOptions, bufferDirectory string) *S3DeadLetterQueue {
+	return &S3DeadLetterQueue{svc: svc, bucketName: bucketName, prefix: prefix, objectOptions: objectOptions, bufferDirectory: bufferDirectory}
+}
+
+func (q *S3DeadLetterQueue) Put(ctx context.Context, key string, path string, manifest *FileManifest) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	if err := q.putObject(ctx, q.prefix+key, file); err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		body, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("failed to serialize manifest: %w", err)
+		}
+
+		if err := q.putObject(ctx, q.prefix+key+deadLetterManifestSuffix, bytes.NewReader(body)); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(path)
+}
+
+func (q *S3DeadLetterQueue) putObject(ctx context.Context, key string, body io.Reader) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(q.bucketName),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	q.objectOptions.Apply(input)
+
+	if _, err := q.svc.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("failed to put dead letter object: %w", err)
+	}
+
+	return nil
+}
+
+func (q *S3DeadLetterQueue) Replay(ctx context.Context, fn func(key string, body io.ReadSeeker, manifest *FileManifest) error) error {
+	paginator := s3.NewListObjectsV2Paginator(q.svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(q.bucketName),
+		Prefix: aws.String(q.prefix),
+	})
+
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed fetch page: %w", err)
+		}
+
+		for _, object := range output.Contents {
+			if strings.HasSuffix(*object.Key, deadLetterManifestSuffix) {
+				continue
+			}
+
+			manifest, err := q.getManifest(ctx, *object.Key+deadLetterManifestSuffix)
+			if err != nil {
+				return err
+			}
+
+			file, err := q.downloadObject(ctx, *object.Key)
+			if err != nil {
+				return err
+			}
+
+			err = fn(strings.TrimPrefix(*object.Key, q.prefix), file, manifest)
+			file.Close()
+			os.Remove(file.Name())
+			if err != nil {
+				return err
+			}
+
+			for _, key := range []string{*object.Key, *object.Key + deadLetterManifestSuffix} {
+				if _, err := q.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: aws.String(q.bucketName),
+					Key:    aws.String(key),
+				}); err != nil {
+					return fmt.Errorf("failed to delete dead letter object: %w", err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (q *S3DeadLetterQueue) getManifest(ctx context.Context, key string) (*FileManifest, error) {
+	body, err := q.getObject(ctx, key)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return decodeDeadLetterManifest(body)
+}
+
+func (q *S3DeadLetterQueue) getObject(ctx context.Context, key string) ([]byte, error) {
+	output, err := q.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(q.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letter object: %w", err)
+	}
+	defer output.Body.Close()
+
+	body, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letter object: %w", err)
+	}
+
+	return body, nil
+}
+
+// downloadObject streams the dead letter at key into a temporary file, so it
+// isn't kept in memory.
+func (q *S3DeadLetterQueue) downloadObject(ctx context.Context, key string) (*os.File, error) {
+	output, err := q.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(q.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letter object: %w", err)
+	}
+	defer output.Body.Close()
+
+	if q.bufferDirectory != "" {
+		if err := os.MkdirAll(q.bufferDirectory, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create buffer directory: %w", err)
+		}
+	}
+
+	file, err := os.CreateTemp(q.bufferDirectory, "dead-letter-*.parquet")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local dead letter file: %w", err)
+	}
+
+	if _, err := io.Copy(file, output.Body); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to download dead letter object: %w", err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to rewind local dead letter file: %w", err)
+	}
+
+	return file, nil
+}
@@ -3,10 +3,13 @@ package s3spanstore
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/metrics"
 )
 
 type DedupeParquetWriter struct {
@@ -15,13 +18,32 @@ type DedupeParquetWriter struct {
 	dedupeDuration              time.Duration
 	dedupeRewriteBufferDuration time.Duration
 	parquetWriter               IParquetWriter
+
+	cacheHits   *metrics.Counter
+	cacheMisses *metrics.Counter
+
+	// Optional persisted state, see WarmStart
+	stateStore     *DedupeStateStore
+	stateDone      chan struct{}
+	stateWaitGroup sync.WaitGroup
+	stopOnce       sync.Once
 }
 
 type DeduplicatableRow interface {
 	DedupeKey() string
 }
 
-func NewDedupeParquetWriter(logger hclog.Logger, dedupeDuration time.Duration, dedupeRewriteBufferDuration time.Duration, dedupeCacheSize int, parquetWriter IParquetWriter) (*DedupeParquetWriter, error) {
+// dedupeEntry is the dedupe cache value of a key
+type dedupeEntry struct {
+	// until is the time until which rows with the key are skipped
+	until time.Time
+	// writtenAt is the time the row was written, zero for seeded entries
+	writtenAt time.Time
+}
+
+// NewDedupeParquetWriter deduplicates the rows written to parquetWriter, dataset
+// names the deduplicated rows in metrics, e.g. operations.
+func NewDedupeParquetWriter(logger hclog.Logger, dataset string, dedupeDuration time.Duration, dedupeRewriteBufferDuration time.Duration, dedupeCacheSize int, parquetWriter IParquetWriter) (*DedupeParquetWriter, error) {
 	dedupeCache, err := lru.New(dedupeCacheSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create service cache, %v", err)
@@ -33,16 +55,20 @@ func NewDedupeParquetWriter(logger hclog.Logger, dedupeDuration time.Duration, d
 		dedupeDuration:              dedupeDuration,
 		dedupeRewriteBufferDuration: dedupeRewriteBufferDuration,
 		parquetWriter:               parquetWriter,
+		cacheHits:                   dedupeCacheRequestsTotal.With(dataset, metricsResultHit),
+		cacheMisses:                 dedupeCacheRequestsTotal.With(dataset, metricsResultMiss),
 	}
 
 	return w, nil
 }
 
 func (w *DedupeParquetWriter) Write(ctx context.Context, rowTime time.Time, maxBufferUntil time.Time, row DeduplicatableRow) error {
-	nextWriteTime, ok := w.dedupeCache.Get(row.DedupeKey())
-	if ok && rowTime.Before(nextWriteTime.(time.Time)) {
+	cached, ok := w.dedupeCache.Get(row.DedupeKey())
+	if ok && rowTime.Before(cached.(dedupeEntry).until) {
+		w.cacheHits.Inc()
 		return nil
 	}
+	w.cacheMisses.Inc()
 
 	var maxBufferUntilCached time.Time
 	if !ok {
@@ -54,11 +80,114 @@ func (w *DedupeParquetWriter) Write(ctx context.Context, rowTime time.Time, maxB
 	if err := w.parquetWriter.Write(ctx, rowTime, maxBufferUntilCached, row); err != nil {
 		return fmt.Errorf("failed to write row: %w", err)
 	}
-	w.dedupeCache.Add(row.DedupeKey(), rowTime.Add(w.dedupeDuration))
+	w.dedupeCache.Add(row.DedupeKey(), dedupeEntry{until: rowTime.Add(w.dedupeDuration), writtenAt: time.Now()})
+
+	return nil
+}
+
+// WarmStart seeds the dedupe cache from the state store and saves the cache to
+// the store every saveInterval and on shutdown. Only entries whose rows have
+// been uploaded are saved, so a crash never skips rows which were only buffered.
+// If the state can't be loaded, the cache starts empty and rows are rewritten
+// like without a state store.
+func (w *DedupeParquetWriter) WarmStart(ctx context.Context, stateStore *DedupeStateStore, saveInterval time.Duration) {
+	if entries, err := stateStore.Load(ctx); err != nil {
+		w.logger.Warn("failed to load dedupe state, starting with an empty cache", "error", err)
+	} else {
+		w.logger.Info("seeded dedupe cache", "entries", w.seed(entries))
+	}
+
+	w.stateStore = stateStore
+	w.stateDone = make(chan struct{})
+
+	w.stateWaitGroup.Add(1)
+	go func() {
+		defer w.stateWaitGroup.Done()
+
+		ticker := time.NewTicker(saveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stateDone:
+				return
+			case <-ticker.C:
+				if err := w.stateStore.Save(ctx, w.entries()); err != nil {
+					w.logger.Error("failed to save dedupe state", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// seed adds all unexpired entries which aren't cached yet, the latest ones are
+// added last so they are evicted last.
+func (w *DedupeParquetWriter) seed(entries map[string]time.Time) int {
+	now := time.Now()
+
+	keys := make([]string, 0, len(entries))
+	for key, until := range entries {
+		if until.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].Before(entries[keys[j]])
+	})
+
+	seeded := 0
+	for _, key := range keys {
+		if ok, _ := w.dedupeCache.ContainsOrAdd(key, dedupeEntry{until: entries[key]}); !ok {
+			seeded++
+		}
+	}
+
+	return seeded
+}
+
+// entries returns all unexpired entries of the dedupe cache, whose rows have
+// been uploaded.
+func (w *DedupeParquetWriter) entries() map[string]time.Time {
+	now := time.Now()
+	uploadedBefore := w.parquetWriter.UploadedBefore()
+	entries := map[string]time.Time{}
+
+	for _, key := range w.dedupeCache.Keys() {
+		value, ok := w.dedupeCache.Peek(key)
+		if !ok {
+			continue
+		}
+
+		if entry := value.(dedupeEntry); entry.until.After(now) && entry.writtenAt.Before(uploadedBefore) {
+			entries[key.(string)] = entry.until
+		}
+	}
+
+	return entries
+}
+
+// Shutdown flushes the parquet writer and afterwards saves the dedupe state.
+func (w *DedupeParquetWriter) Shutdown(ctx context.Context) error {
+	if w.stateStore != nil {
+		w.stopOnce.Do(func() {
+			close(w.stateDone)
+		})
+		w.stateWaitGroup.Wait()
+	}
+
+	if err := w.parquetWriter.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	if w.stateStore != nil {
+		if err := w.stateStore.Save(ctx, w.entries()); err != nil {
+			return fmt.Errorf("failed to save dedupe state: %w", err)
+		}
+	}
 
 	return nil
 }
 
 func (w *DedupeParquetWriter) Close() error {
-	return w.parquetWriter.Close()
+	return w.Shutdown(context.Background())
 }
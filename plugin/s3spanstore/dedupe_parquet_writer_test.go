@@ -2,11 +2,21 @@ package s3spanstore
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/golang/mock/gomock"
 	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,7 +36,7 @@ func NewTestDedupeParquetWriter(assert *assert.Assertions, parquetWriter IParque
 		JSONFormat: true,
 	})
 
-	writer, err := NewDedupeParquetWriter(logger, 100*time.Millisecond, testDedupeRewriteBufferDuration, 100, parquetWriter)
+	writer, err := NewDedupeParquetWriter(logger, "operations", 100*time.Millisecond, testDedupeRewriteBufferDuration, 100, parquetWriter)
 	assert.NoError(err)
 
 	return writer
@@ -34,6 +44,8 @@ func NewTestDedupeParquetWriter(assert *assert.Assertions, parquetWriter IParque
 
 type testWriter struct {
 	writes []interface{}
+	// uploadedBefore is returned by UploadedBefore, zero returns the current time
+	uploadedBefore time.Time
 }
 
 type writeItem struct {
@@ -46,10 +58,31 @@ func (w *testWriter) Write(ctx context.Context, time time.Time, maxBufferUntil t
 	return nil
 }
 
+func (w *testWriter) WriteRows(ctx context.Context, rows []ParquetRow) error {
+	for _, row := range rows {
+		if err := w.Write(ctx, row.Time, row.MaxBufferUntil, row.Row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *testWriter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
 func (w *testWriter) Close() error {
 	return nil
 }
 
+func (w *testWriter) UploadedBefore() time.Time {
+	if w.uploadedBefore.IsZero() {
+		return time.Now()
+	}
+
+	return w.uploadedBefore
+}
+
 type operation struct {
 	name string
 }
@@ -66,6 +99,8 @@ func TestDedupeParquetWriter(t *testing.T) {
 	writer := NewTestDedupeParquetWriter(assert, testWriter)
 
 	timeNow := time.Now()
+	hits := dedupeCacheRequestsTotal.With("operations", metricsResultHit).Value()
+	misses := dedupeCacheRequestsTotal.With("operations", metricsResultMiss).Value()
 
 	assert.NoError(writer.Write(ctx, timeNow, timeNow, operation{name: "a"}))
 	assert.NoError(writer.Write(ctx, timeNow, timeNow, operation{name: "a"}))
@@ -75,6 +110,9 @@ func TestDedupeParquetWriter(t *testing.T) {
 		writeItem{row: operation{name: "a"}, maxBufferUntil: timeNow},
 		writeItem{row: operation{name: "b"}, maxBufferUntil: timeNow},
 	}, testWriter.writes)
+
+	assert.Equal(hits+1, dedupeCacheRequestsTotal.With("operations", metricsResultHit).Value())
+	assert.Equal(misses+2, dedupeCacheRequestsTotal.With("operations", metricsResultMiss).Value())
 }
 
 func TestDedupeParquetWriterWritesAgain(t *testing.T) {
@@ -95,3 +133,96 @@ func TestDedupeParquetWriterWritesAgain(t *testing.T) {
 		writeItem{row: operation{name: "a"}, maxBufferUntil: futureTimeNow.Add(testDedupeRewriteBufferDuration)},
 	}, testWriter.writes)
 }
+
+func TestDedupeParquetWriterWarmStart(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	timeNow := time.Now()
+	states := map[string]string{
+		"state/operations/collector-0.json": fmt.Sprintf(`{"saved_at":%q,"entries":{"a":%q,"b":%q}}`, timeNow.Format(time.RFC3339Nano),
+			timeNow.Add(time.Minute).Format(time.RFC3339Nano), timeNow.Add(-time.Minute).Format(time.RFC3339Nano)),
+		"state/operations/collector-1.json": fmt.Sprintf(`{"saved_at":%q,"entries":{"a":%q}}`, timeNow.Format(time.RFC3339Nano),
+			timeNow.Add(time.Hour).Format(time.RFC3339Nano)),
+		// Saved longer than the dedupe duration ago, so it is ignored
+		"state/operations/collector-2.json": fmt.Sprintf(`{"saved_at":%q,"entries":{"c":%q}}`, timeNow.Add(-time.Hour*3).Format(time.RFC3339Nano),
+			timeNow.Add(time.Hour).Format(time.RFC3339Nano)),
+		// Unreadable states are skipped
+		"state/operations/collector-3.json": `{"saved_at":`,
+	}
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("state/operations/collector-0.json")},
+				{Key: aws.String("state/operations/collector-1.json")},
+				{Key: aws.String("state/operations/collector-2.json")},
+				{Key: aws.String("state/operations/collector-3.json")},
+			},
+		}, nil).Times(1)
+	mockSvc.EXPECT().GetObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(states[*input.Key]))}, nil
+		}).Times(4)
+	// A failed delete doesn't fail the warm start
+	mockSvc.EXPECT().DeleteObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			assert.Equal("state/operations/collector-2.json", *input.Key)
+			return nil, errors.New("access denied")
+		}).Times(1)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			assert.Equal("state/operations/collector-0.json", *input.Key)
+
+			state := &DedupeState{}
+			assert.NoError(json.NewDecoder(input.Body).Decode(state))
+			assert.Equal("collector-0", state.InstanceID)
+			assert.True(timeNow.Add(time.Hour).Equal(state.Entries["a"]))
+			assert.NotContains(state.Entries, "c")
+
+			return &s3.PutObjectOutput{}, nil
+		}).Times(1)
+
+	testWriter := &testWriter{writes: []interface{}{}}
+	writer := NewTestDedupeParquetWriter(assert, testWriter)
+	writer.WarmStart(ctx, NewDedupeStateStore(hclog.NewNullLogger(), mockSvc, "jaeger-spans", "state/operations/", "collector-0", time.Hour*2, ObjectOptions{}), time.Hour)
+
+	// a was written by another collector, b expired
+	assert.NoError(writer.Write(ctx, timeNow.Add(time.Minute*2), timeNow, operation{name: "a"}))
+	assert.NoError(writer.Write(ctx, timeNow, timeNow, operation{name: "b"}))
+
+	assert.Equal([]interface{}{
+		writeItem{row: operation{name: "b"}, maxBufferUntil: timeNow},
+	}, testWriter.writes)
+
+	assert.NoError(writer.Shutdown(ctx))
+}
+
+func TestDedupeParquetWriterOnlySavesUploadedEntries(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	testWriter := &testWriter{writes: []interface{}{}}
+	writer := NewTestDedupeParquetWriter(assert, testWriter)
+	writer.seed(map[string]time.Time{"a": time.Now().Add(time.Minute)})
+
+	assert.NoError(writer.Write(ctx, time.Now(), time.Now(), operation{name: "b"}))
+	time.Sleep(time.Millisecond)
+	uploadedBefore := time.Now()
+	time.Sleep(time.Millisecond)
+	assert.NoError(writer.Write(ctx, time.Now(), time.Now(), operation{name: "c"}))
+
+	// c is still buffered by the parquet writer
+	testWriter.uploadedBefore = uploadedBefore
+	entries := writer.entries()
+	assert.Contains(entries, "a")
+	assert.Contains(entries, "b")
+	assert.NotContains(entries, "c")
+
+	testWriter.uploadedBefore = time.Time{}
+	assert.Contains(writer.entries(), "c")
+}
@@ -0,0 +1,145 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/hashicorp/go-hclog"
+)
+
+// DedupeState is the persisted content of a dedupe cache, mapping dedupe keys
+// to the time until which rows with this key are skipped.
+type DedupeState struct {
+	InstanceID string               `json:"instance_id"`
+	SavedAt    time.Time            `json:"saved_at"`
+	Entries    map[string]time.Time `json:"entries"`
+}
+
+// DedupeStateStore saves the dedupe cache of a collector as object in S3, so
+// restarted collectors don't rewrite all rows.
+//
+// Every instance writes its own state object, but loads the state of all
+// instances, as their rows have been written as well. State objects not saved
+// within maxAge, e.g. of removed instances, only contain expired entries.
+type DedupeStateStore struct {
+	logger        hclog.Logger
+	svc           S3API
+	bucketName    string
+	prefix        string
+	instanceID    string
+	maxAge        time.Duration
+	objectOptions ObjectOptions
+}
+
+// NewDedupeStateStore creates a store, maxAge should be the dedupe duration.
+func NewDedupeStateStore(logger hclog.Logger, svc S3API, bucketName string, prefix string, instanceID string, maxAge time.Duration, objectOptions ObjectOptions) *DedupeStateStore {
+	return &DedupeStateStore{
+		logger:        logger,
+		svc:           svc,
+		bucketName:    bucketName,
+		prefix:        prefix,
+		instanceID:    NewInstanceID(instanceID),
+		maxAge:        maxAge,
+		objectOptions: objectOptions,
+	}
+}
+
+func (s *DedupeStateStore) key() string {
+	return s.prefix + s.instanceID + ".json"
+}
+
+// Load merges the entries of all state objects, keeping the latest time per key.
+// State objects older than maxAge are ignored and deleted, unreadable ones are
+// skipped, so they only miss their own entries.
+func (s *DedupeStateStore) Load(ctx context.Context) (map[string]time.Time, error) {
+	entries := map[string]time.Time{}
+	minSavedAt := time.Now().Add(-s.maxAge)
+
+	paginator := s3.NewListObjectsV2Paginator(s.svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(s.prefix),
+	})
+
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed fetch page: %w", err)
+		}
+
+		for _, object := range output.Contents {
+			state, err := s.getState(ctx, *object.Key)
+			if err != nil {
+				s.logger.Warn("skipping unreadable dedupe state", "key", *object.Key, "error", err)
+				continue
+			}
+
+			// Expired states are ignored either way, so a failed delete is retried on the next load
+			if state.SavedAt.Before(minSavedAt) {
+				if _, err := s.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: aws.String(s.bucketName),
+					Key:    object.Key,
+				}); err != nil {
+					s.logger.Warn("failed to delete expired dedupe state", "key", *object.Key, "error", err)
+				}
+				continue
+			}
+
+			for key, until := range state.Entries {
+				if until.After(entries[key]) {
+					entries[key] = until
+				}
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *DedupeStateStore) getState(ctx context.Context, key string) (*DedupeState, error) {
+	output, err := s.svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dedupe state object: %w", err)
+	}
+	defer output.Body.Close()
+
+	state := &DedupeState{}
+	if err := json.NewDecoder(output.Body).Decode(state); err != nil {
+		return nil, fmt.Errorf("failed to parse dedupe state object %s: %w", key, err)
+	}
+
+	return state, nil
+}
+
+// Save replaces the state object of this instance.
+func (s *DedupeStateStore) Save(ctx context.Context, entries map[string]time.Time) error {
+	body, err := json.Marshal(&DedupeState{
+		InstanceID: s.instanceID,
+		SavedAt:    time.Now().UTC(),
+		Entries:    entries,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to serialize dedupe state: %w", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketName),
+		Key:         aws.String(s.key()),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	s.objectOptions.Apply(input)
+
+	if _, err := s.svc.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("failed to put dedupe state object: %w", err)
+	}
+
+	return nil
+}
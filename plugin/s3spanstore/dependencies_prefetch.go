@@ -3,6 +3,7 @@ package s3spanstore
 import (
 	"context"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
@@ -14,8 +15,10 @@ type DependenciesPrefetch struct {
 	reader        ReaderWithDependencies
 	ticker        *time.Ticker
 	enabled       bool
-	done          chan bool
+	done          chan struct{}
 	ctx           context.Context
+	cancel        context.CancelFunc
+	stopOnce      sync.Once
 	sleepDuration time.Duration
 }
 
@@ -27,13 +30,16 @@ func NewDependenciesPrefetch(ctx context.Context, logger hclog.Logger, reader Re
 	s1 := rand.NewSource(time.Now().UnixNano())
 	r1 := rand.New(s1)
 
+	ctx, cancel := context.WithCancel(ctx)
+
 	return &DependenciesPrefetch{
 		logger:        logger,
 		reader:        reader,
 		ticker:        time.NewTicker(interval),
 		enabled:       enabled,
-		done:          make(chan bool),
+		done:          make(chan struct{}),
 		ctx:           ctx,
+		cancel:        cancel,
 		sleepDuration: time.Second * time.Duration(r1.Intn(180)),
 	}
 }
@@ -61,19 +67,23 @@ func (d *DependenciesPrefetch) Start() {
 
 func (d *DependenciesPrefetch) prefetchDependencies() {
 	// Ensure different readers don't refresh at the same time
-	time.Sleep(d.sleepDuration)
+	select {
+	case <-d.done:
+		return
+	case <-time.After(d.sleepDuration):
+	}
 
 	// GetDependencies to ensure the result is cached
-	if _, err := d.reader.GetDependencies(d.ctx, time.Now(), time.Hour*24*7); err != nil {
+	if _, err := d.reader.GetDependencies(d.ctx, time.Now(), time.Hour*24*7); err != nil && d.ctx.Err() == nil {
 		d.logger.Error("failed to get dependencies", err)
 	}
 }
 
+// Stop cancels a running prefetch without waiting for it.
 func (d *DependenciesPrefetch) Stop() {
-	if !d.enabled {
-		return
-	}
-
-	d.ticker.Stop()
-	d.done <- true
+	d.stopOnce.Do(func() {
+		d.ticker.Stop()
+		d.cancel()
+		close(d.done)
+	})
 }
@@ -72,3 +72,29 @@ func TestDependenciesPrefetchDisabled(t *testing.T) {
 
 	prefetch.Stop()
 }
+
+func TestDependenciesPrefetchStopDuringSleep(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	testReader := &testReader{called: 0}
+	prefetch := NewTestDependencyPrefetch(ctx, assert, testReader, true)
+	prefetch.sleepDuration = time.Hour
+	prefetch.Start()
+
+	stopped := make(chan struct{})
+	go func() {
+		prefetch.Stop()
+		prefetch.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		assert.Fail("stop blocked")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(0, testReader.called)
+}
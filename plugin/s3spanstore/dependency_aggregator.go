@@ -0,0 +1,354 @@
+package s3spanstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/hashicorp/go-hclog"
+	"github.com/xitongsys/parquet-go-source/local"
+)
+
+const (
+	aggregatedDependenciesFilePrefix = "aggregated-"
+
+	// aggregationMarkerPrefix names the markers of running aggregations. Athena
+	// ignores files starting with an underscore.
+	aggregationMarkerPrefix = "_aggregation-"
+)
+
+// DependencyAggregator merges the dependency files of closed partitions into a
+// single file per partition, summing the call counts by parent and child.
+// Links the writers couldn't resolve are resolved by looking up their parent
+// span in the spans table using Athena.
+//
+// Only the files listed before the query are merged and deleted, so files
+// uploaded in between are merged by the next run. The name of the aggregated
+// file is derived from the merged files and a marker records them until they
+// are deleted, so an interrupted run is completed instead of counting the
+// same calls twice. Only a single aggregator should run at a time.
+type DependencyAggregator struct {
+	logger     hclog.Logger
+	svc        S3API
+	reader     *Reader
+	bucketName string
+	prefix     string
+	opts       CompactorOptions
+	uploader   *ParquetUploader
+}
+
+// NewDependencyAggregator uses the MinAge, Lookback and file options of the
+// compactor, the tables are queried using reader.
+func NewDependencyAggregator(logger hclog.Logger, svc S3API, reader *Reader, bucketName string, prefix string, opts CompactorOptions) *DependencyAggregator {
+	return &DependencyAggregator{
+		logger:     logger,
+		svc:        svc,
+		reader:     reader,
+		bucketName: bucketName,
+		prefix:     prefix,
+		opts:       opts,
+		uploader:   NewParquetUploader(logger, svc, bucketName, opts.RetryOptions, opts.ObjectOptions, nil),
+	}
+}
+
+// Run aggregates all closed partitions within the lookback window.
+func (a *DependencyAggregator) Run(ctx context.Context) error {
+	if a.reader.cfg.DependenciesTableName == "" {
+		return fmt.Errorf("no dependencies table configured")
+	}
+
+	interval := a.opts.PartitionScheme.Interval()
+	newest := a.opts.PartitionScheme.Truncate(time.Now().Add(-a.opts.MinAge)).Add(-interval)
+	oldest := newest.Add(-a.opts.Lookback)
+
+	for partitionTime := newest; partitionTime.After(oldest); partitionTime = partitionTime.Add(-interval) {
+		if err := a.AggregatePartition(ctx, partitionTime); err != nil {
+			return fmt.Errorf("failed to aggregate partition: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// AggregatePartition merges all dependency files of the partition starting at partitionTime.
+func (a *DependencyAggregator) AggregatePartition(ctx context.Context, partitionTime time.Time) error {
+	datehour := a.opts.PartitionScheme.TimeKey(partitionTime)
+
+	keys, markerKeys, err := a.listFiles(ctx, datehour)
+	if err != nil {
+		return err
+	}
+
+	keys, err = a.recoverAggregations(ctx, keys, markerKeys)
+	if err != nil {
+		return err
+	}
+
+	// Already aggregated
+	if len(keys) == 0 || (len(keys) == 1 && strings.HasPrefix(path.Base(keys[0]), aggregatedDependenciesFilePrefix)) {
+		return nil
+	}
+
+	records, err := a.queryLinks(ctx, partitionTime, keys)
+	if err != nil {
+		return err
+	}
+
+	key := S3ParquetKey(a.prefix, aggregatedDependenciesFilePrefix+aggregationID(keys), datehour)
+	if len(records) == 0 {
+		// Nothing to keep, all links were dropped
+		if err := a.deleteObjects(ctx, keys); err != nil {
+			return err
+		}
+	} else {
+		marker := &compactionMarker{Key: key, Sources: keys}
+		markerKey := a.markerKey(key)
+		if err := putCompactionMarker(ctx, a.svc, a.bucketName, a.opts.ObjectOptions, markerKey, marker); err != nil {
+			return err
+		}
+
+		if err := a.writeFile(ctx, key, records); err != nil {
+			// The next run removes the marker, if this fails as well
+			if deleteErr := a.deleteObjects(ctx, []string{markerKey}); deleteErr != nil {
+				a.logger.Warn("failed to delete aggregation marker", "key", markerKey, "error", deleteErr)
+			}
+			return err
+		}
+
+		// Only remove the merged files once the aggregated file is in place
+		if err := a.deleteObjects(ctx, append(marker.Sources, markerKey)); err != nil {
+			return err
+		}
+	}
+
+	a.logger.Info("aggregated dependencies", "datehour", datehour, "files", len(keys), "links", len(records), "key", key)
+
+	return nil
+}
+
+// listFiles returns all parquet files and aggregation markers of the partition.
+func (a *DependencyAggregator) listFiles(ctx context.Context, datehour string) ([]string, []string, error) {
+	paginator := s3.NewListObjectsV2Paginator(a.svc, &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucketName),
+		Prefix: aws.String(a.prefix + datehour + "/"),
+	})
+
+	keys := []string{}
+	markerKeys := []string{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed fetch page: %w", err)
+		}
+
+		for _, object := range output.Contents {
+			if strings.HasPrefix(path.Base(*object.Key), aggregationMarkerPrefix) {
+				markerKeys = append(markerKeys, *object.Key)
+				continue
+			}
+
+			if strings.HasSuffix(*object.Key, ".parquet") {
+				keys = append(keys, *object.Key)
+			}
+		}
+	}
+
+	return keys, markerKeys, nil
+}
+
+// recoverAggregations completes aggregations whose aggregated file was
+// uploaded by deleting their remaining merged files, which are excluded from
+// the returned keys. Markers of aggregations which never uploaded their file
+// are removed, their files are aggregated again.
+func (a *DependencyAggregator) recoverAggregations(ctx context.Context, keys []string, markerKeys []string) ([]string, error) {
+	if len(markerKeys) == 0 {
+		return keys, nil
+	}
+
+	existing := map[string]bool{}
+	for _, key := range keys {
+		existing[key] = true
+	}
+
+	merged := map[string]bool{}
+	for _, markerKey := range markerKeys {
+		marker, err := getCompactionMarker(ctx, a.svc, a.bucketName, markerKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if !existing[marker.Key] {
+			if err := a.deleteObjects(ctx, []string{markerKey}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := a.deleteObjects(ctx, append(marker.Sources, markerKey)); err != nil {
+			return nil, err
+		}
+
+		for _, source := range marker.Sources {
+			merged[source] = true
+		}
+
+		a.logger.Info("completed interrupted aggregation", "key", marker.Key, "files", len(marker.Sources))
+	}
+
+	remaining := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !merged[key] {
+			remaining = append(remaining, key)
+		}
+	}
+
+	return remaining, nil
+}
+
+func (a *DependencyAggregator) markerKey(key string) string {
+	return path.Join(path.Dir(key), aggregationMarkerPrefix+strings.TrimPrefix(strings.TrimSuffix(path.Base(key), ".parquet"), aggregatedDependenciesFilePrefix)+".json")
+}
+
+func (a *DependencyAggregator) deleteObjects(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if _, err := a.svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(a.bucketName),
+			Key:    aws.String(key),
+		}); err != nil {
+			return fmt.Errorf("failed to delete aggregated object: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// aggregationID derives the name of the aggregated file from the merged files,
+// so aggregating the same files again replaces the file instead of adding a
+// second one.
+func aggregationID(keys []string) string {
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+
+	hash := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(hash[:16])
+}
+
+// queryLinks sums the resolved links of the files and resolves the unresolved
+// links using the spans table. Links whose parent span isn't found are dropped.
+func (a *DependencyAggregator) queryLinks(ctx context.Context, partitionTime time.Time, keys []string) ([]*DependencyRecord, error) {
+	paths := make([]string, len(keys))
+	for i, key := range keys {
+		paths[i] = fmt.Sprintf(`'s3://%s/%s'`, a.bucketName, key)
+	}
+
+	dependenciesConditions := []string{
+		a.opts.PartitionScheme.Condition(partitionTime, partitionTime),
+		fmt.Sprintf(`"$path" IN (%s)`, strings.Join(paths, ", ")),
+	}
+
+	// Parents start before their children, at most the max trace duration earlier
+	partitionEnd := partitionTime.Add(a.opts.PartitionScheme.Interval())
+	spansConditions := []string{
+		a.reader.partitionScheme.Condition(partitionTime.Add(-a.reader.maxTraceDuration), partitionEnd),
+	}
+	servicesCondition, err := a.reader.allServicesCondition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if servicesCondition != "" {
+		spansConditions = append(spansConditions, servicesCondition)
+	}
+
+	result, err := a.reader.queryAthena(ctx, fmt.Sprintf(`
+		WITH links AS (
+			SELECT parent, child, call_count, ref_trace_id, ref_span_id FROM "%s" WHERE %s
+		),
+		parents AS (
+			SELECT DISTINCT trace_id, span_id, service_name FROM "%s" WHERE %s
+		)
+
+		SELECT parent, child, SUM(call_count) FROM (
+			SELECT parent, child, call_count FROM links WHERE parent != ''
+			UNION ALL
+			SELECT parents.service_name AS parent, links.child, links.call_count
+				FROM links
+				JOIN parents ON links.ref_trace_id = parents.trace_id AND links.ref_span_id = parents.span_id
+				WHERE links.parent = ''
+		)
+		GROUP BY 1, 2
+	`, a.reader.cfg.DependenciesTableName, strings.Join(dependenciesConditions, " AND "), a.reader.cfg.SpansTableName, strings.Join(spansConditions, " AND ")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query athena: %w", err)
+	}
+
+	records := make([]*DependencyRecord, len(result))
+	for i, v := range result {
+		callCount, err := strconv.ParseInt(*v.Data[2].VarCharValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse call count: %w", err)
+		}
+
+		records[i] = &DependencyRecord{
+			Parent:    *v.Data[0].VarCharValue,
+			Child:     *v.Data[1].VarCharValue,
+			CallCount: callCount,
+		}
+	}
+
+	return records, nil
+}
+
+func (a *DependencyAggregator) writeFile(ctx context.Context, key string, records []*DependencyRecord) error {
+	bufferDir := a.opts.BufferDirectory
+	if bufferDir == "" {
+		bufferDir = os.TempDir()
+	}
+
+	localPath := filepath.Join(bufferDir, RandStringBytes(32)+".parquet")
+	writeFile, err := local.NewLocalFileWriter(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to create local parquet file: %w", err)
+	}
+
+	parquetWriter, err := a.opts.ParquetOptions.NewWriter(writeFile, new(DependencyRecord))
+	if err != nil {
+		writeFile.Close()
+		os.Remove(localPath)
+		return fmt.Errorf("failed to create parquet writer: %w", err)
+	}
+
+	for _, record := range records {
+		if err := parquetWriter.Write(record); err != nil {
+			writeFile.Close()
+			os.Remove(localPath)
+			return fmt.Errorf("failed to write row: %w", err)
+		}
+	}
+
+	if err := parquetWriter.WriteStop(); err != nil {
+		writeFile.Close()
+		os.Remove(localPath)
+		return fmt.Errorf("parquet write stop error: %w", err)
+	}
+
+	if err := writeFile.Close(); err != nil {
+		os.Remove(localPath)
+		return fmt.Errorf("parquet file write close error: %w", err)
+	}
+
+	if err := a.uploader.Upload(ctx, key, localPath); err != nil {
+		return fmt.Errorf("failed to upload aggregated file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestDependencyAggregatorAggregatePartition(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			assert.Equal("dependencies/2021/01/30/06/", *input.Prefix)
+
+			return &s3.ListObjectsV2Output{
+				Contents: []types.Object{
+					{Key: aws.String("dependencies/2021/01/30/06/a.parquet")},
+					{Key: aws.String("dependencies/2021/01/30/06/b.parquet")},
+				},
+			}, nil
+		}).Times(1)
+
+	var marker compactionMarker
+	var markerKey string
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			markerKey = *input.Key
+			return &s3.PutObjectOutput{}, json.NewDecoder(input.Body).Decode(&marker)
+		}).Times(1)
+
+	var aggregatedKey string
+	var aggregatedBody []byte
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			aggregatedKey = *input.Key
+			body, err := io.ReadAll(input.Body)
+			aggregatedBody = body
+			return &s3.PutObjectOutput{}, err
+		}).Times(1)
+
+	deletedKeys := []string{}
+	mockSvc.EXPECT().DeleteObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deletedKeys = append(deletedKeys, *input.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		}).Times(3)
+
+	mockAthenaSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockQueryRunAndResult(mockAthenaSvc, [][]string{
+		{"frontend", "payments", "42"},
+	})
+
+	aggregator := NewDependencyAggregator(hclog.NewNullLogger(), mockSvc, NewTestReader(ctx, assert, mockAthenaSvc), "jaeger-spans", "dependencies/", CompactorOptions{
+		PartitionScheme: DefaultPartitionScheme,
+		BufferDirectory: t.TempDir(),
+		RetryOptions:    testRetryOptions,
+	})
+
+	assert.NoError(aggregator.AggregatePartition(ctx, time.Date(2021, 1, 30, 6, 0, 0, 0, time.UTC)))
+
+	sources := []string{"dependencies/2021/01/30/06/a.parquet", "dependencies/2021/01/30/06/b.parquet"}
+	id := aggregationID(sources)
+	assert.Equal(id, aggregationID([]string{sources[1], sources[0]}))
+	assert.Equal("dependencies/2021/01/30/06/aggregated-"+id+".parquet", aggregatedKey)
+	assert.Equal("dependencies/2021/01/30/06/_aggregation-"+id+".json", markerKey)
+	assert.Equal(aggregatedKey, marker.Key)
+	assert.Equal(sources, marker.Sources)
+	assert.Equal(append(sources, markerKey), deletedKeys)
+
+	pr, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(aggregatedBody), new(DependencyRecord), PARQUET_CONCURRENCY)
+	assert.NoError(err)
+	defer pr.ReadStop()
+
+	records := make([]DependencyRecord, pr.GetNumRows())
+	assert.NoError(pr.Read(&records))
+	assert.Equal([]DependencyRecord{{Parent: "frontend", Child: "payments", CallCount: 42}}, records)
+}
+
+func TestDependencyAggregatorSkipsAggregatedPartition(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("dependencies/2021/01/30/06/aggregated-a.parquet")},
+			},
+		}, nil).Times(1)
+
+	aggregator := NewDependencyAggregator(hclog.NewNullLogger(), mockSvc, NewTestReader(ctx, assert, mocks.NewMockAthenaAPI(ctrl)), "jaeger-spans", "dependencies/", CompactorOptions{
+		PartitionScheme: DefaultPartitionScheme,
+		RetryOptions:    testRetryOptions,
+	})
+
+	assert.NoError(aggregator.AggregatePartition(ctx, time.Date(2021, 1, 30, 6, 0, 0, 0, time.UTC)))
+}
+
+func TestDependencyAggregatorCompletesInterruptedAggregation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	marker, err := json.Marshal(&compactionMarker{
+		Key:     "dependencies/2021/01/30/06/aggregated-a.parquet",
+		Sources: []string{"dependencies/2021/01/30/06/a.parquet", "dependencies/2021/01/30/06/b.parquet"},
+	})
+	assert.NoError(err)
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().ListObjectsV2(gomock.Any(), gomock.Any()).
+		Return(&s3.ListObjectsV2Output{
+			Contents: []types.Object{
+				{Key: aws.String("dependencies/2021/01/30/06/_aggregation-a.json")},
+				{Key: aws.String("dependencies/2021/01/30/06/aggregated-a.parquet")},
+				{Key: aws.String("dependencies/2021/01/30/06/b.parquet")},
+				{Key: aws.String("dependencies/2021/01/30/06/_aggregation-c.json")},
+			},
+		}, nil).Times(1)
+	mockSvc.EXPECT().GetObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if *input.Key == "dependencies/2021/01/30/06/_aggregation-a.json" {
+				return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(marker))}, nil
+			}
+
+			// The aggregated file of this marker was never uploaded
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(
+				`{"key":"dependencies/2021/01/30/06/aggregated-c.parquet","sources":["dependencies/2021/01/30/06/b.parquet"]}`))}, nil
+		}).Times(2)
+
+	deletedKeys := []string{}
+	mockSvc.EXPECT().DeleteObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+			deletedKeys = append(deletedKeys, *input.Key)
+			return &s3.DeleteObjectOutput{}, nil
+		}).Times(4)
+
+	aggregator := NewDependencyAggregator(hclog.NewNullLogger(), mockSvc, NewTestReader(ctx, assert, mocks.NewMockAthenaAPI(ctrl)), "jaeger-spans", "dependencies/", CompactorOptions{
+		PartitionScheme: DefaultPartitionScheme,
+		RetryOptions:    testRetryOptions,
+	})
+
+	// Only the aggregated file is left, so the merged calls aren't counted again
+	assert.NoError(aggregator.AggregatePartition(ctx, time.Date(2021, 1, 30, 6, 0, 0, 0, time.UTC)))
+
+	assert.Equal([]string{
+		"dependencies/2021/01/30/06/a.parquet",
+		"dependencies/2021/01/30/06/b.parquet",
+		"dependencies/2021/01/30/06/_aggregation-a.json",
+		"dependencies/2021/01/30/06/_aggregation-c.json",
+	}, deletedKeys)
+}
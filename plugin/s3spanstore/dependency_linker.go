@@ -0,0 +1,248 @@
+package s3spanstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+var (
+	defaultDependenciesSpanCacheSize = 100000
+	defaultDependenciesLinkTimeout   = time.Minute * 5
+)
+
+// DependencyLinkerOptions controls how long spans are kept to link them.
+type DependencyLinkerOptions struct {
+	// SpanCacheSize is the number of recent spans, whose service is kept to link
+	// their children, and the maximum number of children waiting for their parent
+	SpanCacheSize int
+	// LinkTimeout is the time a child waits for its parent, before the link is
+	// written unresolved
+	LinkTimeout time.Duration
+	// FlushInterval is the interval in which counted links are written
+	FlushInterval time.Duration
+	// PartitionScheme buckets the links by the start time of the child span
+	PartitionScheme PartitionScheme
+}
+
+type dependencyLink struct {
+	parent    string
+	child     string
+	partition time.Time
+}
+
+type pendingDependencyLink struct {
+	child      string
+	startTime  time.Time
+	receivedAt time.Time
+	refTraceID string
+	refSpanID  string
+}
+
+// DependencyLinker links spans to the services of their referenced parent spans
+// while they are written and counts the calls between services.
+//
+// Children are often written before their parent, so they wait up to the link
+// timeout for it. Links of parents written by other collectors or after the
+// timeout are written unresolved and later resolved by the DependencyAggregator.
+type DependencyLinker struct {
+	logger        hclog.Logger
+	opts          DependencyLinkerOptions
+	parquetWriter IParquetWriter
+
+	spanServices *lru.Cache
+
+	mutex        sync.Mutex
+	links        map[dependencyLink]int64
+	pending      map[string][]pendingDependencyLink
+	pendingCount int
+	unresolved   []pendingDependencyLink
+
+	ticker    *time.Ticker
+	done      chan struct{}
+	waitGroup sync.WaitGroup
+	stopOnce  sync.Once
+}
+
+func NewDependencyLinker(ctx context.Context, logger hclog.Logger, opts DependencyLinkerOptions, parquetWriter IParquetWriter) (*DependencyLinker, error) {
+	if opts.SpanCacheSize <= 0 {
+		opts.SpanCacheSize = defaultDependenciesSpanCacheSize
+	}
+	if opts.LinkTimeout <= 0 {
+		opts.LinkTimeout = defaultDependenciesLinkTimeout
+	}
+
+	spanServices, err := lru.New(opts.SpanCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create span cache: %w", err)
+	}
+
+	l := &DependencyLinker{
+		logger:        logger,
+		opts:          opts,
+		parquetWriter: parquetWriter,
+		spanServices:  spanServices,
+		links:         map[dependencyLink]int64{},
+		pending:       map[string][]pendingDependencyLink{},
+		ticker:        time.NewTicker(opts.FlushInterval),
+		done:          make(chan struct{}),
+	}
+
+	l.waitGroup.Add(1)
+	go func() {
+		defer l.waitGroup.Done()
+
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-l.ticker.C:
+				if err := l.flush(ctx, false); err != nil {
+					l.logger.Error("failed to flush dependency links", "error", err)
+				}
+			}
+		}
+	}()
+
+	return l, nil
+}
+
+func dependencySpanKey(traceID model.TraceID, spanID model.SpanID) string {
+	return traceID.String() + "/" + spanID.String()
+}
+
+// Add links the spans with their parents and children.
+func (l *DependencyLinker) Add(spans []*model.Span) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, span := range spans {
+		serviceName := span.Process.ServiceName
+		spanKey := dependencySpanKey(span.TraceID, span.SpanID)
+
+		l.spanServices.Add(spanKey, serviceName)
+		for _, child := range l.pending[spanKey] {
+			l.countLink(serviceName, child)
+		}
+		l.pendingCount -= len(l.pending[spanKey])
+		delete(l.pending, spanKey)
+
+		for _, reference := range span.References {
+			child := pendingDependencyLink{
+				child:      serviceName,
+				startTime:  span.StartTime,
+				receivedAt: time.Now(),
+				refTraceID: reference.TraceID.String(),
+				refSpanID:  reference.SpanID.String(),
+			}
+
+			parentKey := dependencySpanKey(reference.TraceID, reference.SpanID)
+			if parent, ok := l.spanServices.Get(parentKey); ok {
+				l.countLink(parent.(string), child)
+				continue
+			}
+
+			if l.pendingCount >= l.opts.SpanCacheSize {
+				l.unresolved = append(l.unresolved, child)
+				continue
+			}
+
+			l.pending[parentKey] = append(l.pending[parentKey], child)
+			l.pendingCount++
+		}
+	}
+}
+
+func (l *DependencyLinker) countLink(parent string, child pendingDependencyLink) {
+	l.links[dependencyLink{
+		parent:    parent,
+		child:     child.child,
+		partition: l.opts.PartitionScheme.Truncate(child.startTime),
+	}]++
+}
+
+// flush writes the counted links and all unresolved links. Without force,
+// children wait for their parent until the link timeout passed.
+func (l *DependencyLinker) flush(ctx context.Context, force bool) error {
+	l.mutex.Lock()
+
+	rows := make([]ParquetRow, 0, len(l.links)+len(l.unresolved))
+	for link, callCount := range l.links {
+		rows = append(rows, ParquetRow{
+			Time:           link.partition,
+			MaxBufferUntil: link.partition,
+			Row:            &DependencyRecord{Parent: link.parent, Child: link.child, CallCount: callCount},
+		})
+	}
+	l.links = map[dependencyLink]int64{}
+
+	expired := time.Now().Add(-l.opts.LinkTimeout)
+	for parentKey, children := range l.pending {
+		waiting := children[:0]
+		for _, child := range children {
+			if force || child.receivedAt.Before(expired) {
+				l.unresolved = append(l.unresolved, child)
+				l.pendingCount--
+			} else {
+				waiting = append(waiting, child)
+			}
+		}
+
+		if len(waiting) == 0 {
+			delete(l.pending, parentKey)
+		} else {
+			l.pending[parentKey] = waiting
+		}
+	}
+
+	for _, child := range l.unresolved {
+		rows = append(rows, ParquetRow{
+			Time:           child.startTime,
+			MaxBufferUntil: child.startTime,
+			Row: &DependencyRecord{
+				Child:      child.child,
+				CallCount:  1,
+				RefTraceID: child.refTraceID,
+				RefSpanID:  child.refSpanID,
+			},
+		})
+	}
+	l.unresolved = nil
+
+	l.mutex.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if err := l.parquetWriter.WriteRows(ctx, rows); err != nil {
+		return fmt.Errorf("failed to write dependency links: %w", err)
+	}
+
+	return nil
+}
+
+// Shutdown writes all links, including those still waiting for their parent,
+// and flushes the parquet writer.
+func (l *DependencyLinker) Shutdown(ctx context.Context) error {
+	l.stopOnce.Do(func() {
+		l.ticker.Stop()
+		close(l.done)
+	})
+	l.waitGroup.Wait()
+
+	if err := l.flush(ctx, true); err != nil {
+		return err
+	}
+
+	return l.parquetWriter.Shutdown(ctx)
+}
+
+func (l *DependencyLinker) Close() error {
+	return l.Shutdown(context.Background())
+}
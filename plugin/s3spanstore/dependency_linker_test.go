@@ -0,0 +1,64 @@
+package s3spanstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDependencySpan(traceID model.TraceID, spanID uint64, serviceName string, startTime time.Time, parentSpanID uint64) *model.Span {
+	span := &model.Span{
+		TraceID:   traceID,
+		SpanID:    model.NewSpanID(spanID),
+		StartTime: startTime,
+		Process:   model.NewProcess(serviceName, nil),
+	}
+
+	if parentSpanID != 0 {
+		span.References = []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(parentSpanID))}
+	}
+
+	return span
+}
+
+func TestDependencyLinker(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	testWriter := &testWriter{writes: []interface{}{}}
+	linker, err := NewDependencyLinker(ctx, hclog.NewNullLogger(), DependencyLinkerOptions{
+		FlushInterval:   time.Hour,
+		PartitionScheme: DefaultPartitionScheme,
+	}, testWriter)
+	assert.NoError(err)
+
+	traceID := model.NewTraceID(0, 1)
+	startTime := time.Date(2021, 1, 30, 6, 30, 0, 0, time.UTC)
+	partitionTime := time.Date(2021, 1, 30, 6, 0, 0, 0, time.UTC)
+
+	// Children are usually written before their parents
+	linker.Add([]*model.Span{newTestDependencySpan(traceID, 3, "db", startTime, 2)})
+	linker.Add([]*model.Span{
+		newTestDependencySpan(traceID, 1, "frontend", startTime, 0),
+		newTestDependencySpan(traceID, 2, "payments", startTime, 1),
+		newTestDependencySpan(traceID, 4, "payments", startTime, 1),
+		newTestDependencySpan(traceID, 5, "worker", startTime, 99),
+	})
+
+	assert.NoError(linker.flush(ctx, false))
+	assert.ElementsMatch([]interface{}{
+		writeItem{row: &DependencyRecord{Parent: "frontend", Child: "payments", CallCount: 2}, maxBufferUntil: partitionTime},
+		writeItem{row: &DependencyRecord{Parent: "payments", Child: "db", CallCount: 1}, maxBufferUntil: partitionTime},
+	}, testWriter.writes)
+
+	// The parent of worker was never written
+	testWriter.writes = []interface{}{}
+	assert.NoError(linker.Shutdown(ctx))
+	assert.Equal([]interface{}{
+		writeItem{row: &DependencyRecord{Child: "worker", CallCount: 1, RefTraceID: traceID.String(), RefSpanID: model.NewSpanID(99).String()}, maxBufferUntil: startTime},
+	}, testWriter.writes)
+}
@@ -0,0 +1,13 @@
+package s3spanstore
+
+// DependencyRecord counts the calls from a parent to a child service.
+//
+// Links the writer couldn't resolve have no Parent, but reference the parent
+// span instead. They are resolved by the DependencyAggregator.
+type DependencyRecord struct {
+	Parent     string `parquet:"name=parent, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Child      string `parquet:"name=child, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	CallCount  int64  `parquet:"name=call_count, type=INT64"`
+	RefTraceID string `parquet:"name=ref_trace_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	RefSpanID  string `parquet:"name=ref_span_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+}
@@ -0,0 +1,47 @@
+package s3spanstore
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// eventNameField is the conventional log field naming the event, see
+// https://github.com/opentracing/specification/blob/master/semantic_conventions.md#log-fields-table
+const eventNameField = "event"
+
+// EventRecord contains a single span log with its fields
+type EventRecord struct {
+	TraceID       string `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	SpanID        string `parquet:"name=span_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	OperationName string `parquet:"name=operation_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ServiceName   string `parquet:"name=service_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	// Timestamp is the log time in the unit of the span start_time column
+	Timestamp int64 `parquet:"name=timestamp, type=INT64"`
+	// Name is the value of the conventional event field, e.g. error or exception
+	Name   string            `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Fields map[string]string `parquet:"name=fields, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+// NewEventRecordsFromSpan returns a record per span log
+func NewEventRecordsFromSpan(span *model.Span) []*EventRecord {
+	eventRecords := make([]*EventRecord, len(span.Logs))
+
+	for i, log := range span.Logs {
+		fields := kvToMap(log.Fields)
+
+		eventRecords[i] = &EventRecord{
+			TraceID:       span.TraceID.String(),
+			SpanID:        span.SpanID.String(),
+			OperationName: span.OperationName,
+			ServiceName:   span.Process.ServiceName,
+			Timestamp:     recordTimestamp(log.Timestamp),
+			Name:          fields[eventNameField],
+			Fields:        fields,
+		}
+	}
+
+	return eventRecords
+}
+
+func (r *EventRecord) GetServiceName() string {
+	return r.ServiceName
+}
@@ -0,0 +1,69 @@
+package s3spanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEventRecordsFromSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestCodecSpan()
+	span.Logs = append(span.Logs, model.Log{
+		Timestamp: span.StartTime.Add(time.Second),
+		Fields: []model.KeyValue{
+			model.Int64("retries", 3),
+		},
+	})
+
+	records := NewEventRecordsFromSpan(span)
+	assert.Equal([]*EventRecord{
+		{
+			TraceID:       "00000000000000010000000000000011",
+			SpanID:        "0000000000000003",
+			OperationName: "example-operation-1",
+			ServiceName:   "example-service-1",
+			Timestamp:     int64(1485449191640),
+			Name:          "error",
+			Fields:        map[string]string{"event": "error", "message": "failed"},
+		},
+		{
+			TraceID:       "00000000000000010000000000000011",
+			SpanID:        "0000000000000003",
+			OperationName: "example-operation-1",
+			ServiceName:   "example-service-1",
+			Timestamp:     int64(1485449192639),
+			Name:          "",
+			Fields:        map[string]string{"retries": "3"},
+		},
+	}, records)
+
+	assert.Equal("example-service-1", records[0].GetServiceName())
+}
+
+func TestEventRecordTimestampMatchesSpanStartTime(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestCodecSpan()
+	span.Logs[0].Timestamp = span.StartTime
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	eventRecords := NewEventRecordsFromSpan(span)
+	assert.Len(eventRecords, 1)
+	assert.Equal(spanRecord.StartTime, eventRecords[0].Timestamp)
+	assert.Equal(span.StartTime.Truncate(time.Millisecond), recordTime(eventRecords[0].Timestamp).UTC())
+}
+
+func TestNewEventRecordsFromSpanWithoutLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestCodecSpan()
+	span.Logs = nil
+
+	assert.Empty(NewEventRecordsFromSpan(span))
+}
@@ -0,0 +1,138 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const manifestTimeFormat = "20060102T150405Z"
+
+var invalidInstanceIDChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// NewInstanceID returns the configured instance id with all characters not
+// safe in object keys replaced, defaulting to the hostname.
+func NewInstanceID(instanceID string) string {
+	if instanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "collector-" + RandStringBytes(8)
+		}
+		instanceID = hostname
+	}
+
+	return strings.Trim(invalidInstanceIDChars.ReplaceAllString(instanceID, "-"), "-")
+}
+
+// FileName returns the name of the sequence-th file written by an instance,
+// which started writing at startedAt.
+func FileName(instanceID string, startedAt time.Time, sequence uint64) string {
+	return fmt.Sprintf("%s-%s-%06d", instanceID, startedAt.UTC().Format(manifestTimeFormat), sequence)
+}
+
+// FileManifest describes a single parquet file written by a collector. As
+// sequence numbers are consecutive per instance and start, missing manifests
+// reveal missing files.
+type FileManifest struct {
+	Key string `json:"key"`
+	// Partition is the partition key of the file, e.g. 2022/03/01/10
+	Partition    string    `json:"partition"`
+	InstanceID   string    `json:"instance_id"`
+	StartedAt    time.Time `json:"started_at"`
+	Sequence     uint64    `json:"sequence"`
+	Rows         int64     `json:"rows"`
+	Bytes        int64     `json:"bytes"`
+	MinStartTime time.Time `json:"min_start_time"`
+	MaxStartTime time.Time `json:"max_start_time"`
+	Services     []string  `json:"services"`
+	// Sources are the files merged into a compacted file
+	Sources []string `json:"sources,omitempty"`
+	// CompactedInto is set once the file was merged into a compacted file and deleted
+	CompactedInto string `json:"compacted_into,omitempty"`
+}
+
+// ManifestKey returns the key of the manifest of the parquet file at key.
+func ManifestKey(manifestsPrefix string, key string) string {
+	return manifestsPrefix + strings.TrimPrefix(strings.TrimSuffix(key, ".parquet"), "/") + ".json"
+}
+
+func (w *ParquetWriter) newFileManifest(parquetRef *ParquetRef) *FileManifest {
+	services := make([]string, 0, len(parquetRef.services))
+	for service := range parquetRef.services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	return &FileManifest{
+		Key:          parquetRef.key,
+		Partition:    parquetRef.partition,
+		InstanceID:   w.instanceID,
+		StartedAt:    w.startedAt,
+		Sequence:     parquetRef.sequence,
+		Rows:         parquetRef.rows,
+		Bytes:        parquetRef.bytes,
+		MinStartTime: parquetRef.minTime,
+		MaxStartTime: parquetRef.maxTime,
+		Services:     services,
+	}
+}
+
+func (w *ParquetWriter) putManifest(ctx context.Context, parquetRef *ParquetRef) error {
+	return putFileManifest(ctx, w.svc, w.bucketName, w.manifestsPrefix, w.objectOptions, w.newFileManifest(parquetRef))
+}
+
+func putFileManifest(ctx context.Context, svc S3API, bucketName string, manifestsPrefix string, objectOptions ObjectOptions, manifest *FileManifest) error {
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to serialize manifest: %w", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(ManifestKey(manifestsPrefix, manifest.Key)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	objectOptions.Apply(input)
+
+	if _, err := svc.PutObject(ctx, input); err != nil {
+		return fmt.Errorf("failed to put manifest: %w", err)
+	}
+
+	return nil
+}
+
+// getFileManifest returns the manifest of the parquet file at key, or nil if
+// the file has no manifest.
+func getFileManifest(ctx context.Context, svc S3API, bucketName string, manifestsPrefix string, key string) (*FileManifest, error) {
+	output, err := svc.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(ManifestKey(manifestsPrefix, key)),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	defer output.Body.Close()
+
+	manifest := &FileManifest{}
+	if err := json.NewDecoder(output.Body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,43 @@
+package s3spanstore
+
+import (
+	"github.com/johanneswuerbach/jaeger-s3/plugin/metrics"
+)
+
+var (
+	spansWrittenTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_spans_written_total",
+		"Spans written into the parquet writers")
+	spansDroppedTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_spans_dropped_total",
+		"Spans dropped before being written", "reason")
+	spansTruncatedTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_spans_truncated_total",
+		"Spans truncated to the size limits")
+
+	parquetRowsWrittenTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_parquet_rows_written_total",
+		"Rows written into parquet files", "prefix")
+	parquetOpenFiles = metrics.DefaultRegistry.NewGauge("jaeger_s3_parquet_open_files",
+		"Parquet files currently buffering rows", "prefix")
+	parquetRotationDuration = metrics.DefaultRegistry.NewHistogram("jaeger_s3_parquet_rotation_duration_seconds",
+		"Time to close and upload a rotated parquet file", metrics.DefaultBuckets, "prefix")
+	parquetFilesUploadedTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_parquet_files_uploaded_total",
+		"Rotated parquet files by result, one of success, dead_letter or failure", "prefix", "result")
+	parquetUploadedBytesTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_parquet_uploaded_bytes_total",
+		"Bytes of parquet files uploaded to S3", "prefix")
+
+	dedupeCacheRequestsTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_dedupe_cache_requests_total",
+		"Dedupe cache lookups by dataset and result, a hit skips the write", "dataset", "result")
+
+	athenaQueryDuration = metrics.DefaultRegistry.NewHistogram("jaeger_s3_athena_query_duration_seconds",
+		"Time until an Athena query completed by its final state", metrics.DefaultBuckets, "state")
+	athenaDataScannedBytesTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_athena_data_scanned_bytes_total",
+		"Bytes scanned by Athena queries")
+	athenaQueryCacheLookupsTotal = metrics.DefaultRegistry.NewCounter("jaeger_s3_athena_query_cache_lookups_total",
+		"Athena query cache lookups by result, hit or miss", "result")
+)
+
+const (
+	metricsResultHit        = "hit"
+	metricsResultMiss       = "miss"
+	metricsResultSuccess    = "success"
+	metricsResultDeadLetter = "dead_letter"
+	metricsResultFailure    = "failure"
+)
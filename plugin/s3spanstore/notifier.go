@@ -0,0 +1,264 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+// notifyTimeout bounds a single notification, so a slow consumer doesn't block rotations
+const notifyTimeout = time.Second * 10
+
+// FileEvent describes a parquet file, which was committed to the bucket.
+type FileEvent struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// Partition is the partition key of the file, e.g. 2022/03/01/10
+	Partition string    `json:"partition"`
+	Rows      int64     `json:"rows"`
+	Bytes     int64     `json:"bytes"`
+	MinTime   time.Time `json:"min_time"`
+	MaxTime   time.Time `json:"max_time"`
+}
+
+// FileNotifier is informed about every committed parquet file, e.g. to register
+// partitions or trigger indexing without polling the bucket.
+type FileNotifier interface {
+	Notify(ctx context.Context, event FileEvent) error
+}
+
+var (
+	_ FileNotifier = (FileNotifiers)(nil)
+	_ FileNotifier = (*WebhookFileNotifier)(nil)
+	_ FileNotifier = (*LocalFileNotifier)(nil)
+	_ FileNotifier = (*SQSFileNotifier)(nil)
+)
+
+// NewFileNotifier returns all configured notifiers or nil if none is configured.
+func NewFileNotifier(ctx context.Context, s3Config config.S3) (FileNotifier, error) {
+	notifiers := FileNotifiers{}
+
+	if s3Config.NotifyWebhookURL != "" {
+		notifiers = append(notifiers, NewWebhookFileNotifier(s3Config.NotifyWebhookURL))
+	}
+
+	if s3Config.NotifyFile != "" {
+		notifier, err := NewLocalFileNotifier(s3Config.NotifyFile)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+
+	if s3Config.NotifySQSQueueURL != "" {
+		awsConfig, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load aws config: %w", err)
+		}
+
+		region := s3Config.NotifySQSRegion
+		if region == "" {
+			region = awsConfig.Region
+		}
+		if region == "" {
+			return nil, fmt.Errorf("sqs notifications require a region")
+		}
+
+		notifiers = append(notifiers, NewSQSFileNotifier(s3Config.NotifySQSQueueURL, region, awsConfig.Credentials))
+	}
+
+	switch len(notifiers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return notifiers[0], nil
+	default:
+		return notifiers, nil
+	}
+}
+
+// newFileEvent describes the file of the manifest in bucketName.
+func newFileEvent(bucketName string, manifest *FileManifest) FileEvent {
+	return FileEvent{
+		Bucket:    bucketName,
+		Key:       manifest.Key,
+		Partition: manifest.Partition,
+		Rows:      manifest.Rows,
+		Bytes:     manifest.Bytes,
+		MinTime:   manifest.MinStartTime,
+		MaxTime:   manifest.MaxStartTime,
+	}
+}
+
+// FileNotifiers notifies all its notifiers, a failing notifier doesn't prevent
+// the others from being notified.
+type FileNotifiers []FileNotifier
+
+func (n FileNotifiers) Notify(ctx context.Context, event FileEvent) error {
+	errs := []error{}
+	for _, notifier := range n {
+		if err := notifier.Notify(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// WebhookFileNotifier posts every event as JSON to an HTTP endpoint.
+type WebhookFileNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookFileNotifier(url string) *WebhookFileNotifier {
+	return &WebhookFileNotifier{
+		url:    url,
+		client: &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+func (n *WebhookFileNotifier) Notify(ctx context.Context, event FileEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize file event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := doNotifyRequest(n.client, req); err != nil {
+		return fmt.Errorf("failed to call webhook: %w", err)
+	}
+
+	return nil
+}
+
+// LocalFileNotifier appends every event as a JSON line to a local file.
+type LocalFileNotifier struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewLocalFileNotifier(path string) (*LocalFileNotifier, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create notify file directory: %w", err)
+	}
+
+	return &LocalFileNotifier{path: path}, nil
+}
+
+func (n *LocalFileNotifier) Notify(ctx context.Context, event FileEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize file event: %w", err)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	file, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open notify file: %w", err)
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write notify file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// SQSFileNotifier sends every event as JSON message to an SQS queue. It uses
+// the SQS query API, which is also implemented by local stand-ins, e.g.
+// ElasticMQ or LocalStack.
+type SQSFileNotifier struct {
+	queueURL    string
+	region      string
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+	client      *http.Client
+}
+
+func NewSQSFileNotifier(queueURL string, region string, credentials aws.CredentialsProvider) *SQSFileNotifier {
+	return &SQSFileNotifier{
+		queueURL:    queueURL,
+		region:      region,
+		credentials: credentials,
+		signer:      v4.NewSigner(),
+		client:      &http.Client{Timeout: notifyTimeout},
+	}
+}
+
+func (n *SQSFileNotifier) Notify(ctx context.Context, event FileEvent) error {
+	message, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize file event: %w", err)
+	}
+
+	body := url.Values{
+		"Action":      {"SendMessage"},
+		"Version":     {"2012-11-05"},
+		"MessageBody": {string(message)},
+	}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.queueURL, strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create sqs request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if n.credentials != nil {
+		credentials, err := n.credentials.Retrieve(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve aws credentials: %w", err)
+		}
+
+		payloadHash := sha256.Sum256([]byte(body))
+		if err := n.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), "sqs", n.region, time.Now()); err != nil {
+			return fmt.Errorf("failed to sign sqs request: %w", err)
+		}
+	}
+
+	if err := doNotifyRequest(n.client, req); err != nil {
+		return fmt.Errorf("failed to send sqs message: %w", err)
+	}
+
+	return nil
+}
+
+func doNotifyRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package s3spanstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+var testFileEvent = FileEvent{
+	Bucket:    "jaeger-spans",
+	Key:       "spans/2017/01/26/16/collector-1-20170126T164500Z-000001.parquet",
+	Partition: "2017/01/26/16",
+	Rows:      2,
+	Bytes:     1024,
+	MinTime:   time.Date(2017, 1, 26, 16, 46, 31, 0, time.UTC),
+	MaxTime:   time.Date(2017, 1, 26, 16, 46, 32, 0, time.UTC),
+}
+
+type testFileNotifier struct {
+	mutex  sync.Mutex
+	events []FileEvent
+	err    error
+}
+
+func (n *testFileNotifier) Notify(ctx context.Context, event FileEvent) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.events = append(n.events, event)
+	return n.err
+}
+
+func TestWebhookFileNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var received FileEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(http.MethodPost, r.Method)
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		assert.NoError(json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	assert.NoError(NewWebhookFileNotifier(server.URL).Notify(context.TODO(), testFileEvent))
+	assert.Equal(testFileEvent, received)
+
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failingServer.Close()
+
+	err := NewWebhookFileNotifier(failingServer.URL).Notify(context.TODO(), testFileEvent)
+	assert.Error(err)
+	assert.Contains(err.Error(), "503")
+}
+
+func TestLocalFileNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "events", "files.jsonl")
+
+	notifier, err := NewLocalFileNotifier(path)
+	assert.NoError(err)
+
+	assert.NoError(notifier.Notify(context.TODO(), testFileEvent))
+	assert.NoError(notifier.Notify(context.TODO(), testFileEvent))
+
+	content, err := os.ReadFile(path)
+	assert.NoError(err)
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(lines, 2)
+
+	var event FileEvent
+	assert.NoError(json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(testFileEvent, event)
+}
+
+func TestSQSFileNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var received FileEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		assert.Contains(r.Header.Get("Authorization"), "/eu-west-1/sqs/aws4_request")
+
+		assert.NoError(r.ParseForm())
+		assert.Equal("/000000000000/jaeger-files", r.URL.Path)
+		assert.Equal("SendMessage", r.PostForm.Get("Action"))
+		assert.NoError(json.Unmarshal([]byte(r.PostForm.Get("MessageBody")), &received))
+	}))
+	defer server.Close()
+
+	credentials := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}, nil
+	})
+
+	notifier := NewSQSFileNotifier(server.URL+"/000000000000/jaeger-files", "eu-west-1", credentials)
+	assert.NoError(notifier.Notify(context.TODO(), testFileEvent))
+	assert.Equal(testFileEvent, received)
+}
+
+func TestFileNotifiers(t *testing.T) {
+	assert := assert.New(t)
+
+	notifier, err := NewFileNotifier(context.TODO(), config.S3{})
+	assert.NoError(err)
+	assert.Nil(notifier)
+
+	failing := &testFileNotifier{err: errors.New("unavailable")}
+	succeeding := &testFileNotifier{}
+
+	assert.Error(FileNotifiers{failing, succeeding}.Notify(context.TODO(), testFileEvent))
+	assert.Equal([]FileEvent{testFileEvent}, succeeding.events)
+}
+
+func TestParquetWriterNotifiesUploadedFiles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.PutObjectOutput{}, nil).Times(1)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	notifier := &testFileNotifier{}
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		Notifier:       notifier,
+	})
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, time.Now(), spanRecord))
+	assert.NoError(writer.Close())
+
+	assert.Len(notifier.events, 1)
+	event := notifier.events[0]
+	assert.Equal("jaeger-spans", event.Bucket)
+	assert.True(strings.HasPrefix(event.Key, "/spans/2017/01/26/16/"))
+	assert.Equal("2017/01/26/16", event.Partition)
+	assert.Equal(int64(1), event.Rows)
+	assert.Greater(event.Bytes, int64(0))
+	assert.True(span.StartTime.Equal(event.MinTime))
+	assert.True(span.StartTime.Equal(event.MaxTime))
+}
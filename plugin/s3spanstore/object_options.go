@@ -0,0 +1,106 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+const (
+	maxObjectTags           = 10
+	maxObjectTagKeyLength   = 128
+	maxObjectTagValueLength = 256
+)
+
+// ObjectOptions are applied to every object uploaded to the bucket.
+type ObjectOptions struct {
+	ServerSideEncryption types.ServerSideEncryption
+	// SSEKMSKeyID is the customer managed KMS key used by aws:kms encryption
+	SSEKMSKeyID      string
+	BucketKeyEnabled bool
+	StorageClass     types.StorageClass
+	// Tagging is the URL encoded object tag set
+	Tagging string
+}
+
+func NewObjectOptions(s3Config config.S3) (ObjectOptions, error) {
+	opts := ObjectOptions{
+		ServerSideEncryption: types.ServerSideEncryption(s3Config.ServerSideEncryption),
+		SSEKMSKeyID:          s3Config.SSEKMSKeyID,
+		BucketKeyEnabled:     s3Config.SSEBucketKeyEnabled,
+		StorageClass:         types.StorageClass(s3Config.StorageClass),
+	}
+
+	if opts.SSEKMSKeyID != "" && opts.ServerSideEncryption == "" {
+		opts.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+	}
+
+	if opts.ServerSideEncryption != "" && !isServerSideEncryption(opts.ServerSideEncryption) {
+		return ObjectOptions{}, fmt.Errorf("unknown server side encryption %q", opts.ServerSideEncryption)
+	}
+
+	if opts.SSEKMSKeyID != "" && opts.ServerSideEncryption == types.ServerSideEncryptionAes256 {
+		return ObjectOptions{}, fmt.Errorf("a kms key requires aws:kms server side encryption")
+	}
+
+	if opts.StorageClass != "" && !isStorageClass(opts.StorageClass) {
+		return ObjectOptions{}, fmt.Errorf("unknown storage class %q", opts.StorageClass)
+	}
+
+	if len(s3Config.ObjectTags) > maxObjectTags {
+		return ObjectOptions{}, fmt.Errorf("at most %d object tags are supported", maxObjectTags)
+	}
+
+	tags := url.Values{}
+	for _, tag := range s3Config.ObjectTags {
+		if tag.Key == "" || len(tag.Key) > maxObjectTagKeyLength || len(tag.Value) > maxObjectTagValueLength {
+			return ObjectOptions{}, fmt.Errorf("invalid object tag %q", tag.Key)
+		}
+		if tags.Has(tag.Key) {
+			return ObjectOptions{}, fmt.Errorf("duplicate object tag %q", tag.Key)
+		}
+		tags.Set(tag.Key, tag.Value)
+	}
+	opts.Tagging = tags.Encode()
+
+	return opts, nil
+}
+
+// Apply sets the options on input.
+func (o ObjectOptions) Apply(input *s3.PutObjectInput) {
+	input.ServerSideEncryption = o.ServerSideEncryption
+	input.BucketKeyEnabled = o.BucketKeyEnabled
+	input.StorageClass = o.StorageClass
+
+	if o.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(o.SSEKMSKeyID)
+	}
+
+	if o.Tagging != "" {
+		input.Tagging = aws.String(o.Tagging)
+	}
+}
+
+func isServerSideEncryption(value types.ServerSideEncryption) bool {
+	for _, v := range value.Values() {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isStorageClass(value types.StorageClass) bool {
+	for _, v := range value.Values() {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,66 @@
+package s3spanstore
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewObjectOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	opts, err := NewObjectOptions(config.S3{
+		SSEKMSKeyID:         "arn:aws:kms:us-east-1:123456789012:key/jaeger",
+		SSEBucketKeyEnabled: true,
+		StorageClass:        "INTELLIGENT_TIERING",
+		ObjectTags: []config.ObjectTag{
+			{Key: "team", Value: "observability"},
+			{Key: "cost center", Value: "a&b"},
+		},
+	})
+	assert.NoError(err)
+	assert.Equal(types.ServerSideEncryptionAwsKms, opts.ServerSideEncryption)
+	assert.Equal(types.StorageClassIntelligentTiering, opts.StorageClass)
+	assert.Equal("cost+center=a%26b&team=observability", opts.Tagging)
+
+	input := &s3.PutObjectInput{Bucket: aws.String("jaeger-spans")}
+	opts.Apply(input)
+	assert.Equal(types.ServerSideEncryptionAwsKms, input.ServerSideEncryption)
+	assert.Equal("arn:aws:kms:us-east-1:123456789012:key/jaeger", *input.SSEKMSKeyId)
+	assert.True(input.BucketKeyEnabled)
+	assert.Equal(types.StorageClassIntelligentTiering, input.StorageClass)
+	assert.Equal("cost+center=a%26b&team=observability", *input.Tagging)
+}
+
+func TestNewObjectOptionsDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	opts, err := NewObjectOptions(config.S3{})
+	assert.NoError(err)
+
+	input := &s3.PutObjectInput{}
+	opts.Apply(input)
+	assert.Empty(input.ServerSideEncryption)
+	assert.Nil(input.SSEKMSKeyId)
+	assert.Empty(input.StorageClass)
+	assert.Nil(input.Tagging)
+}
+
+func TestNewObjectOptionsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s3Config := range []config.S3{
+		{ServerSideEncryption: "rot13"},
+		{ServerSideEncryption: "AES256", SSEKMSKeyID: "alias/jaeger"},
+		{StorageClass: "COLD"},
+		{ObjectTags: []config.ObjectTag{{Key: "", Value: "empty"}}},
+		{ObjectTags: []config.ObjectTag{{Key: "team", Value: "a"}, {Key: "team", Value: "b"}}},
+	} {
+		_, err := NewObjectOptions(s3Config)
+		assert.Error(err, "%+v", s3Config)
+	}
+}
@@ -26,3 +26,7 @@ func NewOperationRecordFromSpan(span *model.Span) (*OperationRecord, error) {
 func (w *OperationRecord) DedupeKey() string {
 	return fmt.Sprintf("%s/%s/%s", w.OperationName, w.SpanKind, w.ServiceName)
 }
+
+func (w *OperationRecord) GetServiceName() string {
+	return w.ServiceName
+}
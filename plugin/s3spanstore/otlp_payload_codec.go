@@ -0,0 +1,551 @@
+package s3spanstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the OTLP trace protobuf messages, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+const (
+	otlpTracesDataResourceSpans protowire.Number = 1
+
+	otlpResourceSpansResource   protowire.Number = 1
+	otlpResourceSpansScopeSpans protowire.Number = 2
+
+	otlpResourceAttributes protowire.Number = 1
+
+	otlpScopeSpansSpans protowire.Number = 2
+
+	otlpSpanTraceID      protowire.Number = 1
+	otlpSpanSpanID       protowire.Number = 2
+	otlpSpanParentSpanID protowire.Number = 4
+	otlpSpanName         protowire.Number = 5
+	otlpSpanKind         protowire.Number = 6
+	otlpSpanStartTime    protowire.Number = 7
+	otlpSpanEndTime      protowire.Number = 8
+	otlpSpanAttributes   protowire.Number = 9
+	otlpSpanEvents       protowire.Number = 11
+	otlpSpanLinks        protowire.Number = 13
+	otlpSpanFlags        protowire.Number = 16
+
+	otlpEventTime       protowire.Number = 1
+	otlpEventName       protowire.Number = 2
+	otlpEventAttributes protowire.Number = 3
+
+	otlpLinkTraceID    protowire.Number = 1
+	otlpLinkSpanID     protowire.Number = 2
+	otlpLinkAttributes protowire.Number = 4
+
+	otlpKeyValueKey   protowire.Number = 1
+	otlpKeyValueValue protowire.Number = 2
+
+	otlpAnyValueString protowire.Number = 1
+	otlpAnyValueBool   protowire.Number = 2
+	otlpAnyValueInt    protowire.Number = 3
+	otlpAnyValueDouble protowire.Number = 4
+	otlpAnyValueArray  protowire.Number = 5
+	otlpAnyValueBytes  protowire.Number = 7
+
+	otlpArrayValueValues protowire.Number = 1
+)
+
+const (
+	otlpServiceNameAttribute = "service.name"
+	otlpRefTypeAttribute     = "opentracing.ref_type"
+	otlpEventField           = "event"
+	otlpSpanKindTag          = "span.kind"
+	// Jaeger flags and warnings have no OTLP equivalent, the OTLP span flags
+	// contain W3C trace flags instead
+	otlpJaegerFlagsAttribute    = "jaeger.flags"
+	otlpJaegerWarningsAttribute = "jaeger.warnings"
+)
+
+var otlpSpanKinds = []string{"", "internal", "server", "client", "producer", "consumer"}
+
+// otlpProtoCodec encodes spans as OTLP TracesData with a single resource and span.
+// Parent references become the parent span id, other references become links and
+// logs become events. Jaeger flags and span warnings are stored as attributes.
+type otlpProtoCodec struct{}
+
+func (c *otlpProtoCodec) Name() string {
+	return PayloadCodecOTLPProto
+}
+
+func (c *otlpProtoCodec) Encode(span *model.Span) ([]byte, error) {
+	var resource []byte
+	if span.Process != nil {
+		resource = appendOTLPKeyValue(resource, otlpResourceAttributes, model.String(otlpServiceNameAttribute, span.Process.ServiceName))
+		for _, tag := range span.Process.Tags {
+			resource = appendOTLPKeyValue(resource, otlpResourceAttributes, tag)
+		}
+	}
+
+	scopeSpans := protowire.AppendTag(nil, otlpScopeSpansSpans, protowire.BytesType)
+	scopeSpans = protowire.AppendBytes(scopeSpans, encodeOTLPSpan(span))
+
+	var resourceSpans []byte
+	resourceSpans = protowire.AppendTag(resourceSpans, otlpResourceSpansResource, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, resource)
+	resourceSpans = protowire.AppendTag(resourceSpans, otlpResourceSpansScopeSpans, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, scopeSpans)
+
+	tracesData := protowire.AppendTag(nil, otlpTracesDataResourceSpans, protowire.BytesType)
+	return protowire.AppendBytes(tracesData, resourceSpans), nil
+}
+
+func encodeOTLPSpan(span *model.Span) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, otlpSpanTraceID, protowire.BytesType)
+	b = protowire.AppendBytes(b, otlpTraceID(span.TraceID))
+	b = protowire.AppendTag(b, otlpSpanSpanID, protowire.BytesType)
+	b = protowire.AppendBytes(b, otlpSpanID(span.SpanID))
+
+	parentSpanID := span.ParentSpanID()
+	if parentSpanID != 0 {
+		b = protowire.AppendTag(b, otlpSpanParentSpanID, protowire.BytesType)
+		b = protowire.AppendBytes(b, otlpSpanID(parentSpanID))
+	}
+
+	b = protowire.AppendTag(b, otlpSpanName, protowire.BytesType)
+	b = protowire.AppendString(b, span.OperationName)
+
+	kind := spanOTLPKind(span)
+	if kind > 0 {
+		b = protowire.AppendTag(b, otlpSpanKind, protowire.VarintType)
+		b = protowire.AppendVarint(b, kind)
+	}
+
+	b = protowire.AppendTag(b, otlpSpanStartTime, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(span.StartTime.UnixNano()))
+	b = protowire.AppendTag(b, otlpSpanEndTime, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(span.StartTime.Add(span.Duration).UnixNano()))
+
+	for _, tag := range span.Tags {
+		// The span kind tag is stored as OTLP span kind
+		if kind > 0 && tag.Key == otlpSpanKindTag {
+			continue
+		}
+		b = appendOTLPKeyValue(b, otlpSpanAttributes, tag)
+	}
+
+	for _, log := range span.Logs {
+		var event []byte
+		event = protowire.AppendTag(event, otlpEventTime, protowire.Fixed64Type)
+		event = protowire.AppendFixed64(event, uint64(log.Timestamp.UnixNano()))
+
+		fields := log.Fields
+		if len(fields) > 0 && fields[0].Key == otlpEventField && fields[0].VType == model.StringType {
+			event = protowire.AppendTag(event, otlpEventName, protowire.BytesType)
+			event = protowire.AppendString(event, fields[0].VStr)
+			fields = fields[1:]
+		}
+
+		for _, field := range fields {
+			event = appendOTLPKeyValue(event, otlpEventAttributes, field)
+		}
+
+		b = protowire.AppendTag(b, otlpSpanEvents, protowire.BytesType)
+		b = protowire.AppendBytes(b, event)
+	}
+
+	parentSkipped := false
+	for _, ref := range span.References {
+		if !parentSkipped && parentSpanID != 0 && ref.TraceID == span.TraceID && ref.SpanID == parentSpanID && ref.RefType == model.ChildOf {
+			parentSkipped = true
+			continue
+		}
+
+		refType := "follows_from"
+		if ref.RefType == model.ChildOf {
+			refType = "child_of"
+		}
+
+		var link []byte
+		link = protowire.AppendTag(link, otlpLinkTraceID, protowire.BytesType)
+		link = protowire.AppendBytes(link, otlpTraceID(ref.TraceID))
+		link = protowire.AppendTag(link, otlpLinkSpanID, protowire.BytesType)
+		link = protowire.AppendBytes(link, otlpSpanID(ref.SpanID))
+		link = appendOTLPKeyValue(link, otlpLinkAttributes, model.String(otlpRefTypeAttribute, refType))
+
+		b = protowire.AppendTag(b, otlpSpanLinks, protowire.BytesType)
+		b = protowire.AppendBytes(b, link)
+	}
+
+	if span.Flags != 0 {
+		b = appendOTLPKeyValue(b, otlpSpanAttributes, model.Int64(otlpJaegerFlagsAttribute, int64(span.Flags)))
+	}
+
+	if len(span.Warnings) > 0 {
+		b = appendOTLPStringArray(b, otlpSpanAttributes, otlpJaegerWarningsAttribute, span.Warnings)
+	}
+
+	return b
+}
+
+func appendOTLPStringArray(b []byte, num protowire.Number, key string, values []string) []byte {
+	var array []byte
+	for _, v := range values {
+		var value []byte
+		value = protowire.AppendTag(value, otlpAnyValueString, protowire.BytesType)
+		value = protowire.AppendString(value, v)
+
+		array = protowire.AppendTag(array, otlpArrayValueValues, protowire.BytesType)
+		array = protowire.AppendBytes(array, value)
+	}
+
+	var value []byte
+	value = protowire.AppendTag(value, otlpAnyValueArray, protowire.BytesType)
+	value = protowire.AppendBytes(value, array)
+
+	var keyValue []byte
+	keyValue = protowire.AppendTag(keyValue, otlpKeyValueKey, protowire.BytesType)
+	keyValue = protowire.AppendString(keyValue, key)
+	keyValue = protowire.AppendTag(keyValue, otlpKeyValueValue, protowire.BytesType)
+	keyValue = protowire.AppendBytes(keyValue, value)
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, keyValue)
+}
+
+// decodeOTLPStringArray returns the string values of an array attribute.
+func decodeOTLPStringArray(b []byte) ([]string, error) {
+	values := []string{}
+
+	err := consumeOTLPFields(b, func(num protowire.Number, value []byte) error {
+		if num != otlpKeyValueValue {
+			return nil
+		}
+
+		return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+			if num != otlpAnyValueArray {
+				return nil
+			}
+
+			return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+				if num != otlpArrayValueValues {
+					return nil
+				}
+
+				return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+					if num == otlpAnyValueString {
+						values = append(values, string(otlpBytes(value)))
+					}
+					return nil
+				})
+			})
+		})
+	})
+
+	return values, err
+}
+
+// spanOTLPKind returns the OTLP span kind of the span, or 0 if it has no known kind.
+func spanOTLPKind(span *model.Span) uint64 {
+	kind, ok := span.GetSpanKind()
+	if !ok {
+		return 0
+	}
+
+	for i := 1; i < len(otlpSpanKinds); i++ {
+		if otlpSpanKinds[i] == kind {
+			return uint64(i)
+		}
+	}
+
+	return 0
+}
+
+func appendOTLPKeyValue(b []byte, num protowire.Number, kv model.KeyValue) []byte {
+	var value []byte
+	switch kv.VType {
+	case model.BoolType:
+		value = protowire.AppendTag(value, otlpAnyValueBool, protowire.VarintType)
+		value = protowire.AppendVarint(value, protowire.EncodeBool(kv.VBool))
+	case model.Int64Type:
+		value = protowire.AppendTag(value, otlpAnyValueInt, protowire.VarintType)
+		value = protowire.AppendVarint(value, uint64(kv.VInt64))
+	case model.Float64Type:
+		value = protowire.AppendTag(value, otlpAnyValueDouble, protowire.Fixed64Type)
+		value = protowire.AppendFixed64(value, math.Float64bits(kv.VFloat64))
+	case model.BinaryType:
+		value = protowire.AppendTag(value, otlpAnyValueBytes, protowire.BytesType)
+		value = protowire.AppendBytes(value, kv.VBinary)
+	default:
+		value = protowire.AppendTag(value, otlpAnyValueString, protowire.BytesType)
+		value = protowire.AppendString(value, kv.VStr)
+	}
+
+	var keyValue []byte
+	keyValue = protowire.AppendTag(keyValue, otlpKeyValueKey, protowire.BytesType)
+	keyValue = protowire.AppendString(keyValue, kv.Key)
+	keyValue = protowire.AppendTag(keyValue, otlpKeyValueValue, protowire.BytesType)
+	keyValue = protowire.AppendBytes(keyValue, value)
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, keyValue)
+}
+
+func otlpTraceID(traceID model.TraceID) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], traceID.High)
+	binary.BigEndian.PutUint64(b[8:], traceID.Low)
+	return b
+}
+
+func otlpSpanID(spanID model.SpanID) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(spanID))
+	return b
+}
+
+func (c *otlpProtoCodec) Decode(payload []byte) (*model.Span, error) {
+	var span *model.Span
+	process := &model.Process{}
+
+	err := consumeOTLPFields(payload, func(num protowire.Number, value []byte) error {
+		if num != otlpTracesDataResourceSpans {
+			return nil
+		}
+
+		return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+			switch num {
+			case otlpResourceSpansResource:
+				return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+					if num != otlpResourceAttributes {
+						return nil
+					}
+
+					kv, err := decodeOTLPKeyValue(otlpBytes(value))
+					if err != nil {
+						return err
+					}
+
+					if kv.Key == otlpServiceNameAttribute && process.ServiceName == "" {
+						process.ServiceName = kv.VStr
+					} else {
+						process.Tags = append(process.Tags, kv)
+					}
+					return nil
+				})
+			case otlpResourceSpansScopeSpans:
+				return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+					if num != otlpScopeSpansSpans {
+						return nil
+					}
+
+					var err error
+					span, err = decodeOTLPSpan(otlpBytes(value))
+					return err
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal span: %w", err)
+	}
+
+	if span == nil {
+		return nil, fmt.Errorf("payload contains no span")
+	}
+
+	span.Process = process
+	return span, nil
+}
+
+func decodeOTLPSpan(b []byte) (*model.Span, error) {
+	span := &model.Span{}
+	var parentSpanID model.SpanID
+	var kind uint64
+	var startTime, endTime uint64
+	links := []model.SpanRef{}
+
+	err := consumeOTLPFields(b, func(num protowire.Number, value []byte) error {
+		var err error
+		switch num {
+		case otlpSpanTraceID:
+			span.TraceID, err = model.TraceIDFromBytes(otlpBytes(value))
+		case otlpSpanSpanID:
+			span.SpanID, err = model.SpanIDFromBytes(otlpBytes(value))
+		case otlpSpanParentSpanID:
+			parentSpanID, err = model.SpanIDFromBytes(otlpBytes(value))
+		case otlpSpanName:
+			span.OperationName = string(otlpBytes(value))
+		case otlpSpanKind:
+			kind, _ = protowire.ConsumeVarint(value)
+		case otlpSpanStartTime:
+			startTime, _ = protowire.ConsumeFixed64(value)
+		case otlpSpanEndTime:
+			endTime, _ = protowire.ConsumeFixed64(value)
+		case otlpSpanAttributes:
+			var kv model.KeyValue
+			if kv, err = decodeOTLPKeyValue(otlpBytes(value)); err == nil {
+				switch kv.Key {
+				case otlpJaegerFlagsAttribute:
+					span.Flags = model.Flags(kv.VInt64)
+				case otlpJaegerWarningsAttribute:
+					span.Warnings, err = decodeOTLPStringArray(otlpBytes(value))
+				default:
+					span.Tags = append(span.Tags, kv)
+				}
+			}
+		case otlpSpanEvents:
+			var log model.Log
+			if log, err = decodeOTLPEvent(otlpBytes(value)); err == nil {
+				span.Logs = append(span.Logs, log)
+			}
+		case otlpSpanLinks:
+			var ref model.SpanRef
+			if ref, err = decodeOTLPLink(otlpBytes(value)); err == nil {
+				links = append(links, ref)
+			}
+		case otlpSpanFlags:
+			// Payloads written by earlier versions stored the Jaeger flags here
+			if span.Flags == 0 {
+				flags, _ := protowire.ConsumeFixed32(value)
+				span.Flags = model.Flags(flags)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if kind > 0 && kind < uint64(len(otlpSpanKinds)) {
+		span.Tags = append(span.Tags, model.String(otlpSpanKindTag, otlpSpanKinds[kind]))
+	}
+
+	if parentSpanID != 0 {
+		span.References = append(span.References, model.NewChildOfRef(span.TraceID, parentSpanID))
+	}
+	span.References = append(span.References, links...)
+
+	span.StartTime = time.Unix(0, int64(startTime)).UTC()
+	span.Duration = time.Duration(endTime - startTime)
+
+	return span, nil
+}
+
+func decodeOTLPEvent(b []byte) (model.Log, error) {
+	log := model.Log{}
+	var name string
+
+	err := consumeOTLPFields(b, func(num protowire.Number, value []byte) error {
+		switch num {
+		case otlpEventTime:
+			timestamp, _ := protowire.ConsumeFixed64(value)
+			log.Timestamp = time.Unix(0, int64(timestamp)).UTC()
+		case otlpEventName:
+			name = string(otlpBytes(value))
+		case otlpEventAttributes:
+			kv, err := decodeOTLPKeyValue(otlpBytes(value))
+			if err != nil {
+				return err
+			}
+			log.Fields = append(log.Fields, kv)
+		}
+		return nil
+	})
+
+	if name != "" {
+		log.Fields = append([]model.KeyValue{model.String(otlpEventField, name)}, log.Fields...)
+	}
+
+	return log, err
+}
+
+func decodeOTLPLink(b []byte) (model.SpanRef, error) {
+	ref := model.SpanRef{RefType: model.FollowsFrom}
+
+	err := consumeOTLPFields(b, func(num protowire.Number, value []byte) error {
+		var err error
+		switch num {
+		case otlpLinkTraceID:
+			ref.TraceID, err = model.TraceIDFromBytes(otlpBytes(value))
+		case otlpLinkSpanID:
+			ref.SpanID, err = model.SpanIDFromBytes(otlpBytes(value))
+		case otlpLinkAttributes:
+			var kv model.KeyValue
+			if kv, err = decodeOTLPKeyValue(otlpBytes(value)); err == nil && kv.Key == otlpRefTypeAttribute && kv.VStr == "child_of" {
+				ref.RefType = model.ChildOf
+			}
+		}
+		return err
+	})
+
+	return ref, err
+}
+
+func decodeOTLPKeyValue(b []byte) (model.KeyValue, error) {
+	kv := model.KeyValue{}
+
+	err := consumeOTLPFields(b, func(num protowire.Number, value []byte) error {
+		switch num {
+		case otlpKeyValueKey:
+			kv.Key = string(otlpBytes(value))
+		case otlpKeyValueValue:
+			return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+				switch num {
+				case otlpAnyValueString:
+					kv.VType = model.StringType
+					kv.VStr = string(otlpBytes(value))
+				case otlpAnyValueBool:
+					v, _ := protowire.ConsumeVarint(value)
+					kv.VType = model.BoolType
+					kv.VBool = protowire.DecodeBool(v)
+				case otlpAnyValueInt:
+					v, _ := protowire.ConsumeVarint(value)
+					kv.VType = model.Int64Type
+					kv.VInt64 = int64(v)
+				case otlpAnyValueDouble:
+					v, _ := protowire.ConsumeFixed64(value)
+					kv.VType = model.Float64Type
+					kv.VFloat64 = math.Float64frombits(v)
+				case otlpAnyValueBytes:
+					kv.VType = model.BinaryType
+					kv.VBinary = append([]byte{}, otlpBytes(value)...)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	return kv, err
+}
+
+// consumeOTLPFields calls fn with the number and raw value of every field in b.
+func consumeOTLPFields(b []byte, fn func(num protowire.Number, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+
+		if err := fn(num, b[:m]); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+
+	return nil
+}
+
+// otlpBytes returns the content of a length-delimited field value.
+func otlpBytes(value []byte) []byte {
+	v, _ := protowire.ConsumeBytes(value)
+	return v
+}
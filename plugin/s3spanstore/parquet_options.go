@@ -0,0 +1,70 @@
+package s3spanstore
+
+import (
+	"fmt"
+
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+var parquetCompressionCodecs = map[string]parquet.CompressionCodec{
+	"":       parquet.CompressionCodec_SNAPPY,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"zstd":   parquet.CompressionCodec_ZSTD,
+	"gzip":   parquet.CompressionCodec_GZIP,
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+}
+
+// ParquetOptions controls the encoding of written parquet files. Zero values use
+// the parquet-go defaults, snappy compression, 128 MB row groups and 8 KB pages.
+type ParquetOptions struct {
+	// Compression is one of snappy, zstd, gzip or none
+	Compression  string
+	RowGroupSize int64
+	PageSize     int64
+	// Parallelism is the number of goroutines used to encode a file
+	Parallelism int64
+}
+
+func NewParquetOptions(s3Config config.S3) (ParquetOptions, error) {
+	if _, ok := parquetCompressionCodecs[s3Config.ParquetCompression]; !ok {
+		return ParquetOptions{}, fmt.Errorf("unknown parquet compression %q", s3Config.ParquetCompression)
+	}
+
+	return ParquetOptions{
+		Compression:  s3Config.ParquetCompression,
+		RowGroupSize: s3Config.ParquetRowGroupSize,
+		PageSize:     s3Config.ParquetPageSize,
+		Parallelism:  s3Config.ParquetParallelism,
+	}, nil
+}
+
+// NewWriter creates a parquet writer for rowType writing into file.
+func (o ParquetOptions) NewWriter(file source.ParquetFile, rowType interface{}) (*writer.ParquetWriter, error) {
+	compression, ok := parquetCompressionCodecs[o.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown parquet compression %q", o.Compression)
+	}
+
+	parallelism := o.Parallelism
+	if parallelism <= 0 {
+		parallelism = PARQUET_CONCURRENCY
+	}
+
+	parquetWriter, err := writer.NewParquetWriter(file, rowType, parallelism)
+	if err != nil {
+		return nil, err
+	}
+
+	parquetWriter.CompressionType = compression
+	if o.RowGroupSize > 0 {
+		parquetWriter.RowGroupSize = o.RowGroupSize
+	}
+	if o.PageSize > 0 {
+		parquetWriter.PageSize = o.PageSize
+	}
+
+	return parquetWriter, nil
+}
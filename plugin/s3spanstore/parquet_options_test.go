@@ -0,0 +1,47 @@
+package s3spanstore
+
+import (
+	"testing"
+
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+func TestParquetOptionsNewWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	opts, err := NewParquetOptions(config.S3{
+		ParquetCompression:  "zstd",
+		ParquetRowGroupSize: 64 * 1024 * 1024,
+		ParquetPageSize:     1024 * 1024,
+		ParquetParallelism:  4,
+	})
+	assert.NoError(err)
+
+	parquetWriter, err := opts.NewWriter(buffer.NewBufferFile(), new(SpanRecord))
+	assert.NoError(err)
+	assert.Equal(parquet.CompressionCodec_ZSTD, parquetWriter.CompressionType)
+	assert.Equal(int64(64*1024*1024), parquetWriter.RowGroupSize)
+	assert.Equal(int64(1024*1024), parquetWriter.PageSize)
+	assert.Equal(int64(4), parquetWriter.NP)
+}
+
+func TestParquetOptionsDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	parquetWriter, err := ParquetOptions{}.NewWriter(buffer.NewBufferFile(), new(SpanRecord))
+	assert.NoError(err)
+	assert.Equal(parquet.CompressionCodec_SNAPPY, parquetWriter.CompressionType)
+	assert.Equal(int64(128*1024*1024), parquetWriter.RowGroupSize)
+	assert.Equal(int64(8*1024), parquetWriter.PageSize)
+	assert.Equal(int64(PARQUET_CONCURRENCY), parquetWriter.NP)
+}
+
+func TestNewParquetOptionsInvalidCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewParquetOptions(config.S3{ParquetCompression: "brotli"})
+	assert.Error(err)
+}
@@ -0,0 +1,269 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+// RetryOptions configures the exponential backoff between upload attempts.
+type RetryOptions struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// failedUploadsDirectory keeps the files which failed all upload attempts
+// without a dead letter queue, using the layout of LocalDeadLetterQueue, so
+// they can be replayed from there.
+const failedUploadsDirectory = "failed"
+
+// abortMultipartUploadTimeout bounds aborting a failed multipart upload, which
+// also happens after the shutdown deadline
+const abortMultipartUploadTimeout = time.Second * 10
+
+var defaultRetryOptions = RetryOptions{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Second * 30,
+}
+
+func NewRetryOptions(s3Config config.S3) (RetryOptions, error) {
+	retryOptions := defaultRetryOptions
+
+	if s3Config.UploadMaxAttempts > 0 {
+		retryOptions.MaxAttempts = s3Config.UploadMaxAttempts
+	}
+
+	initialBackoff, err := parseDurationWithDefault(s3Config.UploadInitialBackoff, defaultRetryOptions.InitialBackoff)
+	if err != nil {
+		return retryOptions, fmt.Errorf("failed to parse upload initial backoff: %w", err)
+	}
+	retryOptions.InitialBackoff = initialBackoff
+
+	maxBackoff, err := parseDurationWithDefault(s3Config.UploadMaxBackoff, defaultRetryOptions.MaxBackoff)
+	if err != nil {
+		return retryOptions, fmt.Errorf("failed to parse upload max backoff: %w", err)
+	}
+	retryOptions.MaxBackoff = maxBackoff
+
+	return retryOptions, nil
+}
+
+func (o RetryOptions) backoff(attempt int) time.Duration {
+	backoff := o.InitialBackoff
+	for i := 1; i < attempt && backoff < o.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > o.MaxBackoff {
+		return o.MaxBackoff
+	}
+	return backoff
+}
+
+// ParquetUploader uploads locally buffered parquet files to S3, retrying failed
+// uploads and handing files to the dead letter queue once all attempts failed.
+type ParquetUploader struct {
+	logger          hclog.Logger
+	svc             S3API
+	bucketName      string
+	retryOptions    RetryOptions
+	objectOptions   ObjectOptions
+	deadLetterQueue DeadLetterQueue
+}
+
+func NewParquetUploader(logger hclog.Logger, svc S3API, bucketName string, retryOptions RetryOptions, objectOptions ObjectOptions, deadLetterQueue DeadLetterQueue) *ParquetUploader {
+	if retryOptions.MaxAttempts < 1 {
+		retryOptions = defaultRetryOptions
+	}
+
+	return &ParquetUploader{
+		logger:          logger,
+		svc:             svc,
+		bucketName:      bucketName,
+		retryOptions:    retryOptions,
+		objectOptions:   objectOptions,
+		deadLetterQueue: deadLetterQueue,
+	}
+}
+
+// Upload uploads the file at path to key and removes it afterwards, also if the
+// upload failed. It is used for files which can be recreated, e.g. compacted files.
+func (u *ParquetUploader) Upload(ctx context.Context, key string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open parquet file: %w", err)
+	}
+
+	err = u.uploadWithRetries(ctx, key, file)
+	file.Close()
+
+	if removeErr := os.Remove(path); err == nil {
+		err = removeErr
+	}
+
+	return err
+}
+
+// UploadOrDeadLetter uploads the file at path to key and removes it afterwards.
+// Files failing all attempts are moved to the dead letter queue, which is
+// reported, or without one into failedUploadsDirectory next to the file. The
+// manifest is kept with the dead letter, so the file can be committed once it
+// is replayed.
+func (u *ParquetUploader) UploadOrDeadLetter(ctx context.Context, key string, path string, manifest *FileManifest) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open parquet file: %w", err)
+	}
+
+	err = u.uploadWithRetries(ctx, key, file)
+	file.Close()
+
+	if err == nil {
+		return false, os.Remove(path)
+	}
+
+	// Aborted uploads, e.g. on shutdown, didn't fail because of the file, so it
+	// is kept locally instead of being dropped or dead lettered
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, fmt.Errorf("parquet file upload aborted, keeping it locally: %w", err)
+	}
+
+	if u.deadLetterQueue == nil {
+		failedPath := filepath.Join(filepath.Dir(path), failedUploadsDirectory, filepath.FromSlash(key))
+		if mkdirErr := os.MkdirAll(filepath.Dir(failedPath), 0755); mkdirErr != nil {
+			return false, fmt.Errorf("failed to create failed uploads directory: %w, upload error: %v", mkdirErr, err)
+		}
+		if moveErr := moveFile(path, failedPath); moveErr != nil {
+			return false, fmt.Errorf("failed to keep parquet file: %w, upload error: %v", moveErr, err)
+		}
+
+		u.logger.Error("failed to upload parquet file, keeping it locally", "key", key, "path", failedPath, "error", err)
+		return false, fmt.Errorf("failed to upload parquet file, keeping it at %s: %w", failedPath, err)
+	}
+
+	u.logger.Error("failed to upload parquet file, moving it to the dead letter queue", "key", key, "error", err)
+	if dlqErr := u.deadLetterQueue.Put(ctx, key, path, manifest); dlqErr != nil {
+		return false, fmt.Errorf("failed to move parquet file to dead letter queue: %w, upload error: %v", dlqErr, err)
+	}
+
+	return true, nil
+}
+
+func (u *ParquetUploader) uploadWithRetries(ctx context.Context, key string, body io.ReadSeeker) error {
+	var err error
+	for attempt := 1; attempt <= u.retryOptions.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			backoff := u.retryOptions.backoff(attempt - 1)
+			u.logger.Warn("retrying parquet file upload", "key", key, "attempt", attempt, "backoff", backoff, "error", err)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		if _, seekErr := body.Seek(0, io.SeekStart); seekErr != nil {
+			return fmt.Errorf("failed to rewind parquet file: %w", seekErr)
+		}
+
+		if err = u.upload(ctx, key, body); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (u *ParquetUploader) upload(ctx context.Context, key string, body io.Reader) error {
+	// The uploader would abort failed multipart uploads using the already
+	// cancelled ctx on shutdown, so they are aborted below instead
+	uploader := manager.NewUploader(u.svc, func(uploader *manager.Uploader) {
+		uploader.LeavePartsOnError = true
+	})
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(u.bucketName),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	u.objectOptions.Apply(input)
+
+	if _, err := uploader.Upload(ctx, input); err != nil {
+		var multiUploadFailure manager.MultiUploadFailure
+		if errors.As(err, &multiUploadFailure) {
+			u.abortMultipartUpload(key, multiUploadFailure.UploadID())
+		}
+
+		return fmt.Errorf("failed to upload parquet file: %w", err)
+	}
+
+	return nil
+}
+
+func (u *ParquetUploader) abortMultipartUpload(key string, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), abortMultipartUploadTimeout)
+	defer cancel()
+
+	if _, err := u.svc.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}); err != nil {
+		u.logger.Error("failed to abort multipart upload", "key", key, "uploadId", uploadID, "error", err)
+	}
+}
+
+// ReplayDeadLetters uploads all files from the dead letter queue to their
+// original key. Replayed files are committed like rotated files, their manifest
+// is written if manifestsPrefix is set and the notifier is informed, if not nil.
+func ReplayDeadLetters(ctx context.Context, logger hclog.Logger, svc S3API, bucketName string, retryOptions RetryOptions, objectOptions ObjectOptions, manifestsPrefix string, notifier FileNotifier, deadLetterQueue DeadLetterQueue) (int, error) {
+	uploader := NewParquetUploader(logger, svc, bucketName, retryOptions, objectOptions, nil)
+
+	replayed := 0
+	err := deadLetterQueue.Replay(ctx, func(key string, body io.ReadSeeker, manifest *FileManifest) error {
+		if err := uploader.uploadWithRetries(ctx, key, body); err != nil {
+			return fmt.Errorf("failed to replay %s: %w", key, err)
+		}
+
+		logger.Info("replayed dead letter", "key", key)
+		replayed++
+
+		// The file is already uploaded, so committing it only logs failures
+		if manifestsPrefix != "" && manifest != nil {
+			if err := putFileManifest(ctx, svc, bucketName, manifestsPrefix, objectOptions, manifest); err != nil {
+				logger.Error("failed to put manifest", "key", key, "error", err)
+			}
+		}
+
+		if notifier != nil {
+			// Files dead lettered without a manifest are only described by their key and size
+			event := FileEvent{Bucket: bucketName, Key: key}
+			if manifest != nil {
+				event = newFileEvent(bucketName, manifest)
+			} else if size, err := body.Seek(0, io.SeekEnd); err == nil {
+				event.Bytes = size
+			}
+
+			if err := notifier.Notify(ctx, event); err != nil {
+				logger.Error("failed to notify about replayed file", "key", key, "error", err)
+			}
+		}
+
+		return nil
+	})
+
+	return replayed, err
+}
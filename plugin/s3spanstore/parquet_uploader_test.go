@@ -0,0 +1,285 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRetryOptions = RetryOptions{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     time.Millisecond * 5,
+}
+
+func newTestParquetFile(assert *assert.Assertions, dir string) string {
+	path := filepath.Join(dir, "test.parquet")
+	assert.NoError(os.WriteFile(path, []byte("PAR1"), 0644))
+
+	return path
+}
+
+func TestRetryOptionsBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	retryOptions := RetryOptions{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: time.Second * 5}
+
+	assert.Equal(time.Second, retryOptions.backoff(1))
+	assert.Equal(time.Second*2, retryOptions.backoff(2))
+	assert.Equal(time.Second*4, retryOptions.backoff(3))
+	assert.Equal(time.Second*5, retryOptions.backoff(4))
+	assert.Equal(time.Second*5, retryOptions.backoff(9))
+}
+
+func TestParquetUploaderRetries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, errors.New("service unavailable")).Times(2)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.PutObjectOutput{}, nil).Times(1)
+
+	path := newTestParquetFile(assert, t.TempDir())
+
+	uploader := NewParquetUploader(hclog.NewNullLogger(), mockSvc, "jaeger-spans", testRetryOptions, ObjectOptions{}, nil)
+	assert.NoError(uploader.Upload(ctx, "spans/test.parquet", path))
+
+	_, err := os.Stat(path)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestParquetUploaderAppliesObjectOptions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	objectOptions := ObjectOptions{
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyID:          "alias/jaeger",
+		BucketKeyEnabled:     true,
+		StorageClass:         types.StorageClassStandardIa,
+		Tagging:              "team=observability",
+	}
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			assert.Equal(types.ServerSideEncryptionAwsKms, input.ServerSideEncryption)
+			assert.Equal("alias/jaeger", *input.SSEKMSKeyId)
+			assert.True(input.BucketKeyEnabled)
+			assert.Equal(types.StorageClassStandardIa, input.StorageClass)
+			assert.Equal("team=observability", *input.Tagging)
+
+			return &s3.PutObjectOutput{}, nil
+		}).Times(1)
+
+	path := newTestParquetFile(assert, t.TempDir())
+
+	uploader := NewParquetUploader(hclog.NewNullLogger(), mockSvc, "jaeger-spans", testRetryOptions, objectOptions, nil)
+	assert.NoError(uploader.Upload(ctx, "spans/test.parquet", path))
+}
+
+func TestParquetUploaderDeadLetterAndReplay(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, errors.New("service unavailable")).Times(3)
+
+	deadLetterQueue, err := NewLocalDeadLetterQueue(t.TempDir())
+	assert.NoError(err)
+
+	path := newTestParquetFile(assert, t.TempDir())
+
+	manifest := &FileManifest{
+		Key:       "spans/2021/01/30/06/test.parquet",
+		Partition: "2021/01/30/06",
+		Rows:      3,
+		Bytes:     4,
+	}
+
+	uploader := NewParquetUploader(hclog.NewNullLogger(), mockSvc, "jaeger-spans", testRetryOptions, ObjectOptions{}, deadLetterQueue)
+	deadLettered, err := uploader.UploadOrDeadLetter(ctx, "spans/2021/01/30/06/test.parquet", path, manifest)
+	assert.NoError(err)
+	assert.True(deadLettered)
+
+	_, err = os.Stat(filepath.Join(deadLetterQueue.dir, "spans", "2021", "01", "30", "06", "test.parquet"))
+	assert.NoError(err)
+	_, err = os.Stat(filepath.Join(deadLetterQueue.dir, "spans", "2021", "01", "30", "06", "test.parquet"+deadLetterManifestSuffix))
+	assert.NoError(err)
+
+	var replayedKey string
+	var replayedBody []byte
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			replayedKey = *input.Key
+			replayedBody, err = io.ReadAll(input.Body)
+			return &s3.PutObjectOutput{}, err
+		}).Times(1)
+
+	var manifestKey string
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			manifestKey = *input.Key
+			return &s3.PutObjectOutput{}, nil
+		}).Times(1)
+
+	notifier := &testFileNotifier{}
+
+	replayed, err := ReplayDeadLetters(ctx, hclog.NewNullLogger(), mockSvc, "jaeger-spans", testRetryOptions, ObjectOptions{}, "manifests/", notifier, deadLetterQueue)
+	assert.NoError(err)
+	assert.Equal(1, replayed)
+	assert.Equal("spans/2021/01/30/06/test.parquet", replayedKey)
+	assert.Equal([]byte("PAR1"), replayedBody)
+
+	// Replayed files are committed like rotated files
+	assert.Equal("manifests/spans/2021/01/30/06/test.json", manifestKey)
+	assert.Equal([]FileEvent{{
+		Bucket:    "jaeger-spans",
+		Key:       "spans/2021/01/30/06/test.parquet",
+		Partition: "2021/01/30/06",
+		Rows:      3,
+		Bytes:     4,
+	}}, notifier.events)
+
+	_, err = os.Stat(filepath.Join(deadLetterQueue.dir, "spans", "2021", "01", "30", "06", "test.parquet"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(deadLetterQueue.dir, "spans", "2021", "01", "30", "06", "test.parquet"+deadLetterManifestSuffix))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestParquetUploaderWithoutDeadLetterQueue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, errors.New("service unavailable")).Times(3)
+
+	path := newTestParquetFile(assert, t.TempDir())
+
+	uploader := NewParquetUploader(hclog.NewNullLogger(), mockSvc, "jaeger-spans", testRetryOptions, ObjectOptions{}, nil)
+	assert.Error(uploader.Upload(ctx, "spans/test.parquet", path))
+}
+
+func TestParquetUploaderKeepsFailedFilesWithoutDeadLetterQueue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, errors.New("service unavailable")).Times(3)
+
+	bufferDir := t.TempDir()
+	path := newTestParquetFile(assert, bufferDir)
+
+	uploader := NewParquetUploader(hclog.NewNullLogger(), mockSvc, "jaeger-spans", testRetryOptions, ObjectOptions{}, nil)
+	deadLettered, err := uploader.UploadOrDeadLetter(ctx, "spans/2021/01/30/06/test.parquet", path, nil)
+	assert.Error(err)
+	assert.False(deadLettered)
+
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	// Failed files are kept in the layout of the local dead letter queue
+	failedDir := filepath.Join(bufferDir, failedUploadsDirectory)
+	_, err = os.Stat(filepath.Join(failedDir, "spans", "2021", "01", "30", "06", "test.parquet"))
+	assert.NoError(err)
+
+	deadLetterQueue, err := NewLocalDeadLetterQueue(failedDir)
+	assert.NoError(err)
+
+	keys := []string{}
+	assert.NoError(deadLetterQueue.Replay(ctx, func(key string, _ io.ReadSeeker, _ *FileManifest) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal([]string{"spans/2021/01/30/06/test.parquet"}, keys)
+}
+
+func TestParquetUploaderKeepsAbortedUploads(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			cancel()
+			return nil, context.Canceled
+		}).Times(1)
+
+	deadLetterQueue, err := NewLocalDeadLetterQueue(t.TempDir())
+	assert.NoError(err)
+
+	path := newTestParquetFile(assert, t.TempDir())
+
+	uploader := NewParquetUploader(hclog.NewNullLogger(), mockSvc, "jaeger-spans", testRetryOptions, ObjectOptions{}, deadLetterQueue)
+	deadLettered, err := uploader.UploadOrDeadLetter(ctx, "spans/test.parquet", path, nil)
+	assert.ErrorIs(err, context.Canceled)
+	assert.False(deadLettered)
+
+	_, err = os.Stat(path)
+	assert.NoError(err)
+	_, err = os.Stat(filepath.Join(deadLetterQueue.dir, "spans", "test.parquet"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestParquetUploaderAbortsFailedMultipartUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil).Times(1)
+	mockSvc.EXPECT().UploadPart(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, errors.New("service unavailable")).MinTimes(1)
+	mockSvc.EXPECT().AbortMultipartUpload(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+			assert.Equal("upload-1", *input.UploadId)
+			assert.Equal("spans/test.parquet", *input.Key)
+			return &s3.AbortMultipartUploadOutput{}, nil
+		}).Times(1)
+
+	// Files larger than the part size are uploaded using a multipart upload
+	path := filepath.Join(t.TempDir(), "test.parquet")
+	assert.NoError(os.WriteFile(path, make([]byte, manager.DefaultUploadPartSize+1), 0644))
+
+	uploader := NewParquetUploader(hclog.NewNullLogger(), mockSvc, "jaeger-spans", RetryOptions{MaxAttempts: 1}, ObjectOptions{}, nil)
+	assert.Error(uploader.Upload(ctx, "spans/test.parquet", path))
+}
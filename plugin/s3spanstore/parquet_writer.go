@@ -2,22 +2,28 @@ package s3spanstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
-	"github.com/xitongsys/parquet-go-source/s3v2"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/metrics"
+	"github.com/xitongsys/parquet-go-source/local"
 	"github.com/xitongsys/parquet-go/source"
 	"github.com/xitongsys/parquet-go/writer"
 )
 
 const (
 	PARQUET_CONCURRENCY = 1
-	PARTION_FORMAT      = "2006/01/02/15"
 )
 
+// ErrParquetWriterStopped is returned by writes after Shutdown was called
+var ErrParquetWriterStopped = errors.New("parquet writer is shut down")
+
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func RandStringBytes(n int) string {
@@ -32,13 +38,83 @@ func S3ParquetKey(prefix, suffix string, datehour string) string {
 	return prefix + datehour + "/" + suffix + ".parquet"
 }
 
+// ServiceRow is implemented by rows, which can be partitioned by service
+type ServiceRow interface {
+	GetServiceName() string
+}
+
+// RowMapper converts rows before they are written into parquet files, e.g. to
+// add columns which are derived from the row
+type RowMapper interface {
+	// RowType returns the parquet row type of mapped rows
+	RowType() interface{}
+	MapRow(row interface{}) (interface{}, error)
+}
+
+// S3PartitionKey returns the partition key of t in the default partition scheme
 func S3PartitionKey(t time.Time) string {
-	return t.Format(PARTION_FORMAT)
+	return DefaultPartitionScheme.Key(t, "")
 }
 
 type ParquetRef struct {
+	key              string
+	localPath        string
 	parquetWriteFile source.ParquetFile
 	parquetWriter    *writer.ParquetWriter
+	spoolSegment     *SpoolSegment
+	rows             int64
+	// openedAt is the time of the first write, all rows of the file were written afterwards
+	openedAt time.Time
+
+	// Manifest fields, bytes is set once the file is closed
+	partition string
+	sequence  uint64
+	bytes     int64
+	minTime   time.Time
+	maxTime   time.Time
+	services  map[string]bool
+	// deadLettered is set if the file was moved to the dead letter queue instead of being uploaded
+	deadLettered bool
+}
+
+// Size returns the estimated size of the parquet file in bytes, including
+// rows still buffered in memory.
+func (r *ParquetRef) Size() int64 {
+	return r.parquetWriter.Offset + r.parquetWriter.Size + r.parquetWriter.ObjsSize
+}
+
+// ParquetWriterOptions controls when the open parquet files are rotated.
+type ParquetWriterOptions struct {
+	// BufferDuration is the interval in which all open files are rotated
+	BufferDuration time.Duration
+	// MaxBytes rotates a partition's file once it exceeds this size, 0 disables the limit
+	MaxBytes int64
+	// MaxRows rotates a partition's file once it contains this many rows, 0 disables the limit
+	MaxRows int64
+	// PartitionScheme maps row times to partitions
+	PartitionScheme PartitionScheme
+	// SpoolDirectory enables a local write-ahead log for buffered rows, empty disables the spool
+	SpoolDirectory string
+	// SpoolSync is the interval in which spooled rows are synced to disk, 0 syncs every row
+	SpoolSync time.Duration
+	// BufferDirectory holds parquet files until they are uploaded, defaults to a temporary directory
+	BufferDirectory string
+	// RetryOptions controls retries of failed uploads
+	RetryOptions RetryOptions
+	// ObjectOptions sets encryption, storage class and tags of uploaded objects
+	ObjectOptions ObjectOptions
+	// DeadLetterQueue receives files which failed all upload attempts, nil drops them
+	DeadLetterQueue DeadLetterQueue
+	// ParquetOptions controls compression and sizes of the written files
+	ParquetOptions ParquetOptions
+	// RowMapper converts rows before they are written, nil writes rows as they are
+	RowMapper RowMapper
+	// InstanceID identifies the writer in object keys, defaults to the hostname
+	InstanceID string
+	// ManifestsPrefix enables a manifest object per uploaded file, empty disables manifests
+	ManifestsPrefix string
+	// Notifier is informed about every uploaded file, nil disables notifications
+	Notifier FileNotifier
 }
 
 type ParquetWriter struct {
@@ -47,78 +123,327 @@ type ParquetWriter struct {
 	bucketName string
 	prefix     string
 	ticker     *time.Ticker
-	done       chan bool
+	done       chan struct{}
 	rowType    interface{}
+	maxBytes   int64
+	maxRows    int64
+	partitions PartitionScheme
+	spool      *Spool
+	spoolSync  time.Duration
+	bufferDir  string
+	uploader   *ParquetUploader
+	parquet    ParquetOptions
+	rowMapper  RowMapper
+
+	// Files are named by instance, start of the writer and a sequence number
+	instanceID      string
+	startedAt       time.Time
+	sequence        uint64
+	manifestsPrefix string
+	notifier        FileNotifier
+	objectOptions   ObjectOptions
+
+	rowsWritten      *metrics.Counter
+	openFiles        *metrics.Gauge
+	rotationDuration *metrics.Histogram
+	uploadedBytes    *metrics.Counter
+
+	bufferDirTemporary bool
 
 	parquetWriterRefs map[string]*ParquetRef
 	bufferMutex       sync.Mutex
 	bufferMaxUntil    *time.Time
 	ctx               context.Context
+	cancelUploads     context.CancelFunc
+	closeWaitGroup    sync.WaitGroup
+	stopOnce          sync.Once
+
+	// stopping rejects writes once Shutdown started, so no rotation is added to
+	// the closeWaitGroup while Shutdown waits for it, guarded by bufferMutex
+	stopping bool
+	// unfinishedRefs contains all open or rotated files which haven't been
+	// uploaded yet, guarded by bufferMutex
+	unfinishedRefs map[*ParquetRef]bool
 }
 
 type IParquetWriter interface {
 	Write(ctx context.Context, time time.Time, maxBufferUntil time.Time, row interface{}) error
+	WriteRows(ctx context.Context, rows []ParquetRow) error
+	// Shutdown flushes all buffered rows, uploads still running once ctx is done are aborted
+	Shutdown(ctx context.Context) error
 	Close() error
+	// UploadedBefore returns a time before which all written rows have been uploaded
+	UploadedBefore() time.Time
+}
+
+// ParquetRow is a single row written by WriteRows
+type ParquetRow struct {
+	Time           time.Time
+	MaxBufferUntil time.Time
+	Row            interface{}
 }
 
-func NewParquetWriter(ctx context.Context, logger hclog.Logger, svc S3API, bufferDuration time.Duration, bucketName string, prefix string, rowType interface{}) (*ParquetWriter, error) {
+func NewParquetWriter(ctx context.Context, logger hclog.Logger, svc S3API, opts ParquetWriterOptions, bucketName string, prefix string, rowType interface{}) (*ParquetWriter, error) {
+	ctx, cancelUploads := context.WithCancel(ctx)
+
 	w := &ParquetWriter{
 		svc:               svc,
 		bucketName:        bucketName,
 		prefix:            prefix,
 		logger:            logger,
-		ticker:            time.NewTicker(bufferDuration),
-		done:              make(chan bool),
+		ticker:            time.NewTicker(opts.BufferDuration),
+		maxBytes:          opts.MaxBytes,
+		maxRows:           opts.MaxRows,
+		spoolSync:         opts.SpoolSync,
+		partitions:        opts.PartitionScheme,
+		parquet:           opts.ParquetOptions,
+		rowMapper:         opts.RowMapper,
+		instanceID:        NewInstanceID(opts.InstanceID),
+		startedAt:         time.Now().UTC().Truncate(time.Second),
+		manifestsPrefix:   opts.ManifestsPrefix,
+		notifier:          opts.Notifier,
+		objectOptions:     opts.ObjectOptions,
+		rowsWritten:       parquetRowsWrittenTotal.With(prefix),
+		openFiles:         parquetOpenFiles.With(prefix),
+		rotationDuration:  parquetRotationDuration.With(prefix),
+		uploadedBytes:     parquetUploadedBytesTotal.With(prefix),
+		done:              make(chan struct{}),
 		parquetWriterRefs: map[string]*ParquetRef{},
+		unfinishedRefs:    map[*ParquetRef]bool{},
 		ctx:               ctx,
+		cancelUploads:     cancelUploads,
 		rowType:           rowType,
+		uploader:          NewParquetUploader(logger, svc, bucketName, opts.RetryOptions, opts.ObjectOptions, opts.DeadLetterQueue),
 	}
 
+	if err := w.prepareBufferDirectory(opts.BufferDirectory); err != nil {
+		cancelUploads()
+		return nil, fmt.Errorf("failed to prepare buffer directory: %w", err)
+	}
+
+	if opts.SpoolDirectory != "" {
+		spool, err := NewSpool(opts.SpoolDirectory, rowType)
+		if err != nil {
+			cancelUploads()
+			return nil, fmt.Errorf("failed to create spool: %w", err)
+		}
+		w.spool = spool
+
+		if err := w.replaySpool(); err != nil {
+			cancelUploads()
+			return nil, fmt.Errorf("failed to replay spool: %w", err)
+		}
+	}
+
+	// Shutdown waits for a running rotation
+	w.closeWaitGroup.Add(1)
 	go func() {
+		defer w.closeWaitGroup.Done()
+
 		for {
 			select {
 			case <-w.done:
 				return
 			case <-w.ticker.C:
 				if err := w.rotateParquetWriters(); err != nil {
-					w.logger.Error("failed to rotate parquet writer", err)
+					w.logger.Error("failed to rotate parquet writer", "error", err)
 				}
 			}
 		}
 	}()
 
+	if w.spool != nil && w.spoolSync > 0 {
+		w.closeWaitGroup.Add(1)
+		go func() {
+			defer w.closeWaitGroup.Done()
+
+			ticker := time.NewTicker(w.spoolSync)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-w.done:
+					return
+				case <-ticker.C:
+					if err := w.syncSpoolSegments(); err != nil {
+						w.logger.Error("failed to sync spool segments", "error", err)
+					}
+				}
+			}
+		}()
+	}
+
 	return w, nil
 }
 
-func (w *ParquetWriter) getParquetWriter(datehour string) (*writer.ParquetWriter, error) {
+// syncSpoolSegments syncs the spool segments of all open files to disk.
+func (w *ParquetWriter) syncSpoolSegments() error {
+	w.bufferMutex.Lock()
+	defer w.bufferMutex.Unlock()
+
+	errs := []error{}
+	for _, parquetRef := range w.parquetWriterRefs {
+		if parquetRef.spoolSegment == nil {
+			continue
+		}
+
+		if err := parquetRef.spoolSegment.Sync(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to sync spool segment of %s: %w", parquetRef.key, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (w *ParquetWriter) getParquetWriter(datehour string) (*ParquetRef, error) {
 	if w.parquetWriterRefs[datehour] != nil {
-		return w.parquetWriterRefs[datehour].parquetWriter, nil
+		return w.parquetWriterRefs[datehour], nil
+	}
+
+	var spoolSegment *SpoolSegment
+	if w.spool != nil {
+		var err error
+		if spoolSegment, err = w.spool.Create(); err != nil {
+			return nil, fmt.Errorf("failed to create spool segment: %w", err)
+		}
 	}
 
-	writeFile, err := s3v2.NewS3FileWriterWithClient(w.ctx, w.svc, w.bucketName, w.parquetKey(datehour), nil)
+	localPath := filepath.Join(w.bufferDir, RandStringBytes(32)+".parquet")
+	writeFile, err := local.NewLocalFileWriter(localPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create parquet s3 client: %w", err)
+		if spoolSegment != nil {
+			spoolSegment.Remove()
+		}
+		return nil, fmt.Errorf("failed to create local parquet file: %w", err)
 	}
 
-	parquetWriter, err := writer.NewParquetWriter(writeFile, w.rowType, PARQUET_CONCURRENCY)
+	rowType := w.rowType
+	if w.rowMapper != nil {
+		rowType = w.rowMapper.RowType()
+	}
+
+	parquetWriter, err := w.parquet.NewWriter(writeFile, rowType)
 	if err != nil {
 		writeFile.Close()
+		if spoolSegment != nil {
+			spoolSegment.Remove()
+		}
 		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
 	}
 
-	w.parquetWriterRefs[datehour] = &ParquetRef{
+	w.sequence++
+
+	parquetRef := &ParquetRef{
+		key:              w.parquetKey(datehour, w.sequence),
+		localPath:        localPath,
 		parquetWriteFile: writeFile,
 		parquetWriter:    parquetWriter,
+		spoolSegment:     spoolSegment,
+		partition:        datehour,
+		sequence:         w.sequence,
+		services:         map[string]bool{},
+		openedAt:         time.Now(),
 	}
 
-	return parquetWriter, nil
+	w.parquetWriterRefs[datehour] = parquetRef
+	w.unfinishedRefs[parquetRef] = true
+	w.updateOpenFiles()
+
+	return parquetRef, nil
+}
+
+func (w *ParquetWriter) parquetKey(datehour string, sequence uint64) string {
+	return S3ParquetKey(w.prefix, FileName(w.instanceID, w.startedAt, sequence), datehour)
 }
 
-func (w *ParquetWriter) parquetKey(datehour string) string {
-	return S3ParquetKey(w.prefix, RandStringBytes(32), datehour)
+// updateOpenFiles must be called while holding the bufferMutex.
+func (w *ParquetWriter) updateOpenFiles() {
+	w.openFiles.Set(float64(len(w.parquetWriterRefs)))
 }
 
 func (w *ParquetWriter) closeParquetWriter(parquetRef *ParquetRef) error {
+	started := time.Now()
+	defer func() {
+		w.rotationDuration.Observe(time.Since(started).Seconds())
+	}()
+
+	// The rows are needed until the upload completed, also after a power loss
+	if parquetRef.spoolSegment != nil {
+		if err := parquetRef.spoolSegment.Sync(); err != nil {
+			w.logger.Error("failed to sync spool segment", "key", parquetRef.key, "error", err)
+		}
+	}
+
+	if err := w.uploadParquetFile(parquetRef); err != nil {
+		parquetFilesUploadedTotal.With(w.prefix, metricsResultFailure).Inc()
+
+		// Keep the spool segment, so the rows are replayed on the next start
+		if parquetRef.spoolSegment != nil {
+			parquetRef.spoolSegment.Close()
+		}
+
+		return err
+	}
+	w.finishParquetRef(parquetRef)
+
+	if parquetRef.deadLettered {
+		parquetFilesUploadedTotal.With(w.prefix, metricsResultDeadLetter).Inc()
+	} else {
+		parquetFilesUploadedTotal.With(w.prefix, metricsResultSuccess).Inc()
+		w.uploadedBytes.Add(float64(parquetRef.bytes))
+	}
+
+	// The file is already uploaded, so a missing manifest doesn't fail the rotation.
+	// Dead lettered files never arrived, so they have no manifest.
+	if w.manifestsPrefix != "" && !parquetRef.deadLettered {
+		if err := w.putManifest(w.ctx, parquetRef); err != nil {
+			w.logger.Error("failed to put manifest", "key", parquetRef.key, "error", err)
+		}
+	}
+
+	// Dead lettered files are only committed once they are replayed
+	if w.notifier != nil && !parquetRef.deadLettered {
+		if err := w.notifier.Notify(w.ctx, newFileEvent(w.bucketName, w.newFileManifest(parquetRef))); err != nil {
+			w.logger.Error("failed to notify about parquet file", "key", parquetRef.key, "error", err)
+		}
+	}
+
+	if parquetRef.spoolSegment != nil {
+		if err := parquetRef.spoolSegment.Remove(); err != nil {
+			return fmt.Errorf("failed to remove spool segment: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// finishParquetRef marks the file as uploaded. Files failing to upload stay
+// unfinished, as their rows are only replayed from the spool after a restart.
+func (w *ParquetWriter) finishParquetRef(parquetRef *ParquetRef) {
+	w.bufferMutex.Lock()
+	defer w.bufferMutex.Unlock()
+
+	delete(w.unfinishedRefs, parquetRef)
+}
+
+// UploadedBefore returns the time before which all rows written to this writer
+// have been uploaded or moved to the dead letter queue, i.e. the first write
+// to any unfinished file or now.
+func (w *ParquetWriter) UploadedBefore() time.Time {
+	w.bufferMutex.Lock()
+	defer w.bufferMutex.Unlock()
+
+	uploadedBefore := time.Now()
+	for parquetRef := range w.unfinishedRefs {
+		if parquetRef.openedAt.Before(uploadedBefore) {
+			uploadedBefore = parquetRef.openedAt
+		}
+	}
+
+	return uploadedBefore
+}
+
+func (w *ParquetWriter) uploadParquetFile(parquetRef *ParquetRef) error {
 	if parquetRef.parquetWriter != nil {
 		if err := parquetRef.parquetWriter.WriteStop(); err != nil {
 			return fmt.Errorf("parquet write stop error: %w", err)
@@ -131,6 +456,52 @@ func (w *ParquetWriter) closeParquetWriter(parquetRef *ParquetRef) error {
 		}
 	}
 
+	fileInfo, err := os.Stat(parquetRef.localPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat parquet file: %w", err)
+	}
+	parquetRef.bytes = fileInfo.Size()
+
+	deadLettered, err := w.uploader.UploadOrDeadLetter(w.ctx, parquetRef.key, parquetRef.localPath, w.newFileManifest(parquetRef))
+	if err != nil {
+		return fmt.Errorf("parquet file upload error: %w", err)
+	}
+	parquetRef.deadLettered = deadLettered
+
+	return nil
+}
+
+// prepareBufferDirectory creates the directory for local parquet files. Files
+// left behind by a previous process are incomplete, so they are removed, their
+// rows are recovered from the spool. Files in failedUploadsDirectory are kept.
+func (w *ParquetWriter) prepareBufferDirectory(dir string) error {
+	if dir == "" {
+		tempDir, err := os.MkdirTemp("", "jaeger-s3-")
+		if err != nil {
+			return err
+		}
+		w.bufferDir = tempDir
+		w.bufferDirTemporary = true
+
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	w.bufferDir = dir
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if err != nil {
+		return err
+	}
+
+	for _, leftover := range leftovers {
+		if err := os.Remove(leftover); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -145,49 +516,250 @@ func (w *ParquetWriter) rotateParquetWriters() error {
 	writerRefs := w.parquetWriterRefs
 	w.parquetWriterRefs = map[string]*ParquetRef{}
 	w.bufferMaxUntil = nil
+	w.updateOpenFiles()
 
 	w.bufferMutex.Unlock()
 
 	return w.closeParquetWriters(writerRefs)
 }
 
+// closeParquetWriters closes all given writers in parallel, a failing writer
+// doesn't prevent the others from being closed.
 func (w *ParquetWriter) closeParquetWriters(parquetWriterRefs map[string]*ParquetRef) error {
+	errs := []error{}
+	errsMutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
 	for _, writerRef := range parquetWriterRefs {
-		if err := w.closeParquetWriter(writerRef); err != nil {
-			return fmt.Errorf("failed to close previous parquet writer: %w", err)
-		}
+		wg.Add(1)
+		go func(writerRef *ParquetRef) {
+			defer wg.Done()
+
+			if err := w.closeParquetWriter(writerRef); err != nil {
+				w.logger.Error("failed to flush parquet file", "key", writerRef.key, "rows", writerRef.rows, "error", err)
+
+				errsMutex.Lock()
+				errs = append(errs, fmt.Errorf("failed to close parquet file %s: %w", writerRef.key, err))
+				errsMutex.Unlock()
+				return
+			}
+
+			w.logger.Debug("flushed parquet file", "key", writerRef.key, "rows", writerRef.rows)
+		}(writerRef)
 	}
 
-	return nil
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
 func (w *ParquetWriter) Write(ctx context.Context, time time.Time, maxBufferUntil time.Time, row interface{}) error {
 	w.bufferMutex.Lock()
 	defer w.bufferMutex.Unlock()
 
+	if w.stopping {
+		return ErrParquetWriterStopped
+	}
+
+	return w.writeRow(time, maxBufferUntil, row)
+}
+
+// WriteRows writes a batch of rows, only acquiring the buffer lock once
+func (w *ParquetWriter) WriteRows(ctx context.Context, rows []ParquetRow) error {
+	w.bufferMutex.Lock()
+	defer w.bufferMutex.Unlock()
+
+	if w.stopping {
+		return ErrParquetWriterStopped
+	}
+
+	for _, row := range rows {
+		if err := w.writeRow(row.Time, row.MaxBufferUntil, row.Row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeRow must be called while holding the bufferMutex.
+func (w *ParquetWriter) writeRow(time time.Time, maxBufferUntil time.Time, row interface{}) error {
 	if w.bufferMaxUntil == nil || w.bufferMaxUntil.After(maxBufferUntil) {
 		w.bufferMaxUntil = &maxBufferUntil
 	}
 
-	spanDatehour := S3PartitionKey(time)
+	serviceName := ""
+	if serviceRow, ok := row.(ServiceRow); ok {
+		serviceName = serviceRow.GetServiceName()
+	}
+
+	spanDatehour := w.partitions.Key(time, serviceName)
 
-	parquetWriter, err := w.getParquetWriter(spanDatehour)
+	parquetRef, err := w.getParquetWriter(spanDatehour)
 	if err != nil {
 		return fmt.Errorf("failed to get parquet writer: %w", err)
 	}
 
-	if err := parquetWriter.Write(row); err != nil {
+	if parquetRef.spoolSegment != nil {
+		if err := parquetRef.spoolSegment.Append(time, row); err != nil {
+			return fmt.Errorf("failed to spool row: %w", err)
+		}
+
+		if w.spoolSync == 0 {
+			if err := parquetRef.spoolSegment.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The spool keeps the original row, so it is mapped again on replay
+	parquetRow := row
+	if w.rowMapper != nil {
+		if parquetRow, err = w.rowMapper.MapRow(row); err != nil {
+			return fmt.Errorf("failed to map row: %w", err)
+		}
+	}
+
+	if err := parquetRef.parquetWriter.Write(parquetRow); err != nil {
 		return fmt.Errorf("failed to write row: %w", err)
 	}
+	parquetRef.rows++
+	w.rowsWritten.Inc()
+
+	if parquetRef.minTime.IsZero() || time.Before(parquetRef.minTime) {
+		parquetRef.minTime = time
+	}
+	if time.After(parquetRef.maxTime) {
+		parquetRef.maxTime = time
+	}
+	if serviceName != "" {
+		parquetRef.services[serviceName] = true
+	}
+
+	if w.exceedsLimits(parquetRef) {
+		w.rotateParquetWriter(spanDatehour, parquetRef)
+	}
+
 	return nil
 }
 
+func (w *ParquetWriter) exceedsLimits(parquetRef *ParquetRef) bool {
+	if w.maxRows > 0 && parquetRef.rows >= w.maxRows {
+		return true
+	}
+
+	return w.maxBytes > 0 && parquetRef.Size() >= w.maxBytes
+}
+
+// rotateParquetWriter detaches a single partition's file and closes it in the
+// background, so the next write to this partition starts a new file.
+// Must be called while holding the bufferMutex.
+func (w *ParquetWriter) rotateParquetWriter(datehour string, parquetRef *ParquetRef) {
+	delete(w.parquetWriterRefs, datehour)
+	w.updateOpenFiles()
+
+	w.closeWaitGroup.Add(1)
+	go func() {
+		defer w.closeWaitGroup.Done()
+
+		if err := w.closeParquetWriter(parquetRef); err != nil {
+			w.logger.Error("failed to rotate parquet writer", "error", err)
+		}
+	}()
+}
+
+// replaySpool writes the rows of segments left behind by a previous process
+// and uploads them right away.
+func (w *ParquetWriter) replaySpool() error {
+	segments, err := w.spool.Segments()
+	if err != nil {
+		return fmt.Errorf("failed to list spool segments: %w", err)
+	}
+
+	if len(segments) == 0 {
+		return nil
+	}
+
+	rows := 0
+	for _, segment := range segments {
+		if err := w.spool.ReadSegment(segment, func(rowTime time.Time, row interface{}) error {
+			rows++
+			return w.Write(w.ctx, rowTime, time.Now(), row)
+		}); err != nil {
+			return fmt.Errorf("failed to read spool segment %s: %w", segment, err)
+		}
+
+		// The rows are now part of new segments, which need to be on disk
+		// before the replayed segment is removed
+		if err := w.syncSpoolSegments(); err != nil {
+			return err
+		}
+
+		if err := os.Remove(segment); err != nil {
+			return fmt.Errorf("failed to remove spool segment: %w", err)
+		}
+	}
+
+	w.logger.Info("replayed spool", "segments", len(segments), "rows", rows)
+
+	w.bufferMutex.Lock()
+	writerRefs := w.parquetWriterRefs
+	w.parquetWriterRefs = map[string]*ParquetRef{}
+	w.bufferMaxUntil = nil
+	w.updateOpenFiles()
+	w.bufferMutex.Unlock()
+
+	return w.closeParquetWriters(writerRefs)
+}
+
 func (w *ParquetWriter) Close() error {
-	w.ticker.Stop()
-	w.done <- true
+	return w.Shutdown(context.Background())
+}
 
+// Shutdown rejects further writes, stops the rotation and uploads all open files
+// in parallel. Once ctx is done, running uploads are aborted, their files are
+// kept locally and their rows in the spool if enabled. The returned error
+// contains the key of every file which failed.
+func (w *ParquetWriter) Shutdown(ctx context.Context) error {
 	w.bufferMutex.Lock()
-	defer w.bufferMutex.Unlock()
+	w.stopping = true
+	writerRefs := w.parquetWriterRefs
+	w.parquetWriterRefs = map[string]*ParquetRef{}
+	w.updateOpenFiles()
+	w.bufferMutex.Unlock()
+
+	w.stopOnce.Do(func() {
+		w.ticker.Stop()
+		close(w.done)
+	})
+
+	shutdownDone := make(chan struct{})
+	defer close(shutdownDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.cancelUploads()
+		case <-shutdownDone:
+		}
+	}()
+
+	w.closeWaitGroup.Wait()
+
+	err := w.closeParquetWriters(writerRefs)
+	w.logger.Info("flushed parquet files on shutdown", "prefix", w.prefix, "files", len(writerRefs), "error", err)
+
+	if w.bufferDirTemporary {
+		// The temporary directory still contains the aborted and failed files
+		_, failedErr := os.Stat(filepath.Join(w.bufferDir, failedUploadsDirectory))
+		if err != nil || failedErr == nil {
+			w.logger.Warn("keeping buffer directory with files which weren't uploaded", "path", w.bufferDir)
+			return err
+		}
+
+		if removeErr := os.RemoveAll(w.bufferDir); removeErr != nil {
+			return removeErr
+		}
+	}
 
-	return w.closeParquetWriters(w.parquetWriterRefs)
+	return err
 }
@@ -2,7 +2,10 @@ package s3spanstore
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -14,6 +17,12 @@ import (
 )
 
 func NewTestParquetWriter(ctx context.Context, assert *assert.Assertions, mockSvc *mocks.MockS3API) *ParquetWriter {
+	return NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Millisecond * 200,
+	})
+}
+
+func NewTestParquetWriterWithOptions(ctx context.Context, assert *assert.Assertions, mockSvc *mocks.MockS3API, opts ParquetWriterOptions) *ParquetWriter {
 	loggerName := "jaeger-s3"
 
 	logLevel := os.Getenv("GRPC_STORAGE_PLUGIN_LOG_LEVEL")
@@ -27,7 +36,7 @@ func NewTestParquetWriter(ctx context.Context, assert *assert.Assertions, mockSv
 		JSONFormat: true,
 	})
 
-	writer, err := NewParquetWriter(ctx, logger, mockSvc, time.Millisecond*200, "jaeger-spans", "/spans/", new(SpanRecord))
+	writer, err := NewParquetWriter(ctx, logger, mockSvc, opts, "jaeger-spans", "/spans/", new(SpanRecord))
 
 	assert.NoError(err)
 
@@ -49,7 +58,7 @@ func TestWriteSpanAndRotate(t *testing.T) {
 
 	span := NewTestSpan(assert)
 
-	spanRecord, err := NewSpanRecordFromSpan(span)
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
 	assert.NoError(err)
 
 	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
@@ -76,7 +85,7 @@ func TestWriteSpanWithLargeBufferUntilAndRotate(t *testing.T) {
 
 	span := NewTestSpan(assert)
 
-	spanRecord, err := NewSpanRecordFromSpan(span)
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
 	assert.NoError(err)
 
 	assert.NoError(writer.Write(ctx, span.StartTime, time.Now().Add(time.Millisecond*500), spanRecord))
@@ -87,3 +96,254 @@ func TestWriteSpanWithLargeBufferUntilAndRotate(t *testing.T) {
 
 	assert.NoError(writer.Close())
 }
+
+func TestWriteSpanAndRotateOnMaxRows(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.PutObjectOutput{}, nil).Times(2)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		MaxRows:        2,
+	})
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	rowsWritten := parquetRowsWrittenTotal.With("/spans/").Value()
+	filesUploaded := parquetFilesUploadedTotal.With("/spans/", metricsResultSuccess).Value()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(writer.Write(ctx, span.StartTime, time.Now().Add(time.Hour), spanRecord))
+	}
+
+	// The first file was rotated, the second one is still open
+	assert.Equal(float64(1), parquetOpenFiles.With("/spans/").Value())
+
+	assert.NoError(writer.Close())
+
+	assert.Equal(rowsWritten+3, parquetRowsWrittenTotal.With("/spans/").Value())
+	assert.Equal(filesUploaded+2, parquetFilesUploadedTotal.With("/spans/", metricsResultSuccess).Value())
+	assert.Equal(float64(0), parquetOpenFiles.With("/spans/").Value())
+}
+
+func TestWriteSpanAndRotateOnMaxBytes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.PutObjectOutput{}, nil).Times(2)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		MaxBytes:       1,
+	})
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, time.Now().Add(time.Hour), spanRecord))
+	assert.NoError(writer.Write(ctx, span.StartTime, time.Now().Add(time.Hour), spanRecord))
+
+	assert.NoError(writer.Close())
+}
+
+func TestParquetWriterShutdownAbortsUploadsAfterDeadline(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}).Times(1)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		RetryOptions:   RetryOptions{MaxAttempts: 1},
+	})
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, time.Now(), spanRecord))
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer cancel()
+
+	started := time.Now()
+	err = writer.Shutdown(shutdownCtx)
+	assert.Error(err)
+	assert.Contains(err.Error(), "/spans/2017/01/26/16/")
+	assert.Less(time.Since(started), time.Second*5)
+
+	// The aborted file is kept in the temporary buffer directory
+	files, err := filepath.Glob(filepath.Join(writer.bufferDir, "*.parquet"))
+	assert.NoError(err)
+	assert.Len(files, 1)
+	assert.NoError(os.RemoveAll(writer.bufferDir))
+}
+
+func TestParquetWriterRejectsWritesAfterShutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil).Times(1)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	// Every row rotates the file in the background
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		MaxRows:        1,
+	})
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, time.Now(), spanRecord))
+	assert.NoError(writer.Shutdown(ctx))
+
+	assert.ErrorIs(writer.Write(ctx, span.StartTime, time.Now(), spanRecord), ErrParquetWriterStopped)
+	assert.ErrorIs(writer.WriteRows(ctx, []ParquetRow{{Time: span.StartTime, MaxBufferUntil: time.Now(), Row: spanRecord}}), ErrParquetWriterStopped)
+	assert.NoError(writer.Close())
+}
+
+func TestParquetWriterUploadedBefore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil).Times(1)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+	})
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	beforeWrite := time.Now()
+	assert.NoError(writer.Write(ctx, span.StartTime, time.Now(), spanRecord))
+	afterWrite := time.Now()
+
+	// The buffered row holds the time back until its file is uploaded
+	assert.False(writer.UploadedBefore().After(afterWrite))
+	assert.False(writer.UploadedBefore().Before(beforeWrite))
+
+	assert.NoError(writer.Close())
+	assert.True(writer.UploadedBefore().After(afterWrite))
+}
+
+func TestParquetWriterWritesManifests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var fileKey string
+	var manifestKey string
+	manifest := FileManifest{}
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			fileKey = *input.Key
+			return &s3.PutObjectOutput{}, nil
+		}).Times(1)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			manifestKey = *input.Key
+			return &s3.PutObjectOutput{}, json.NewDecoder(input.Body).Decode(&manifest)
+		}).Times(1)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration:  time.Hour,
+		InstanceID:      "collector 1",
+		ManifestsPrefix: "manifests/",
+	})
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, time.Now(), spanRecord))
+	assert.NoError(writer.Write(ctx, span.StartTime.Add(time.Second), time.Now(), spanRecord))
+
+	assert.NoError(writer.Close())
+
+	assert.Regexp(`^/spans/2017/01/26/16/collector-1-\d{8}T\d{6}Z-000001\.parquet$`, fileKey)
+	assert.Equal(ManifestKey("manifests/", fileKey), manifestKey)
+	assert.Regexp(`^manifests/spans/2017/01/26/16/collector-1-\d{8}T\d{6}Z-000001\.json$`, manifestKey)
+
+	assert.Equal(fileKey, manifest.Key)
+	assert.Equal("collector-1", manifest.InstanceID)
+	assert.Equal(uint64(1), manifest.Sequence)
+	assert.Equal(int64(2), manifest.Rows)
+	assert.Greater(manifest.Bytes, int64(0))
+	assert.True(span.StartTime.Equal(manifest.MinStartTime))
+	assert.True(span.StartTime.Add(time.Second).Equal(manifest.MaxStartTime))
+	assert.Equal([]string{"example-service-1"}, manifest.Services)
+}
+
+func TestParquetWriterSkipsManifestOfDeadLetteredFiles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Only the failing upload, no manifest is put
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, errors.New("upload failed")).Times(1)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	deadLetterQueue, err := NewLocalDeadLetterQueue(t.TempDir())
+	assert.NoError(err)
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration:  time.Hour,
+		RetryOptions:    RetryOptions{MaxAttempts: 1},
+		DeadLetterQueue: deadLetterQueue,
+		ManifestsPrefix: "manifests/",
+	})
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, time.Now(), spanRecord))
+	assert.NoError(writer.Close())
+}
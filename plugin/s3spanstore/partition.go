@@ -0,0 +1,371 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+type PartitionGranularity string
+
+const (
+	PartitionGranularityDay         PartitionGranularity = "day"
+	PartitionGranularityHour        PartitionGranularity = "hour"
+	PartitionGranularityQuarterHour PartitionGranularity = "15m"
+)
+
+type PartitionLayout string
+
+const (
+	// PartitionLayoutPath stores files under a single datehour path, e.g. 2021/01/30/06
+	PartitionLayoutPath PartitionLayout = "path"
+	// PartitionLayoutHive stores files under Hive-style paths, e.g. dt=2021-01-30/hour=06
+	PartitionLayoutHive PartitionLayout = "hive"
+)
+
+type ServicePartitioning string
+
+const (
+	// ServicePartitioningNone only partitions by time
+	ServicePartitioningNone ServicePartitioning = "none"
+	// ServicePartitioningName adds a partition per service name below the time partition
+	ServicePartitioningName ServicePartitioning = "name"
+	// ServicePartitioningBucket adds a partition per hash bucket of the service name below the time partition
+	ServicePartitioningBucket ServicePartitioning = "bucket"
+)
+
+const defaultServicePartitionBuckets = 16
+
+var invalidServicePartitionChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// PartitionScheme defines how span time and service are mapped to S3 key prefixes
+// and the matching Athena partition columns. The zero value is hourly with the
+// path layout and without service partitioning.
+type PartitionScheme struct {
+	Granularity         PartitionGranularity
+	Layout              PartitionLayout
+	ServicePartitioning ServicePartitioning
+	ServiceBuckets      int
+}
+
+var DefaultPartitionScheme = PartitionScheme{
+	Granularity:         PartitionGranularityHour,
+	Layout:              PartitionLayoutPath,
+	ServicePartitioning: ServicePartitioningNone,
+}
+
+// PartitionColumn is a single Athena partition column and how it is projected.
+type PartitionColumn struct {
+	Name string
+	// format is the go time format of the column value
+	format string
+	// ProjectionParameters are the Glue partition projection parameters without the "projection.<name>." prefix
+	ProjectionParameters map[string]string
+}
+
+func NewPartitionScheme(s3Config config.S3) (PartitionScheme, error) {
+	scheme := DefaultPartitionScheme
+
+	switch granularity := PartitionGranularity(s3Config.PartitionGranularity); granularity {
+	case "":
+	case PartitionGranularityDay, PartitionGranularityHour, PartitionGranularityQuarterHour:
+		scheme.Granularity = granularity
+	default:
+		return scheme, fmt.Errorf("unknown partition granularity %q", granularity)
+	}
+
+	switch layout := PartitionLayout(s3Config.PartitionLayout); layout {
+	case "":
+	case PartitionLayoutPath, PartitionLayoutHive:
+		scheme.Layout = layout
+	default:
+		return scheme, fmt.Errorf("unknown partition layout %q", layout)
+	}
+
+	switch servicePartitioning := ServicePartitioning(s3Config.ServicePartitioning); servicePartitioning {
+	case "":
+	case ServicePartitioningNone, ServicePartitioningName, ServicePartitioningBucket:
+		scheme.ServicePartitioning = servicePartitioning
+	default:
+		return scheme, fmt.Errorf("unknown service partitioning %q", servicePartitioning)
+	}
+
+	if scheme.ServicePartitioning == ServicePartitioningBucket {
+		scheme.ServiceBuckets = defaultServicePartitionBuckets
+		if s3Config.ServicePartitionBuckets > 0 {
+			scheme.ServiceBuckets = s3Config.ServicePartitionBuckets
+		}
+	}
+
+	return scheme, nil
+}
+
+// WithoutServicePartitioning returns a copy of the scheme only partitioning by time.
+func (p PartitionScheme) WithoutServicePartitioning() PartitionScheme {
+	p.ServicePartitioning = ServicePartitioningNone
+	p.ServiceBuckets = 0
+	return p
+}
+
+// Interval is the time span covered by a single partition.
+func (p PartitionScheme) Interval() time.Duration {
+	switch p.Granularity {
+	case PartitionGranularityDay:
+		return time.Hour * 24
+	case PartitionGranularityQuarterHour:
+		return time.Minute * 15
+	default:
+		return time.Hour
+	}
+}
+
+// Truncate returns the start of the partition containing t in UTC.
+func (p PartitionScheme) Truncate(t time.Time) time.Time {
+	return t.UTC().Truncate(p.Interval())
+}
+
+// Columns returns all partition columns, the time columns followed by the optional service column.
+func (p PartitionScheme) Columns() []PartitionColumn {
+	columns := p.timeColumns()
+	if column := p.serviceColumn(); column != nil {
+		columns = append(columns, *column)
+	}
+
+	return columns
+}
+
+func (p PartitionScheme) timeColumns() []PartitionColumn {
+	if p.Layout == PartitionLayoutHive {
+		columns := []PartitionColumn{
+			{Name: "dt", format: "2006-01-02", ProjectionParameters: map[string]string{
+				"type":          "date",
+				"format":        "yyyy-MM-dd",
+				"range":         "2022-01-01,NOW",
+				"interval":      "1",
+				"interval.unit": "DAYS",
+			}},
+		}
+
+		if p.Granularity != PartitionGranularityDay {
+			columns = append(columns, PartitionColumn{Name: "hour", format: "15", ProjectionParameters: map[string]string{
+				"type":   "integer",
+				"range":  "0,23",
+				"digits": "2",
+			}})
+		}
+
+		if p.Granularity == PartitionGranularityQuarterHour {
+			columns = append(columns, PartitionColumn{Name: "minute", format: "04", ProjectionParameters: map[string]string{
+				"type":   "enum",
+				"values": "00,15,30,45",
+			}})
+		}
+
+		return columns
+	}
+
+	switch p.Granularity {
+	case PartitionGranularityDay:
+		return []PartitionColumn{{Name: "datehour", format: "2006/01/02", ProjectionParameters: map[string]string{
+			"type":          "date",
+			"format":        "yyyy/MM/dd",
+			"range":         "2022/01/01,NOW",
+			"interval":      "1",
+			"interval.unit": "DAYS",
+		}}}
+	case PartitionGranularityQuarterHour:
+		return []PartitionColumn{{Name: "datehour", format: "2006/01/02/15/04", ProjectionParameters: map[string]string{
+			"type":          "date",
+			"format":        "yyyy/MM/dd/HH/mm",
+			"range":         "2022/01/01/00/00,NOW",
+			"interval":      "15",
+			"interval.unit": "MINUTES",
+		}}}
+	default:
+		return []PartitionColumn{{Name: "datehour", format: "2006/01/02/15", ProjectionParameters: map[string]string{
+			"type":          "date",
+			"format":        "yyyy/MM/dd/HH",
+			"range":         "2022/01/01/00,NOW",
+			"interval":      "1",
+			"interval.unit": "HOURS",
+		}}}
+	}
+}
+
+func (p PartitionScheme) serviceColumn() *PartitionColumn {
+	switch p.ServicePartitioning {
+	case ServicePartitioningName:
+		// Service names can't be enumerated, so queries have to provide them
+		return &PartitionColumn{Name: "service", ProjectionParameters: map[string]string{
+			"type": "injected",
+		}}
+	case ServicePartitioningBucket:
+		return &PartitionColumn{Name: "service_bucket", ProjectionParameters: map[string]string{
+			"type":   "integer",
+			"range":  fmt.Sprintf("0,%d", p.ServiceBuckets-1),
+			"digits": strconv.Itoa(p.serviceBucketDigits()),
+		}}
+	default:
+		return nil
+	}
+}
+
+func (p PartitionScheme) serviceBucketDigits() int {
+	return len(strconv.Itoa(p.ServiceBuckets - 1))
+}
+
+// ServiceValue returns the service partition value of serviceName.
+func (p PartitionScheme) ServiceValue(serviceName string) string {
+	switch p.ServicePartitioning {
+	case ServicePartitioningName:
+		if serviceName == "" {
+			return "_"
+		}
+		return invalidServicePartitionChars.ReplaceAllString(serviceName, "_")
+	case ServicePartitioningBucket:
+		hash := fnv.New32a()
+		hash.Write([]byte(serviceName))
+		return fmt.Sprintf("%0*d", p.serviceBucketDigits(), hash.Sum32()%uint32(p.ServiceBuckets))
+	default:
+		return ""
+	}
+}
+
+func (p PartitionScheme) values(t time.Time) []string {
+	t = p.Truncate(t)
+
+	columns := p.timeColumns()
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		values[i] = t.Format(column.format)
+	}
+
+	return values
+}
+
+// Key returns the key prefix of the partition containing t and serviceName, without trailing slash.
+func (p PartitionScheme) Key(t time.Time, serviceName string) string {
+	values := p.values(t)
+	columns := p.timeColumns()
+
+	if column := p.serviceColumn(); column != nil {
+		values = append(values, p.ServiceValue(serviceName))
+		columns = append(columns, *column)
+	}
+
+	if p.Layout != PartitionLayoutHive {
+		return strings.Join(values, "/")
+	}
+
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		parts[i] = column.Name + "=" + values[i]
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// TimeKey returns the key prefix of the time partition containing t, without trailing slash.
+// All service partitions of that time are stored below it.
+func (p PartitionScheme) TimeKey(t time.Time) string {
+	return p.WithoutServicePartitioning().Key(t, "")
+}
+
+// Condition returns an Athena condition selecting all time partitions between min and max.
+func (p PartitionScheme) Condition(min time.Time, max time.Time) string {
+	columns := p.timeColumns()
+	minValues := p.values(min)
+	maxValues := p.values(max)
+
+	conditions := []string{
+		fmt.Sprintf(`%s BETWEEN '%s' AND '%s'`, columns[0].Name, minValues[0], maxValues[0]),
+	}
+
+	// Compare the remaining columns as tuple, only relevant at the boundaries of the first column
+	if len(columns) > 1 {
+		conditions = append(conditions,
+			tupleCondition(columns, minValues, ">"),
+			tupleCondition(columns, maxValues, "<"),
+		)
+	}
+
+	return strings.Join(conditions, " AND ")
+}
+
+// ServiceCondition returns an Athena condition selecting the service partition
+// of serviceName, or an empty string without service partitioning.
+func (p PartitionScheme) ServiceCondition(serviceName string) string {
+	return p.ServicesCondition([]string{serviceName})
+}
+
+// ServicesCondition returns an Athena condition selecting the service partitions
+// of all serviceNames, or an empty string without service partitioning.
+func (p PartitionScheme) ServicesCondition(serviceNames []string) string {
+	column := p.serviceColumn()
+	if column == nil {
+		return ""
+	}
+
+	values := []string{}
+	seen := map[string]bool{}
+	for _, serviceName := range serviceNames {
+		value := p.ServiceValue(serviceName)
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		values = append(values, fmt.Sprintf(`'%s'`, value))
+	}
+
+	// Always select at least one partition, as injected columns require a predicate
+	if len(values) == 0 {
+		values = append(values, `''`)
+	}
+
+	if len(values) == 1 {
+		return fmt.Sprintf(`%s = %s`, column.Name, values[0])
+	}
+
+	return fmt.Sprintf(`%s IN (%s)`, column.Name, strings.Join(values, ", "))
+}
+
+func tupleCondition(columns []PartitionColumn, values []string, operator string) string {
+	if len(columns) == 1 {
+		return fmt.Sprintf(`%s %s= '%s'`, columns[0].Name, operator, values[0])
+	}
+
+	return fmt.Sprintf(`(%s %s '%s' OR (%s = '%s' AND %s))`,
+		columns[0].Name, operator, values[0],
+		columns[0].Name, values[0],
+		tupleCondition(columns[1:], values[1:], operator))
+}
+
+// GlueParameters returns the Glue table parameters for partition projection with
+// the storage location template below location.
+func (p PartitionScheme) GlueParameters(location string) map[string]string {
+	parameters := map[string]string{
+		"projection.enabled": "true",
+	}
+
+	templateParts := []string{}
+	for _, column := range p.Columns() {
+		for key, value := range column.ProjectionParameters {
+			parameters[fmt.Sprintf("projection.%s.%s", column.Name, key)] = value
+		}
+
+		if p.Layout == PartitionLayoutHive {
+			templateParts = append(templateParts, fmt.Sprintf("%s=${%s}", column.Name, column.Name))
+		} else {
+			templateParts = append(templateParts, fmt.Sprintf("${%s}", column.Name))
+		}
+	}
+
+	parameters["storage.location.template"] = location + strings.Join(templateParts, "/") + "/"
+
+	return parameters
+}
@@ -0,0 +1,153 @@
+package s3spanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionSchemeKey(t *testing.T) {
+	assert := assert.New(t)
+
+	testTime := time.Date(2021, 1, 30, 6, 34, 58, 123, time.UTC)
+
+	tests := []struct {
+		granularity string
+		layout      string
+		key         string
+	}{
+		{"", "", "2021/01/30/06"},
+		{"day", "path", "2021/01/30"},
+		{"hour", "path", "2021/01/30/06"},
+		{"15m", "path", "2021/01/30/06/30"},
+		{"day", "hive", "dt=2021-01-30"},
+		{"hour", "hive", "dt=2021-01-30/hour=06"},
+		{"15m", "hive", "dt=2021-01-30/hour=06/minute=30"},
+	}
+
+	for _, test := range tests {
+		scheme, err := NewPartitionScheme(config.S3{PartitionGranularity: test.granularity, PartitionLayout: test.layout})
+		assert.NoError(err)
+		assert.Equal(test.key, scheme.Key(testTime, "frontend"), "%s/%s", test.granularity, test.layout)
+	}
+}
+
+func TestPartitionSchemeKeyUsesUTC(t *testing.T) {
+	assert := assert.New(t)
+
+	location := time.FixedZone("UTC+2", 2*60*60)
+	testTime := time.Date(2021, 1, 30, 1, 34, 58, 123, location)
+
+	assert.Equal("2021/01/29/23", DefaultPartitionScheme.Key(testTime, ""))
+}
+
+func TestNewPartitionSchemeInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewPartitionScheme(config.S3{PartitionGranularity: "week"})
+	assert.Error(err)
+
+	_, err = NewPartitionScheme(config.S3{PartitionLayout: "flat"})
+	assert.Error(err)
+
+	_, err = NewPartitionScheme(config.S3{ServicePartitioning: "team"})
+	assert.Error(err)
+}
+
+func TestPartitionSchemeServiceKey(t *testing.T) {
+	assert := assert.New(t)
+
+	testTime := time.Date(2021, 1, 30, 6, 34, 58, 123, time.UTC)
+
+	byName, err := NewPartitionScheme(config.S3{ServicePartitioning: "name"})
+	assert.NoError(err)
+	assert.Equal("2021/01/30/06/frontend", byName.Key(testTime, "frontend"))
+	assert.Equal("2021/01/30/06/my_service_v2", byName.Key(testTime, "my service/v2"))
+	assert.Equal("2021/01/30/06", byName.TimeKey(testTime))
+
+	byNameHive, err := NewPartitionScheme(config.S3{PartitionLayout: "hive", ServicePartitioning: "name"})
+	assert.NoError(err)
+	assert.Equal("dt=2021-01-30/hour=06/service=frontend", byNameHive.Key(testTime, "frontend"))
+
+	byBucket, err := NewPartitionScheme(config.S3{ServicePartitioning: "bucket", ServicePartitionBuckets: 32})
+	assert.NoError(err)
+	assert.Equal(32, byBucket.ServiceBuckets)
+
+	bucket := byBucket.ServiceValue("frontend")
+	assert.Len(bucket, 2)
+	assert.Equal(bucket, byBucket.ServiceValue("frontend"))
+	assert.Equal("2021/01/30/06/"+bucket, byBucket.Key(testTime, "frontend"))
+}
+
+func TestPartitionSchemeServiceCondition(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", DefaultPartitionScheme.ServiceCondition("frontend"))
+
+	byName := PartitionScheme{ServicePartitioning: ServicePartitioningName}
+	assert.Equal(`service = 'frontend'`, byName.ServiceCondition("frontend"))
+	assert.Equal(`service IN ('frontend', 'backend')`, byName.ServicesCondition([]string{"frontend", "backend", "frontend"}))
+	assert.Equal(`service = ''`, byName.ServicesCondition([]string{}))
+
+	byBucket := PartitionScheme{ServicePartitioning: ServicePartitioningBucket, ServiceBuckets: 4}
+	assert.Equal(`service_bucket = '`+byBucket.ServiceValue("frontend")+`'`, byBucket.ServiceCondition("frontend"))
+}
+
+func TestPartitionSchemeCondition(t *testing.T) {
+	assert := assert.New(t)
+
+	minTime := time.Date(2021, 1, 30, 6, 34, 58, 123, time.UTC)
+	maxTime := time.Date(2021, 1, 31, 18, 4, 58, 123, time.UTC)
+
+	assert.Equal(`datehour BETWEEN '2021/01/30/06' AND '2021/01/31/18'`, DefaultPartitionScheme.Condition(minTime, maxTime))
+
+	hourlyHive := PartitionScheme{Granularity: PartitionGranularityHour, Layout: PartitionLayoutHive}
+	assert.Equal(`dt BETWEEN '2021-01-30' AND '2021-01-31' AND (dt > '2021-01-30' OR (dt = '2021-01-30' AND hour >= '06')) AND (dt < '2021-01-31' OR (dt = '2021-01-31' AND hour <= '18'))`, hourlyHive.Condition(minTime, maxTime))
+
+	dailyHive := PartitionScheme{Granularity: PartitionGranularityDay, Layout: PartitionLayoutHive}
+	assert.Equal(`dt BETWEEN '2021-01-30' AND '2021-01-31'`, dailyHive.Condition(minTime, maxTime))
+}
+
+func TestPartitionSchemeGlueParameters(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(map[string]string{
+		"projection.enabled":                "true",
+		"projection.datehour.type":          "date",
+		"projection.datehour.format":        "yyyy/MM/dd/HH",
+		"projection.datehour.range":         "2022/01/01/00,NOW",
+		"projection.datehour.interval":      "1",
+		"projection.datehour.interval.unit": "HOURS",
+		"storage.location.template":         "s3://bucket/spans/${datehour}/",
+	}, DefaultPartitionScheme.GlueParameters("s3://bucket/spans/"))
+
+	hourlyHive := PartitionScheme{Granularity: PartitionGranularityHour, Layout: PartitionLayoutHive}
+	assert.Equal(map[string]string{
+		"projection.enabled":          "true",
+		"projection.dt.type":          "date",
+		"projection.dt.format":        "yyyy-MM-dd",
+		"projection.dt.range":         "2022-01-01,NOW",
+		"projection.dt.interval":      "1",
+		"projection.dt.interval.unit": "DAYS",
+		"projection.hour.type":        "integer",
+		"projection.hour.range":       "0,23",
+		"projection.hour.digits":      "2",
+		"storage.location.template":   "s3://bucket/spans/dt=${dt}/hour=${hour}/",
+	}, hourlyHive.GlueParameters("s3://bucket/spans/"))
+
+	byBucket := PartitionScheme{Granularity: PartitionGranularityDay, Layout: PartitionLayoutPath, ServicePartitioning: ServicePartitioningBucket, ServiceBuckets: 16}
+	assert.Equal(map[string]string{
+		"projection.enabled":                "true",
+		"projection.datehour.type":          "date",
+		"projection.datehour.format":        "yyyy/MM/dd",
+		"projection.datehour.range":         "2022/01/01,NOW",
+		"projection.datehour.interval":      "1",
+		"projection.datehour.interval.unit": "DAYS",
+		"projection.service_bucket.type":    "integer",
+		"projection.service_bucket.range":   "0,15",
+		"projection.service_bucket.digits":  "2",
+		"storage.location.template":         "s3://bucket/spans/${datehour}/${service_bucket}/",
+	}, byBucket.GlueParameters("s3://bucket/spans/"))
+}
@@ -0,0 +1,175 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// PayloadCodecSnappyProto is the snappy compressed Jaeger protobuf span
+	PayloadCodecSnappyProto = "snappy-proto"
+	// PayloadCodecZstdProto is the zstd compressed Jaeger protobuf span
+	PayloadCodecZstdProto = "zstd-proto"
+	// PayloadCodecOTLPProto is an OTLP TracesData protobuf containing the span and its resource
+	PayloadCodecOTLPProto = "otlp-proto"
+	// PayloadCodecJaegerJSON is the Jaeger JSON span as stored by the Elasticsearch backend
+	PayloadCodecJaegerJSON = "jaeger-json"
+)
+
+// SpanPayloadCodec encodes the full span stored with every span row.
+type SpanPayloadCodec interface {
+	// Name is recorded with every row, so the payload can be decoded later on
+	Name() string
+	Encode(span *model.Span) ([]byte, error)
+	Decode(payload []byte) (*model.Span, error)
+}
+
+var payloadCodecs = map[string]SpanPayloadCodec{}
+
+func init() {
+	for _, codec := range []SpanPayloadCodec{
+		&snappyProtoCodec{},
+		newZstdProtoCodec(),
+		&otlpProtoCodec{},
+		&jaegerJSONCodec{},
+	} {
+		payloadCodecs[codec.Name()] = codec
+	}
+}
+
+// NewSpanPayloadCodec returns the codec with the given name, defaults to snappy-proto.
+func NewSpanPayloadCodec(name string) (SpanPayloadCodec, error) {
+	if name == "" {
+		name = PayloadCodecSnappyProto
+	}
+
+	codec, ok := payloadCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown payload codec %q", name)
+	}
+
+	return codec, nil
+}
+
+type snappyProtoCodec struct{}
+
+func (c *snappyProtoCodec) Name() string {
+	return PayloadCodecSnappyProto
+}
+
+func (c *snappyProtoCodec) Encode(span *model.Span) ([]byte, error) {
+	spanBytes, err := proto.Marshal(span)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize item: %w", err)
+	}
+
+	var b bytes.Buffer
+	sn := snappy.NewBufferedWriter(&b)
+
+	_, err = sn.Write(spanBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write compress span: %w", err)
+	}
+
+	if err = sn.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close compress span: %w", err)
+	}
+
+	return b.Bytes(), nil
+}
+
+func (c *snappyProtoCodec) Decode(payload []byte) (*model.Span, error) {
+	r := snappy.NewReader(bytes.NewReader(payload))
+
+	var resB bytes.Buffer
+	_, err := resB.ReadFrom(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %w", err)
+	}
+
+	span := &model.Span{}
+	if err := proto.Unmarshal(resB.Bytes(), span); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal span: %w", err)
+	}
+	return span, nil
+}
+
+type zstdProtoCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdProtoCodec() *zstdProtoCodec {
+	// Creating the encoder and decoder without options can't fail.
+	// EncodeAll and DecodeAll are safe for concurrent use.
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil)
+
+	return &zstdProtoCodec{
+		encoder: encoder,
+		decoder: decoder,
+	}
+}
+
+func (c *zstdProtoCodec) Name() string {
+	return PayloadCodecZstdProto
+}
+
+func (c *zstdProtoCodec) Encode(span *model.Span) ([]byte, error) {
+	spanBytes, err := proto.Marshal(span)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize item: %w", err)
+	}
+
+	return c.encoder.EncodeAll(spanBytes, nil), nil
+}
+
+func (c *zstdProtoCodec) Decode(payload []byte) (*model.Span, error) {
+	spanBytes, err := c.decoder.DecodeAll(payload, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %w", err)
+	}
+
+	span := &model.Span{}
+	if err := proto.Unmarshal(spanBytes, span); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal span: %w", err)
+	}
+	return span, nil
+}
+
+type jaegerJSONCodec struct{}
+
+func (c *jaegerJSONCodec) Name() string {
+	return PayloadCodecJaegerJSON
+}
+
+func (c *jaegerJSONCodec) Encode(span *model.Span) ([]byte, error) {
+	dbSpan := dbmodel.NewFromDomain(false, nil, ".").FromDomainEmbedProcess(span)
+
+	spanBytes, err := json.Marshal(dbSpan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize item: %w", err)
+	}
+
+	return spanBytes, nil
+}
+
+func (c *jaegerJSONCodec) Decode(payload []byte) (*model.Span, error) {
+	dbSpan := &dbmodel.Span{}
+	if err := json.Unmarshal(payload, dbSpan); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal span: %w", err)
+	}
+
+	span, err := dbmodel.NewToDomain(".").SpanToDomain(dbSpan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert span: %w", err)
+	}
+	return span, nil
+}
@@ -0,0 +1,159 @@
+package s3spanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func NewTestCodecSpan() *model.Span {
+	traceID := model.NewTraceID(1, 17)
+	startTime := time.Date(2017, 1, 26, 16, 46, 31, 639875000, time.UTC)
+
+	return &model.Span{
+		TraceID:       traceID,
+		SpanID:        model.NewSpanID(3),
+		OperationName: "example-operation-1",
+		References: []model.SpanRef{
+			model.NewChildOfRef(traceID, model.NewSpanID(2)),
+			model.NewFollowsFromRef(model.NewTraceID(0, 5), model.NewSpanID(6)),
+		},
+		Flags:     model.Flags(1),
+		StartTime: startTime,
+		Duration:  time.Millisecond * 100,
+		Tags: []model.KeyValue{
+			model.String("http.method", "GET"),
+			model.Bool("error", true),
+			model.Int64("http.status_code", 500),
+			model.Float64("sampler.param", 1.5),
+			model.Binary("payload", []byte{1, 2, 3}),
+			model.String("span.kind", "server"),
+		},
+		Logs: []model.Log{
+			{
+				Timestamp: startTime.Add(time.Millisecond),
+				Fields: []model.KeyValue{
+					model.String("event", "error"),
+					model.String("message", "failed"),
+				},
+			},
+		},
+		Process: &model.Process{
+			ServiceName: "example-service-1",
+			Tags: []model.KeyValue{
+				model.String("hostname", "localhost"),
+			},
+		},
+	}
+}
+
+func TestSpanPayloadCodecsRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestCodecSpan()
+	expected, err := EncodeSpanPayload(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	for _, name := range []string{PayloadCodecSnappyProto, PayloadCodecZstdProto, PayloadCodecOTLPProto, PayloadCodecJaegerJSON} {
+		codec, err := NewSpanPayloadCodec(name)
+		assert.NoError(err)
+		assert.Equal(name, codec.Name())
+
+		payload, err := EncodeSpanPayload(span, codec)
+		assert.NoError(err, name)
+
+		decoded, err := DecodeSpanPayload(name, payload)
+		assert.NoError(err, name)
+
+		// Compare the canonical protobuf encoding, to ignore time zones and empty slices
+		actual, err := EncodeSpanPayload(decoded, &snappyProtoCodec{})
+		assert.NoError(err, name)
+		assert.Equal(expected, actual, name)
+	}
+}
+
+func TestOTLPProtoCodecRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestCodecSpan()
+	span.Flags = model.Flags(3)
+	span.Warnings = []string{"clock skew adjustment disabled", "tag value truncated"}
+	span.References = append(span.References,
+		model.NewChildOfRef(span.TraceID, model.NewSpanID(7)),
+		model.NewFollowsFromRef(span.TraceID, model.NewSpanID(8)),
+	)
+
+	codec := &otlpProtoCodec{}
+	payload, err := codec.Encode(span)
+	assert.NoError(err)
+
+	// The OTLP span flags are reserved for W3C trace flags
+	spanFields := map[protowire.Number]bool{}
+	assert.NoError(consumeOTLPFields(payload, func(num protowire.Number, value []byte) error {
+		return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+			if num != otlpResourceSpansScopeSpans {
+				return nil
+			}
+			return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+				if num != otlpScopeSpansSpans {
+					return nil
+				}
+				return consumeOTLPFields(otlpBytes(value), func(num protowire.Number, value []byte) error {
+					spanFields[num] = true
+					return nil
+				})
+			})
+		})
+	}))
+	assert.True(spanFields[otlpSpanLinks])
+	assert.False(spanFields[otlpSpanFlags])
+
+	decoded, err := codec.Decode(payload)
+	assert.NoError(err)
+
+	assert.Equal(span.Flags, decoded.Flags)
+	assert.Equal(span.Warnings, decoded.Warnings)
+	assert.Equal(span.References, decoded.References)
+	for _, tag := range decoded.Tags {
+		assert.NotContains([]string{otlpJaegerFlagsAttribute, otlpJaegerWarningsAttribute}, tag.Key)
+	}
+}
+
+func TestOTLPProtoCodecDecodesLegacyFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	// Earlier versions stored the Jaeger flags in the OTLP span flags
+	var span []byte
+	span = protowire.AppendTag(span, otlpSpanTraceID, protowire.BytesType)
+	span = protowire.AppendBytes(span, make([]byte, 16))
+	span = protowire.AppendTag(span, otlpSpanFlags, protowire.Fixed32Type)
+	span = protowire.AppendFixed32(span, 1)
+
+	var scopeSpans []byte
+	scopeSpans = protowire.AppendTag(scopeSpans, otlpScopeSpansSpans, protowire.BytesType)
+	scopeSpans = protowire.AppendBytes(scopeSpans, span)
+	var resourceSpans []byte
+	resourceSpans = protowire.AppendTag(resourceSpans, otlpResourceSpansScopeSpans, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, scopeSpans)
+	var payload []byte
+	payload = protowire.AppendTag(payload, otlpTracesDataResourceSpans, protowire.BytesType)
+	payload = protowire.AppendBytes(payload, resourceSpans)
+
+	decoded, err := (&otlpProtoCodec{}).Decode(payload)
+	assert.NoError(err)
+	assert.Equal(model.Flags(1), decoded.Flags)
+}
+
+func TestNewSpanPayloadCodec(t *testing.T) {
+	assert := assert.New(t)
+
+	codec, err := NewSpanPayloadCodec("")
+	assert.NoError(err)
+	assert.Equal(PayloadCodecSnappyProto, codec.Name())
+
+	_, err = NewSpanPayloadCodec("gzip-proto")
+	assert.Error(err)
+}
@@ -0,0 +1,247 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+const (
+	PromotedTagTypeString = "string"
+	PromotedTagTypeInt64  = "int64"
+	PromotedTagTypeDouble = "double"
+	PromotedTagTypeBool   = "bool"
+)
+
+var invalidColumnChars = regexp.MustCompile(`[^a-z0-9_]`)
+
+// PromotedTag is a tag key additionally written into its own typed column.
+type PromotedTag struct {
+	Key    string
+	Column string
+	Type   string
+}
+
+// AthenaType returns the Athena column type of the tag column.
+func (t PromotedTag) AthenaType() string {
+	switch t.Type {
+	case PromotedTagTypeInt64:
+		return "bigint"
+	case PromotedTagTypeDouble:
+		return "double"
+	case PromotedTagTypeBool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+func (t PromotedTag) parquetTag() string {
+	switch t.Type {
+	case PromotedTagTypeInt64:
+		return fmt.Sprintf("name=%s, type=INT64, repetitiontype=OPTIONAL", t.Column)
+	case PromotedTagTypeDouble:
+		return fmt.Sprintf("name=%s, type=DOUBLE, repetitiontype=OPTIONAL", t.Column)
+	case PromotedTagTypeBool:
+		return fmt.Sprintf("name=%s, type=BOOLEAN, repetitiontype=OPTIONAL", t.Column)
+	default:
+		return fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL", t.Column)
+	}
+}
+
+// parse converts a tag value into a pointer of the column type, ok is false if
+// the value doesn't match the type.
+func (t PromotedTag) parse(value string) (interface{}, bool) {
+	switch t.Type {
+	case PromotedTagTypeInt64:
+		v, err := strconv.ParseInt(value, 10, 64)
+		return &v, err == nil
+	case PromotedTagTypeDouble:
+		v, err := strconv.ParseFloat(value, 64)
+		return &v, err == nil
+	case PromotedTagTypeBool:
+		v, err := strconv.ParseBool(value)
+		return &v, err == nil
+	default:
+		return &value, true
+	}
+}
+
+func (t PromotedTag) goType() reflect.Type {
+	switch t.Type {
+	case PromotedTagTypeInt64:
+		return reflect.TypeOf(new(int64))
+	case PromotedTagTypeDouble:
+		return reflect.TypeOf(new(float64))
+	case PromotedTagTypeBool:
+		return reflect.TypeOf(new(bool))
+	default:
+		return reflect.TypeOf(new(string))
+	}
+}
+
+// PromotedTagColumns writes span records with an additional typed top-level
+// column per promoted tag, so Athena can use column statistics when searching
+// for these tags. The tags are still contained in the tag maps.
+type PromotedTagColumns struct {
+	tags    []PromotedTag
+	rowType reflect.Type
+}
+
+// NewPromotedTagColumns returns nil if no tags are promoted.
+func NewPromotedTagColumns(promotedTags []config.PromotedTag) (*PromotedTagColumns, error) {
+	if len(promotedTags) == 0 {
+		return nil, nil
+	}
+
+	recordType := reflect.TypeOf(SpanRecord{})
+	fields := make([]reflect.StructField, 0, recordType.NumField()+len(promotedTags))
+	columns := map[string]bool{}
+	for i := 0; i < recordType.NumField(); i++ {
+		fields = append(fields, recordType.Field(i))
+	}
+
+	tags := make([]PromotedTag, len(promotedTags))
+	for i, promotedTag := range promotedTags {
+		if promotedTag.Key == "" {
+			return nil, fmt.Errorf("promoted tag key must not be empty")
+		}
+
+		tag := PromotedTag{
+			Key:    promotedTag.Key,
+			Column: "tag_" + invalidColumnChars.ReplaceAllString(strings.ToLower(promotedTag.Key), "_"),
+			Type:   promotedTag.Type,
+		}
+
+		switch tag.Type {
+		case "":
+			tag.Type = PromotedTagTypeString
+		case PromotedTagTypeString, PromotedTagTypeInt64, PromotedTagTypeDouble, PromotedTagTypeBool:
+		default:
+			return nil, fmt.Errorf("unknown type %q of promoted tag %s", tag.Type, tag.Key)
+		}
+
+		if columns[tag.Column] {
+			return nil, fmt.Errorf("promoted tag %s conflicts with column %s", tag.Key, tag.Column)
+		}
+		columns[tag.Column] = true
+
+		tags[i] = tag
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("PromotedTag%d", i),
+			Type: tag.goType(),
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, tag.parquetTag())),
+		})
+	}
+
+	return &PromotedTagColumns{
+		tags:    tags,
+		rowType: reflect.StructOf(fields),
+	}, nil
+}
+
+// Tags returns all promoted tags.
+func (p *PromotedTagColumns) Tags() []PromotedTag {
+	if p == nil {
+		return nil
+	}
+
+	return p.tags
+}
+
+// RowType returns a pointer to a zero row, as expected by parquet-go.
+func (p *PromotedTagColumns) RowType() interface{} {
+	return reflect.New(p.rowType).Interface()
+}
+
+// MapRow converts a *SpanRecord into a row including the promoted tag columns.
+func (p *PromotedTagColumns) MapRow(row interface{}) (interface{}, error) {
+	record, ok := row.(*SpanRecord)
+	if !ok {
+		return nil, fmt.Errorf("unexpected row type %T", row)
+	}
+
+	source := reflect.ValueOf(record).Elem()
+	target := reflect.New(p.rowType).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		target.Field(i).Set(source.Field(i))
+	}
+
+	for i, tag := range p.tags {
+		value, ok := record.Tag(tag.Key)
+		if !ok {
+			continue
+		}
+
+		// Values not matching the column type are only kept in the tags map
+		if parsed, ok := tag.parse(value); ok {
+			target.Field(source.NumField() + i).Set(reflect.ValueOf(parsed))
+		}
+	}
+
+	return target.Addr().Interface(), nil
+}
+
+// Condition returns the Athena condition of filter. Promoted keys are only
+// compared using their column, so Athena can skip row groups using its
+// statistics. fallback additionally compares the tag maps, which contain rows
+// written before the key was promoted and values not matching the column type.
+func (p *PromotedTagColumns) Condition(filter TagFilter, fallback bool) (string, error) {
+	tagCondition, err := filter.Condition()
+	if err != nil {
+		return "", err
+	}
+
+	columnCondition, ok := p.columnCondition(filter)
+	if !ok {
+		return tagCondition, nil
+	}
+
+	if fallback {
+		return fmt.Sprintf(`(%s OR %s)`, columnCondition, tagCondition), nil
+	}
+
+	return columnCondition, nil
+}
+
+// columnCondition returns the condition applying filter to the promoted column
+// of its key, ok is false if the key isn't promoted or the filter doesn't match
+// the column type.
+func (p *PromotedTagColumns) columnCondition(filter TagFilter) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+
+	for _, tag := range p.tags {
+		if tag.Key != filter.Key {
+			continue
+		}
+
+		parsed, ok := tag.parse(filter.Value)
+		if !ok {
+			return "", false
+		}
+
+		switch v := parsed.(type) {
+		case *int64:
+			return fmt.Sprintf(`%s %s %d`, tag.Column, filter.Operator, *v), true
+		case *float64:
+			return fmt.Sprintf(`%s %s %s`, tag.Column, filter.Operator, strconv.FormatFloat(*v, 'g', -1, 64)), true
+		}
+
+		if filter.Operator != TagOperatorEqual && filter.Operator != TagOperatorNotEqual {
+			return "", false
+		}
+
+		if v, ok := parsed.(*bool); ok {
+			return fmt.Sprintf(`%s %s %t`, tag.Column, filter.Operator, *v), true
+		}
+		return fmt.Sprintf(`%s %s '%s'`, tag.Column, filter.Operator, strings.ReplaceAll(filter.Value, "'", "''")), true
+	}
+
+	return "", false
+}
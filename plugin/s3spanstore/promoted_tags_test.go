@@ -0,0 +1,120 @@
+package s3spanstore
+
+import (
+	"testing"
+
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+type promotedSpanRecord struct {
+	TraceID    string  `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	StatusCode *int64  `parquet:"name=tag_http_status_code, type=INT64, repetitiontype=OPTIONAL"`
+	Error      *bool   `parquet:"name=tag_error, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	Method     *string `parquet:"name=tag_http_method, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Route      *string `parquet:"name=tag_http_route, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+}
+
+func NewTestPromotedTagColumns(assert *assert.Assertions) *PromotedTagColumns {
+	promotedTags, err := NewPromotedTagColumns([]config.PromotedTag{
+		{Key: "http.status_code", Type: PromotedTagTypeInt64},
+		{Key: "error", Type: PromotedTagTypeBool},
+		{Key: "http.method"},
+		{Key: "http.route"},
+	})
+	assert.NoError(err)
+
+	return promotedTags
+}
+
+func TestPromotedTagColumnsWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	promotedTags := NewTestPromotedTagColumns(assert)
+
+	record, err := NewSpanRecordFromSpan(NewTestCodecSpan(), &snappyProtoCodec{})
+	assert.NoError(err)
+
+	row, err := promotedTags.MapRow(record)
+	assert.NoError(err)
+
+	file := buffer.NewBufferFile()
+	parquetWriter, err := ParquetOptions{}.NewWriter(file, promotedTags.RowType())
+	assert.NoError(err)
+	assert.NoError(parquetWriter.Write(row))
+	assert.NoError(parquetWriter.WriteStop())
+
+	pr, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(file.Bytes()), new(promotedSpanRecord), PARQUET_CONCURRENCY)
+	assert.NoError(err)
+	defer pr.ReadStop()
+
+	records := make([]promotedSpanRecord, pr.GetNumRows())
+	assert.NoError(pr.Read(&records))
+	assert.Len(records, 1)
+
+	assert.Equal(record.TraceID, records[0].TraceID)
+	assert.Equal(int64(500), *records[0].StatusCode)
+	assert.Equal(true, *records[0].Error)
+	assert.Equal("GET", *records[0].Method)
+	assert.Nil(records[0].Route)
+}
+
+func TestPromotedTagColumnsCondition(t *testing.T) {
+	assert := assert.New(t)
+
+	promotedTags := NewTestPromotedTagColumns(assert)
+
+	assertCondition := func(columnCondition string, filter TagFilter) {
+		tagCondition, err := filter.Condition()
+		assert.NoError(err)
+
+		condition, err := promotedTags.Condition(filter, false)
+		assert.NoError(err)
+		fallbackCondition, err := promotedTags.Condition(filter, true)
+		assert.NoError(err)
+		if columnCondition == "" {
+			assert.Equal(tagCondition, condition)
+			assert.Equal(tagCondition, fallbackCondition)
+		} else {
+			assert.Equal(columnCondition, condition)
+			assert.Equal("("+columnCondition+" OR "+tagCondition+")", fallbackCondition)
+		}
+	}
+
+	assertCondition("tag_http_status_code = 500", ParseTagFilter("http.status_code", "500"))
+	assertCondition("tag_error = true", ParseTagFilter("error", "true"))
+	assertCondition("tag_http_method = 'GET'", ParseTagFilter("http.method", "GET"))
+	assertCondition("tag_http_route = '/users/''admin'''", ParseTagFilter("http.route", "/users/'admin'"))
+	assertCondition("tag_http_status_code >= 499", ParseTagFilter("http.status_code>", "499"))
+
+	// Values not matching the type can only be in the tag maps
+	assertCondition("", ParseTagFilter("http.status_code", "unknown"))
+	assertCondition("", ParseTagFilter("db.system", "mysql"))
+
+	_, err := promotedTags.Condition(TagFilter{Key: "http.method", Operator: TagOperatorGreater, Value: "GET"}, false)
+	assert.Error(err)
+
+	var noPromotedTags *PromotedTagColumns
+	filter := ParseTagFilter("http.status_code", "500")
+	tagCondition, err := filter.Condition()
+	assert.NoError(err)
+	condition, err := noPromotedTags.Condition(filter, false)
+	assert.NoError(err)
+	assert.Equal(tagCondition, condition)
+}
+
+func TestNewPromotedTagColumnsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	promotedTags, err := NewPromotedTagColumns(nil)
+	assert.NoError(err)
+	assert.Nil(promotedTags)
+
+	_, err = NewPromotedTagColumns([]config.PromotedTag{{Key: "http.status_code", Type: "int32"}})
+	assert.Error(err)
+
+	_, err = NewPromotedTagColumns([]config.PromotedTag{{Key: "http.route"}, {Key: "http_route"}})
+	assert.Error(err)
+}
@@ -33,7 +33,7 @@ var (
 	defaultServicesQueryTtl     = time.Second * 60
 )
 
-func NewReader(ctx context.Context, logger hclog.Logger, svc AthenaAPI, cfg config.Athena) (*Reader, error) {
+func NewReader(ctx context.Context, logger hclog.Logger, svc AthenaAPI, cfg config.Athena, partitionScheme PartitionScheme, promotedTags *PromotedTagColumns) (*Reader, error) {
 	maxSpanAge, err := time.ParseDuration(cfg.MaxSpanAge)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse max timeframe: %w", err)
@@ -63,6 +63,8 @@ func NewReader(ctx context.Context, logger hclog.Logger, svc AthenaAPI, cfg conf
 		servicesQueryTTL:     servicesQueryTTL,
 		athenaQueryCache:     NewAthenaQueryCache(logger, svc, cfg.WorkGroup),
 		maxTraceDuration:     maxTraceDuration,
+		partitionScheme:      partitionScheme,
+		promotedTags:         promotedTags,
 	}
 
 	reader.dependenciesPrefetch = NewDependenciesPrefetch(ctx, logger, reader, dependenciesQueryTTL, cfg.DependenciesPrefetch)
@@ -81,6 +83,8 @@ type Reader struct {
 	athenaQueryCache     *AthenaQueryCache
 	dependenciesPrefetch *DependenciesPrefetch
 	maxTraceDuration     time.Duration
+	partitionScheme      PartitionScheme
+	promotedTags         *PromotedTagColumns
 }
 
 const (
@@ -101,11 +105,19 @@ func (s *Reader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Tr
 	defer otSpan.Finish()
 
 	conditions := []string{
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, s.DefaultMinTime().Format(PARTION_FORMAT), s.DefaultMaxTime().Format(PARTION_FORMAT)),
+		s.partitionScheme.Condition(s.DefaultMinTime(), s.DefaultMaxTime()),
 		fmt.Sprintf(`trace_id = '%s'`, traceID),
 	}
 
-	result, err := s.queryAthena(ctx, fmt.Sprintf(`SELECT DISTINCT span_payload FROM "%s" WHERE %s`, s.cfg.SpansTableName, strings.Join(conditions, " AND ")))
+	servicesCondition, err := s.allServicesCondition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if servicesCondition != "" {
+		conditions = append(conditions, servicesCondition)
+	}
+
+	result, err := s.queryAthena(ctx, fmt.Sprintf(`SELECT DISTINCT %s FROM "%s" WHERE %s`, SpanPayloadColumns, s.cfg.SpansTableName, strings.Join(conditions, " AND ")))
 	if err != nil {
 		return nil, fmt.Errorf("failed to query athena: %w", err)
 	}
@@ -115,7 +127,7 @@ func (s *Reader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Tr
 
 	spans := make([]*model.Span, len(result))
 	for i, v := range result {
-		span, err := DecodeSpanPayload(*v.Data[0].VarCharValue)
+		span, err := decodeSpanPayloadRow(v.Data[0:3])
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal span: %w", err)
 		}
@@ -184,7 +196,7 @@ func (s *Reader) GetOperations(ctx context.Context, query spanstore.OperationQue
 
 func (r *Reader) getServicesAndOperations(ctx context.Context) ([]types.Row, error) {
 	conditions := []string{
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, r.DefaultMinTime().Format(PARTION_FORMAT), r.DefaultMaxTime().Format(PARTION_FORMAT)),
+		r.partitionScheme.Condition(r.DefaultMinTime(), r.DefaultMaxTime()),
 	}
 
 	result, err := r.queryAthenaCached(
@@ -199,6 +211,65 @@ func (r *Reader) getServicesAndOperations(ctx context.Context) ([]types.Row, err
 	return result, nil
 }
 
+// TagKey is a tag key of a service. Values lists the known values of
+// low-cardinality keys and is empty for keys with too many distinct values.
+type TagKey struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values,omitempty"`
+}
+
+// GetTagKeys returns the tag keys of a service from the tag key catalog, sorted by key.
+func (r *Reader) GetTagKeys(ctx context.Context, serviceName string) ([]TagKey, error) {
+	r.logger.Trace("GetTagKeys", serviceName)
+	otSpan, _ := opentracing.StartSpanFromContext(ctx, "GetTagKeys")
+	defer otSpan.Finish()
+
+	if r.cfg.TagKeysTableName == "" {
+		return nil, fmt.Errorf("no tag keys table configured")
+	}
+
+	serviceCondition := fmt.Sprintf(`service_name = '%s'`, strings.ReplaceAll(serviceName, "'", "''"))
+	conditions := []string{
+		serviceCondition,
+		r.partitionScheme.Condition(r.DefaultMinTime(), r.DefaultMaxTime()),
+	}
+
+	result, err := r.queryAthenaCached(
+		ctx,
+		fmt.Sprintf(`SELECT key, value, high_cardinality FROM "%s" WHERE %s GROUP BY 1, 2, 3 ORDER BY 1, 2`, r.cfg.TagKeysTableName, strings.Join(conditions, " AND ")),
+		fmt.Sprintf(`SELECT key, value, high_cardinality FROM "%s" WHERE %s AND`, r.cfg.TagKeysTableName, serviceCondition),
+		r.servicesQueryTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query athena: %w", err)
+	}
+
+	tagKeys := []TagKey{}
+	highCardinality := map[string]bool{}
+	for _, v := range result {
+		key := *v.Data[0].VarCharValue
+		if len(tagKeys) == 0 || tagKeys[len(tagKeys)-1].Key != key {
+			tagKeys = append(tagKeys, TagKey{Key: key})
+		}
+
+		if *v.Data[2].VarCharValue == "true" {
+			highCardinality[key] = true
+			continue
+		}
+
+		tagKey := &tagKeys[len(tagKeys)-1]
+		tagKey.Values = append(tagKey.Values, *v.Data[1].VarCharValue)
+	}
+
+	// Keys become high-cardinality after some values have been recorded
+	for i := range tagKeys {
+		if highCardinality[tagKeys[i].Key] {
+			tagKeys[i].Values = nil
+		}
+	}
+
+	return tagKeys, nil
+}
+
 func (r *Reader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
 	r.logger.Trace("FindTraces", query)
 	span, _ := opentracing.StartSpanFromContext(ctx, "FindTraces")
@@ -220,11 +291,20 @@ func (r *Reader) FindTraces(ctx context.Context, query *spanstore.TraceQueryPara
 
 	// Fetch span details, but only look into partitions +/- maxTraceDurations
 	spanConditions := []string{
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, query.StartTimeMin.Add(-r.maxTraceDuration).Format(PARTION_FORMAT), query.StartTimeMax.Add(r.maxTraceDuration).Format(PARTION_FORMAT)),
+		r.partitionScheme.Condition(query.StartTimeMin.Add(-r.maxTraceDuration), query.StartTimeMax.Add(r.maxTraceDuration)),
 		fmt.Sprintf(`trace_id IN ('%s')`, strings.Join(traceIDs, `', '`)),
 	}
 
-	spanResult, err := r.queryAthena(ctx, fmt.Sprintf(`SELECT DISTINCT trace_id, span_payload FROM "%s" WHERE %s`, r.cfg.SpansTableName, strings.Join(spanConditions, " AND ")))
+	// Traces usually span multiple services, so search all service partitions
+	servicesCondition, err := r.allServicesCondition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if servicesCondition != "" {
+		spanConditions = append(spanConditions, servicesCondition)
+	}
+
+	spanResult, err := r.queryAthena(ctx, fmt.Sprintf(`SELECT DISTINCT trace_id, %s FROM "%s" WHERE %s`, SpanPayloadColumns, r.cfg.SpansTableName, strings.Join(spanConditions, " AND ")))
 	if err != nil {
 		return nil, fmt.Errorf("failed to query athena: %w", err)
 	}
@@ -232,7 +312,7 @@ func (r *Reader) FindTraces(ctx context.Context, query *spanstore.TraceQueryPara
 	traceIdSpans := map[string][]*model.Span{}
 	for _, v := range spanResult {
 		traceId := *v.Data[0].VarCharValue
-		span, err := DecodeSpanPayload(*v.Data[1].VarCharValue)
+		span, err := decodeSpanPayloadRow(v.Data[1:4])
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal span: %w", err)
 		}
@@ -290,12 +370,20 @@ func (r *Reader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 	// TODO Prevent SQL injections
 	conditions := []string{fmt.Sprintf(`service_name = '%s'`, query.ServiceName)}
 
+	if serviceCondition := r.partitionScheme.ServiceCondition(query.ServiceName); serviceCondition != "" {
+		conditions = append(conditions, serviceCondition)
+	}
+
 	if query.OperationName != "" {
 		conditions = append(conditions, fmt.Sprintf(`operation_name = '%s'`, query.OperationName))
 	}
 
 	for key, value := range query.Tags {
-		conditions = append(conditions, fmt.Sprintf(`tags['%s'] = '%s'`, key, value))
+		tagCondition, err := r.promotedTags.Condition(ParseTagFilter(key, value), r.cfg.PromotedTagsFallback)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag filter: %w", err)
+		}
+		conditions = append(conditions, tagCondition)
 	}
 
 	if query.StartTimeMin.IsZero() {
@@ -306,7 +394,7 @@ func (r *Reader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 		query.StartTimeMax = r.DefaultMaxTime()
 	}
 
-	conditions = append(conditions, fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, query.StartTimeMin.Format(PARTION_FORMAT), query.StartTimeMax.Format(PARTION_FORMAT)))
+	conditions = append(conditions, r.partitionScheme.Condition(query.StartTimeMin, query.StartTimeMax))
 	conditions = append(conditions, fmt.Sprintf(`start_time BETWEEN timestamp '%s' AND timestamp '%s'`, query.StartTimeMin.Format(ATHENA_TIMEFORMAT), query.StartTimeMax.Format(ATHENA_TIMEFORMAT)))
 
 	if query.DurationMin.String() != "0s" && query.DurationMax.String() != "0s" {
@@ -341,13 +429,27 @@ func (r *Reader) GetDependencies(ctx context.Context, endTs time.Time, lookback
 
 	startTs := endTs.Add(-lookback)
 
+	if r.cfg.DependenciesTableName != "" {
+		return r.getDependenciesFromTable(ctx, startTs, endTs)
+	}
+
 	conditions := []string{
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, startTs.Format(PARTION_FORMAT), endTs.Format(PARTION_FORMAT)),
+		r.partitionScheme.Condition(startTs, endTs),
 	}
 
+	servicesCondition, err := r.allServicesCondition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if servicesCondition != "" {
+		conditions = append(conditions, servicesCondition)
+	}
+
+	// Spans are counted distinct, as they are present twice while a compaction
+	// replaces their files
 	result, err := r.queryAthenaCached(ctx, fmt.Sprintf(`
 		WITH spans_with_references AS (
-			SELECT
+			SELECT DISTINCT
 				base.service_name,
 				base.trace_id,
 				base.span_id,
@@ -355,18 +457,47 @@ func (r *Reader) GetDependencies(ctx context.Context, endTs time.Time, lookback
 				unnested_references.reference.span_id as ref_span_id
 			FROM %s as base
 			CROSS JOIN UNNEST(base.references) AS unnested_references (reference)
+		),
+		parents AS (
+			SELECT DISTINCT trace_id, span_id, service_name FROM %s WHERE %s
 		)
 
-		SELECT jaeger.service_name as parent, spans_with_references.service_name as child, COUNT(*) as callcount
+		SELECT parents.service_name as parent, spans_with_references.service_name as child, COUNT(*) as callcount
 			FROM spans_with_references
-			JOIN %s as jaeger ON spans_with_references.ref_trace_id = jaeger.trace_id AND spans_with_references.ref_span_id = jaeger.span_id
-			WHERE %s
+			JOIN parents ON spans_with_references.ref_trace_id = parents.trace_id AND spans_with_references.ref_span_id = parents.span_id
 			GROUP BY 1, 2
 	`, r.cfg.SpansTableName, r.cfg.SpansTableName, strings.Join(conditions, " AND ")), "WITH spans_with_reference", r.dependenciesQueryTTL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query athena: %w", err)
 	}
 
+	return parseDependencyLinks(result)
+}
+
+// getDependenciesFromTable sums the call counts of the dependencies dataset.
+// Links which weren't resolved yet are skipped, resolving them here would scan
+// the spans table the dataset avoids. They are counted once the aggregation
+// resolved them, which is delayed by at least the compaction min age.
+func (r *Reader) getDependenciesFromTable(ctx context.Context, startTs time.Time, endTs time.Time) ([]model.DependencyLink, error) {
+	conditions := []string{
+		r.partitionScheme.Condition(startTs, endTs),
+		`parent != ''`,
+	}
+
+	result, err := r.queryAthenaCached(
+		ctx,
+		fmt.Sprintf(`SELECT parent, child, SUM(call_count) FROM "%s" WHERE %s GROUP BY 1, 2`, r.cfg.DependenciesTableName, strings.Join(conditions, " AND ")),
+		fmt.Sprintf(`SELECT parent, child, SUM(call_count) FROM "%s" WHERE`, r.cfg.DependenciesTableName),
+		r.dependenciesQueryTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query athena: %w", err)
+	}
+
+	return parseDependencyLinks(result)
+}
+
+// parseDependencyLinks parses rows of parent, child and call count.
+func parseDependencyLinks(result []types.Row) ([]model.DependencyLink, error) {
 	dependencyLinks := make([]model.DependencyLink, len(result))
 	for i, v := range result {
 		callCount, err := strconv.ParseUint(*v.Data[2].VarCharValue, 10, 64)
@@ -384,6 +515,31 @@ func (r *Reader) GetDependencies(ctx context.Context, endTs time.Time, lookback
 	return dependencyLinks, nil
 }
 
+// decodeSpanPayloadRow decodes the span from the result data of SpanPayloadColumns.
+func decodeSpanPayloadRow(data []types.Datum) (*model.Span, error) {
+	version, err := strconv.ParseInt(*data[0].VarCharValue, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse payload version: %w", err)
+	}
+
+	return DecodeSpanPayloadColumn(int32(version), *data[1].VarCharValue, *data[2].VarCharValue)
+}
+
+// allServicesCondition returns the partition condition selecting the spans of all services.
+// Service name partitions can't be enumerated by Athena, so all known services are listed.
+func (r *Reader) allServicesCondition(ctx context.Context) (string, error) {
+	if r.partitionScheme.ServicePartitioning != ServicePartitioningName {
+		return "", nil
+	}
+
+	serviceNames, err := r.GetServices(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to query services: %w", err)
+	}
+
+	return r.partitionScheme.ServicesCondition(serviceNames), nil
+}
+
 func (r *Reader) queryAthenaCached(ctx context.Context, queryString string, lookupString string, ttl time.Duration) ([]types.Row, error) {
 	otSpan, _ := opentracing.StartSpanFromContext(ctx, "queryAthenaCached")
 	defer otSpan.Finish()
@@ -419,6 +575,8 @@ func (r *Reader) queryAthena(ctx context.Context, queryString string) ([]types.R
 		return nil, fmt.Errorf("failed to start athena query: %w", err)
 	}
 
+	started := time.Now()
+
 	status, err := r.svc.GetQueryExecution(ctx, &athena.GetQueryExecutionInput{
 		QueryExecutionId: output.QueryExecutionId,
 	})
@@ -426,13 +584,34 @@ func (r *Reader) queryAthena(ctx context.Context, queryString string) ([]types.R
 		return nil, fmt.Errorf("failed to get athena query execution: %w", err)
 	}
 
-	return r.waitAndFetchQueryResult(ctx, status.QueryExecution)
+	queryExecution, err := r.waitForQueryExecution(ctx, status.QueryExecution)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only queries started by the reader are measured, cached queries didn't scan any data
+	athenaQueryDuration.With(strings.ToLower(string(queryExecution.Status.State))).Observe(time.Since(started).Seconds())
+	if queryExecution.Statistics != nil && queryExecution.Statistics.DataScannedInBytes != nil {
+		athenaDataScannedBytesTotal.With().Add(float64(*queryExecution.Statistics.DataScannedInBytes))
+	}
+
+	return r.fetchQueryResult(ctx, queryExecution.QueryExecutionId)
 }
 
 func (r *Reader) waitAndFetchQueryResult(ctx context.Context, queryExecution *types.QueryExecution) ([]types.Row, error) {
 	otSpan, _ := opentracing.StartSpanFromContext(ctx, "waitAndFetchQueryResult")
 	defer otSpan.Finish()
 
+	queryExecution, err := r.waitForQueryExecution(ctx, queryExecution)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.fetchQueryResult(ctx, queryExecution.QueryExecutionId)
+}
+
+// waitForQueryExecution polls until the query completed and returns its final execution
+func (r *Reader) waitForQueryExecution(ctx context.Context, queryExecution *types.QueryExecution) (*types.QueryExecution, error) {
 	// Poll until the query completed
 	for {
 		if queryExecution.Status.CompletionDateTime != nil {
@@ -451,7 +630,7 @@ func (r *Reader) waitAndFetchQueryResult(ctx context.Context, queryExecution *ty
 		queryExecution = status.QueryExecution
 	}
 
-	return r.fetchQueryResult(ctx, queryExecution.QueryExecutionId)
+	return queryExecution, nil
 }
 
 func (r *Reader) fetchQueryResult(ctx context.Context, queryExecutionId *string) ([]types.Row, error) {
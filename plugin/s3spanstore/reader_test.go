@@ -11,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/athena/types"
 	"github.com/golang/mock/gomock"
 	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
@@ -32,15 +33,17 @@ func NewTestReader(ctx context.Context, assert *assert.Assertions, mockSvc *mock
 	})
 
 	reader, err := NewReader(ctx, logger, mockSvc, config.Athena{
-		DatabaseName:         "default",
-		SpansTableName:       "jaeger_spans",
-		OperationsTableName:  "jaeger_operations",
-		OutputLocation:       "s3://jaeger-s3-test-results/",
-		WorkGroup:            "jaeger",
-		MaxSpanAge:           "336h",
-		DependenciesQueryTTL: "6h",
-		ServicesQueryTTL:     "10s",
-	})
+		DatabaseName:          "default",
+		SpansTableName:        "jaeger_spans",
+		OperationsTableName:   "jaeger_operations",
+		TagKeysTableName:      "jaeger_tag_keys",
+		DependenciesTableName: "jaeger_dependencies",
+		OutputLocation:        "s3://jaeger-s3-test-results/",
+		WorkGroup:             "jaeger",
+		MaxSpanAge:            "336h",
+		DependenciesQueryTTL:  "6h",
+		ServicesQueryTTL:      "10s",
+	}, DefaultPartitionScheme, nil)
 
 	assert.NoError(err)
 
@@ -260,3 +263,63 @@ func TestGetOperationsWithSpanKind(t *testing.T) {
 		},
 	}, operations)
 }
+
+func TestGetTagKeys(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	results := [][]string{
+		{"http.method", "GET", "false"},
+		{"http.method", "POST", "false"},
+		{"http.url", "", "true"},
+		{"user.id", "1", "false"},
+		{"user.id", "", "true"},
+	}
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockSvc.EXPECT().ListQueryExecutions(gomock.Any(), gomock.Any()).
+		Return(&athena.ListQueryExecutionsOutput{}, nil)
+
+	mockQueryRunAndResult(mockSvc, results)
+
+	reader := NewTestReader(ctx, assert, mockSvc)
+
+	tagKeys, err := reader.GetTagKeys(ctx, "test")
+
+	assert.NoError(err)
+	assert.Equal([]TagKey{
+		{Key: "http.method", Values: []string{"GET", "POST"}},
+		{Key: "http.url"},
+		{Key: "user.id"},
+	}, tagKeys)
+}
+
+func TestGetDependenciesFromTable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockSvc.EXPECT().ListQueryExecutions(gomock.Any(), gomock.Any()).
+		Return(&athena.ListQueryExecutionsOutput{}, nil)
+
+	mockQueryRunAndResult(mockSvc, [][]string{
+		{"frontend", "payments", "42"},
+		{"payments", "db", "7"},
+	})
+
+	reader := NewTestReader(ctx, assert, mockSvc)
+
+	dependencyLinks, err := reader.GetDependencies(ctx, time.Now(), time.Hour*24*7)
+
+	assert.NoError(err)
+	assert.Equal([]model.DependencyLink{
+		{Parent: "frontend", Child: "payments", CallCount: 42},
+		{Parent: "payments", Child: "db", CallCount: 7},
+	}, dependencyLinks)
+}
@@ -0,0 +1,178 @@
+package s3spanstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+const (
+	RedactionActionDrop = "drop"
+	RedactionActionMask = "mask"
+	RedactionActionHash = "hash"
+)
+
+const defaultRedactionReplacement = "[REDACTED]"
+
+type redactionRule struct {
+	keys         map[string]bool
+	keyPattern   *regexp.Regexp
+	valuePattern *regexp.Regexp
+	action       string
+	replacement  string
+}
+
+// Redactor scrubs sensitive span tags, process tags and log fields before a
+// span is persisted. Rules are applied in order, dropping or hashing a field
+// ends its processing, while multiple masks can apply to the same field.
+type Redactor struct {
+	rules   []redactionRule
+	hashKey []byte
+}
+
+// NewRedactor returns nil if no rules are configured.
+func NewRedactor(rules []config.RedactionRule, hashKey string) (*Redactor, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	redactionRules := make([]redactionRule, len(rules))
+	for i, rule := range rules {
+		redactionRule := redactionRule{
+			keys:        map[string]bool{},
+			action:      rule.Action,
+			replacement: rule.Replacement,
+		}
+
+		for _, key := range rule.Keys {
+			redactionRule.keys[key] = true
+		}
+
+		if rule.KeyPattern != "" {
+			keyPattern, err := regexp.Compile(rule.KeyPattern)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse key pattern of redaction rule %d: %w", i, err)
+			}
+			redactionRule.keyPattern = keyPattern
+		}
+
+		if rule.ValuePattern != "" {
+			valuePattern, err := regexp.Compile(rule.ValuePattern)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse value pattern of redaction rule %d: %w", i, err)
+			}
+			redactionRule.valuePattern = valuePattern
+		}
+
+		if redactionRule.replacement == "" {
+			redactionRule.replacement = defaultRedactionReplacement
+		}
+
+		switch rule.Action {
+		case RedactionActionMask:
+		case RedactionActionDrop, RedactionActionHash:
+			// Dropping or hashing all fields is most likely a mistake
+			if len(rule.Keys) == 0 && rule.KeyPattern == "" {
+				return nil, fmt.Errorf("redaction rule %d requires keys or a key pattern", i)
+			}
+			if rule.Action == RedactionActionHash && hashKey == "" {
+				return nil, fmt.Errorf("redaction rule %d requires a hash key", i)
+			}
+		default:
+			return nil, fmt.Errorf("unknown action %q of redaction rule %d", rule.Action, i)
+		}
+
+		redactionRules[i] = redactionRule
+	}
+
+	return &Redactor{
+		rules:   redactionRules,
+		hashKey: []byte(hashKey),
+	}, nil
+}
+
+// Redact returns a redacted copy of span, span itself isn't modified as its
+// process might be shared with other spans.
+func (r *Redactor) Redact(span *model.Span) *model.Span {
+	if r == nil {
+		return span
+	}
+
+	redacted := *span
+	redacted.Tags = r.redactKeyValues(span.Tags)
+
+	if span.Process != nil {
+		process := *span.Process
+		process.Tags = r.redactKeyValues(span.Process.Tags)
+		redacted.Process = &process
+	}
+
+	if span.Logs != nil {
+		redacted.Logs = make([]model.Log, len(span.Logs))
+		for i, log := range span.Logs {
+			redacted.Logs[i] = model.Log{
+				Timestamp: log.Timestamp,
+				Fields:    r.redactKeyValues(log.Fields),
+			}
+		}
+	}
+
+	return &redacted
+}
+
+func (r *Redactor) redactKeyValues(kvs []model.KeyValue) []model.KeyValue {
+	if kvs == nil {
+		return nil
+	}
+
+	redacted := make([]model.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		if kv, keep := r.redactKeyValue(kv); keep {
+			redacted = append(redacted, kv)
+		}
+	}
+
+	return redacted
+}
+
+func (r *Redactor) redactKeyValue(kv model.KeyValue) (model.KeyValue, bool) {
+	for _, rule := range r.rules {
+		if !rule.matchesKey(kv.Key) {
+			continue
+		}
+
+		switch rule.action {
+		case RedactionActionDrop:
+			return kv, false
+		case RedactionActionHash:
+			mac := hmac.New(sha256.New, r.hashKey)
+			mac.Write([]byte(kv.AsString()))
+			return model.String(kv.Key, hex.EncodeToString(mac.Sum(nil))), true
+		case RedactionActionMask:
+			if rule.valuePattern == nil {
+				kv = model.String(kv.Key, rule.replacement)
+				continue
+			}
+
+			value := kv.AsString()
+			if masked := rule.valuePattern.ReplaceAllLiteralString(value, rule.replacement); masked != value {
+				kv = model.String(kv.Key, masked)
+			}
+		}
+	}
+
+	return kv, true
+}
+
+func (r redactionRule) matchesKey(key string) bool {
+	if len(r.keys) == 0 && r.keyPattern == nil {
+		return true
+	}
+
+	return r.keys[key] || (r.keyPattern != nil && r.keyPattern.MatchString(key))
+}
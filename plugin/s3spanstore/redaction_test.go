@@ -0,0 +1,68 @@
+package s3spanstore
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactorRedact(t *testing.T) {
+	assert := assert.New(t)
+
+	redactor, err := NewRedactor([]config.RedactionRule{
+		{Keys: []string{"http.request.header.authorization"}, Action: RedactionActionDrop},
+		{KeyPattern: `^user\.id$`, Action: RedactionActionHash},
+		{ValuePattern: `[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`, Action: RedactionActionMask, Replacement: "<email>"},
+		{Keys: []string{"card"}, Action: RedactionActionMask},
+	}, "secret")
+	assert.NoError(err)
+
+	span := NewTestCodecSpan()
+	span.Tags = append(span.Tags,
+		model.String("http.request.header.authorization", "Bearer token"),
+		model.Int64("user.id", 42),
+		model.String("message", "sent to jane@example.com"),
+	)
+	span.Process.Tags = append(span.Process.Tags, model.String("owner", "ops@example.com"))
+	span.Logs[0].Fields = append(span.Logs[0].Fields, model.String("card", "4111 1111 1111 1111"))
+
+	redacted := redactor.Redact(span)
+
+	tags := kvToMap(redacted.Tags)
+	assert.NotContains(tags, "http.request.header.authorization")
+	assert.Equal("93c121e7aa437a1e01e3c512c6f0ce3c821a839025dca4408f85616de4aaee70", tags["user.id"])
+	assert.Equal("sent to <email>", tags["message"])
+	assert.Equal("GET", tags["http.method"])
+	assert.Equal("<email>", kvToMap(redacted.Process.Tags)["owner"])
+	assert.Equal("[REDACTED]", kvToMap(redacted.Logs[0].Fields)["card"])
+
+	// The original span is left untouched
+	assert.Equal("Bearer token", kvToMap(span.Tags)["http.request.header.authorization"])
+	assert.Equal("ops@example.com", kvToMap(span.Process.Tags)["owner"])
+	assert.Equal("4111 1111 1111 1111", kvToMap(span.Logs[0].Fields)["card"])
+
+	var noRedactor *Redactor
+	assert.Equal(span, noRedactor.Redact(span))
+}
+
+func TestNewRedactorInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	redactor, err := NewRedactor(nil, "")
+	assert.NoError(err)
+	assert.Nil(redactor)
+
+	_, err = NewRedactor([]config.RedactionRule{{Action: RedactionActionDrop}}, "")
+	assert.Error(err)
+
+	_, err = NewRedactor([]config.RedactionRule{{Keys: []string{"user.id"}, Action: RedactionActionHash}}, "")
+	assert.Error(err)
+
+	_, err = NewRedactor([]config.RedactionRule{{Keys: []string{"user.id"}, Action: "encrypt"}}, "")
+	assert.Error(err)
+
+	_, err = NewRedactor([]config.RedactionRule{{ValuePattern: "(", Action: RedactionActionMask}}, "")
+	assert.Error(err)
+}
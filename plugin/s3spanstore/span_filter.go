@@ -0,0 +1,162 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+const (
+	SpanFilterActionKeep   = "keep"
+	SpanFilterActionDrop   = "drop"
+	SpanFilterActionSample = "sample"
+)
+
+type spanFilterRule struct {
+	service          string
+	operation        string
+	operationPattern *regexp.Regexp
+	spanKind         string
+	tags             []config.TagMatch
+	minDuration      time.Duration
+	maxDuration      time.Duration
+	action           string
+	sampleRate       float64
+}
+
+// SpanFilter decides which spans are written. The first matching rule is
+// applied, spans not matching any rule are kept.
+type SpanFilter struct {
+	rules []spanFilterRule
+}
+
+// NewSpanFilter returns nil if no filters are configured.
+func NewSpanFilter(filters []config.SpanFilter) (*SpanFilter, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]spanFilterRule, len(filters))
+	for i, filter := range filters {
+		rule := spanFilterRule{
+			service:    filter.Service,
+			operation:  filter.Operation,
+			spanKind:   filter.SpanKind,
+			tags:       filter.Tags,
+			action:     filter.Action,
+			sampleRate: filter.SampleRate,
+		}
+
+		if filter.OperationPattern != "" {
+			operationPattern, err := regexp.Compile(filter.OperationPattern)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse operation pattern of span filter %d: %w", i, err)
+			}
+			rule.operationPattern = operationPattern
+		}
+
+		var err error
+		if rule.minDuration, err = parseDurationWithDefault(filter.MinDuration, 0); err != nil {
+			return nil, fmt.Errorf("failed to parse min duration of span filter %d: %w", i, err)
+		}
+		if rule.maxDuration, err = parseDurationWithDefault(filter.MaxDuration, 0); err != nil {
+			return nil, fmt.Errorf("failed to parse max duration of span filter %d: %w", i, err)
+		}
+
+		switch rule.action {
+		case SpanFilterActionKeep, SpanFilterActionDrop:
+		case SpanFilterActionSample:
+			if rule.sampleRate < 0 || rule.sampleRate > 1 {
+				return nil, fmt.Errorf("sample rate of span filter %d must be between 0 and 1", i)
+			}
+		default:
+			return nil, fmt.Errorf("unknown action %q of span filter %d", rule.action, i)
+		}
+
+		rules[i] = rule
+	}
+
+	return &SpanFilter{rules: rules}, nil
+}
+
+// Keep returns whether span should be written.
+func (f *SpanFilter) Keep(span *model.Span) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, rule := range f.rules {
+		if !rule.matches(span) {
+			continue
+		}
+
+		switch rule.action {
+		case SpanFilterActionDrop:
+			return false
+		case SpanFilterActionSample:
+			return sampleTrace(span.TraceID, rule.sampleRate)
+		default:
+			return true
+		}
+	}
+
+	return true
+}
+
+func (r spanFilterRule) matches(span *model.Span) bool {
+	if r.service != "" && r.service != span.Process.ServiceName {
+		return false
+	}
+
+	if r.operation != "" && r.operation != span.OperationName {
+		return false
+	}
+
+	if r.operationPattern != nil && !r.operationPattern.MatchString(span.OperationName) {
+		return false
+	}
+
+	if r.spanKind != "" {
+		if kind, _ := span.GetSpanKind(); kind != r.spanKind {
+			return false
+		}
+	}
+
+	if r.minDuration > 0 && span.Duration < r.minDuration {
+		return false
+	}
+
+	if r.maxDuration > 0 && span.Duration > r.maxDuration {
+		return false
+	}
+
+	for _, tag := range r.tags {
+		if !hasTag(span, tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasTag(span *model.Span, tag config.TagMatch) bool {
+	for _, kvs := range [][]model.KeyValue{span.Tags, span.Process.Tags} {
+		for _, kv := range kvs {
+			if kv.Key == tag.Key && kv.AsString() == tag.Value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sampleTrace decides by trace id, so all sampled spans of a trace are kept or
+// dropped together, also across collectors.
+func sampleTrace(traceID model.TraceID, rate float64) bool {
+	// The upper 53 bits of the random trace id as a number in [0, 1)
+	return float64(traceID.Low>>11)/(1<<53) < rate
+}
@@ -0,0 +1,81 @@
+package s3spanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanFilterKeep(t *testing.T) {
+	assert := assert.New(t)
+
+	spanFilter, err := NewSpanFilter([]config.SpanFilter{
+		{OperationPattern: "^/health", Action: SpanFilterActionDrop},
+		{Service: "example-service-1", Tags: []config.TagMatch{{Key: "error", Value: "true"}}, Action: SpanFilterActionKeep},
+		{Service: "example-service-1", Operation: "GET /metrics", MaxDuration: "200ms", Action: SpanFilterActionSample, SampleRate: 0},
+	})
+	assert.NoError(err)
+
+	span := NewTestCodecSpan()
+	assert.True(spanFilter.Keep(span))
+
+	span.OperationName = "/healthz"
+	assert.False(spanFilter.Keep(span))
+
+	// Error spans are kept by the earlier rule
+	span.OperationName = "GET /metrics"
+	assert.True(spanFilter.Keep(span))
+
+	span.Tags = []model.KeyValue{model.String("span.kind", "server")}
+	assert.False(spanFilter.Keep(span))
+
+	span.Duration = time.Second
+	assert.True(spanFilter.Keep(span))
+
+	var noSpanFilter *SpanFilter
+	assert.True(noSpanFilter.Keep(span))
+}
+
+func TestSpanFilterSamplesByTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	spanFilter, err := NewSpanFilter([]config.SpanFilter{
+		{SpanKind: "server", Action: SpanFilterActionSample, SampleRate: 0.5},
+	})
+	assert.NoError(err)
+
+	span := NewTestCodecSpan()
+
+	span.TraceID = model.NewTraceID(0, 1<<62)
+	assert.True(spanFilter.Keep(span))
+
+	span.TraceID = model.NewTraceID(0, 3<<62)
+	assert.False(spanFilter.Keep(span))
+
+	// Spans of other kinds aren't sampled
+	span.Tags = nil
+	assert.True(spanFilter.Keep(span))
+}
+
+func TestNewSpanFilterInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	spanFilter, err := NewSpanFilter(nil)
+	assert.NoError(err)
+	assert.Nil(spanFilter)
+
+	_, err = NewSpanFilter([]config.SpanFilter{{Action: "ignore"}})
+	assert.Error(err)
+
+	_, err = NewSpanFilter([]config.SpanFilter{{Action: SpanFilterActionSample, SampleRate: 1.5}})
+	assert.Error(err)
+
+	_, err = NewSpanFilter([]config.SpanFilter{{OperationPattern: "(", Action: SpanFilterActionDrop}})
+	assert.Error(err)
+
+	_, err = NewSpanFilter([]config.SpanFilter{{MaxDuration: "fast", Action: SpanFilterActionDrop}})
+	assert.Error(err)
+}
@@ -0,0 +1,244 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+const (
+	// SizeLimitPolicyTruncate cuts spans down to the limits
+	SizeLimitPolicyTruncate = "truncate"
+	// SizeLimitPolicyDrop drops spans exceeding any limit
+	SizeLimitPolicyDrop = "drop"
+)
+
+// truncatedPayloadTagValueLength is the tag value length used as a last resort
+// to fit a span into the max payload size
+const truncatedPayloadTagValueLength = 128
+
+// SpanLimits restricts the size of written spans, zero values disable a limit.
+type SpanLimits struct {
+	MaxTagValueLength int
+	MaxLogs           int
+	// MaxPayloadSize is the maximum size of the encoded span payload in bytes
+	MaxPayloadSize int
+	Policy         string
+}
+
+func NewSpanLimits(s3Config config.S3) (SpanLimits, error) {
+	limits := SpanLimits{
+		MaxTagValueLength: s3Config.MaxTagValueLength,
+		MaxLogs:           s3Config.MaxLogs,
+		MaxPayloadSize:    s3Config.MaxPayloadSize,
+		Policy:            s3Config.SizeLimitPolicy,
+	}
+
+	switch limits.Policy {
+	case "":
+		limits.Policy = SizeLimitPolicyTruncate
+	case SizeLimitPolicyTruncate, SizeLimitPolicyDrop:
+	default:
+		return SpanLimits{}, fmt.Errorf("unknown size limit policy %q", limits.Policy)
+	}
+
+	return limits, nil
+}
+
+func (l SpanLimits) enabled() bool {
+	return l.MaxTagValueLength > 0 || l.MaxLogs > 0 || l.MaxPayloadSize > 0
+}
+
+// SpanLimiter applies SpanLimits to spans and counts truncated and dropped spans.
+type SpanLimiter struct {
+	logger hclog.Logger
+	limits SpanLimits
+	codec  SpanPayloadCodec
+
+	truncated uint64
+	dropped   uint64
+}
+
+// NewSpanLimiter returns nil if no limit is configured.
+func NewSpanLimiter(logger hclog.Logger, limits SpanLimits, codec SpanPayloadCodec) *SpanLimiter {
+	if !limits.enabled() {
+		return nil
+	}
+
+	return &SpanLimiter{
+		logger: logger,
+		limits: limits,
+		codec:  codec,
+	}
+}
+
+// Limit returns span or a truncated copy of it, ok is false if the span should
+// be dropped. Truncated spans contain a warning describing the truncation.
+func (l *SpanLimiter) Limit(span *model.Span) (*model.Span, bool) {
+	if l == nil {
+		return span, true
+	}
+
+	limited, warnings := l.limit(span)
+	if len(warnings) == 0 {
+		return span, true
+	}
+
+	if l.limits.Policy == SizeLimitPolicyDrop || limited == nil {
+		atomic.AddUint64(&l.dropped, 1)
+		spansDroppedTotal.With("size_limit").Inc()
+		l.logger.Warn("dropped span exceeding size limits", "trace_id", span.TraceID.String(), "span_id", span.SpanID.String(), "reasons", warnings)
+		return nil, false
+	}
+
+	atomic.AddUint64(&l.truncated, 1)
+	spansTruncatedTotal.With().Inc()
+	l.logger.Warn("truncated span exceeding size limits", "trace_id", span.TraceID.String(), "span_id", span.SpanID.String(), "reasons", warnings)
+
+	limited.Warnings = append(append([]string{}, limited.Warnings...), warnings...)
+	return limited, true
+}
+
+// Truncated returns the number of truncated spans.
+func (l *SpanLimiter) Truncated() uint64 {
+	return atomic.LoadUint64(&l.truncated)
+}
+
+// Dropped returns the number of dropped spans.
+func (l *SpanLimiter) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// limit returns the truncated copy of span and the applied truncations, the
+// copy is nil if the span can't be truncated to the max payload size.
+func (l *SpanLimiter) limit(span *model.Span) (*model.Span, []string) {
+	warnings := []string{}
+	limited := *span
+
+	if l.limits.MaxLogs > 0 && len(span.Logs) > l.limits.MaxLogs {
+		warnings = append(warnings, fmt.Sprintf("span truncated: dropped %d of %d logs", len(span.Logs)-l.limits.MaxLogs, len(span.Logs)))
+		limited.Logs = span.Logs[:l.limits.MaxLogs]
+	}
+
+	if l.limits.MaxTagValueLength > 0 {
+		if truncated := truncateSpanTagValues(&limited, l.limits.MaxTagValueLength); truncated > 0 {
+			warnings = append(warnings, fmt.Sprintf("span truncated: cut %d tag values to %d bytes", truncated, l.limits.MaxTagValueLength))
+		}
+	}
+
+	if l.limits.MaxPayloadSize <= 0 || l.fitsPayloadSize(&limited) {
+		return &limited, warnings
+	}
+
+	if l.limits.Policy == SizeLimitPolicyDrop {
+		return nil, append(warnings, "span exceeds the max payload size")
+	}
+
+	// Logs usually contain the largest values, e.g. stack traces
+	if len(limited.Logs) > 0 {
+		warnings = append(warnings, fmt.Sprintf("span truncated: dropped all %d logs to fit the max payload size", len(limited.Logs)))
+		limited.Logs = nil
+
+		if l.fitsPayloadSize(&limited) {
+			return &limited, warnings
+		}
+	}
+
+	if truncated := truncateSpanTagValues(&limited, truncatedPayloadTagValueLength); truncated > 0 {
+		warnings = append(warnings, fmt.Sprintf("span truncated: cut %d tag values to %d bytes to fit the max payload size", truncated, truncatedPayloadTagValueLength))
+
+		if l.fitsPayloadSize(&limited) {
+			return &limited, warnings
+		}
+	}
+
+	return nil, append(warnings, "span exceeds the max payload size")
+}
+
+func (l *SpanLimiter) fitsPayloadSize(span *model.Span) bool {
+	payload, err := EncodeSpanPayload(span, l.codec)
+	if err != nil {
+		// Encoding errors are reported when writing the span
+		return true
+	}
+
+	return len(payload) <= l.limits.MaxPayloadSize
+}
+
+// truncateSpanTagValues cuts the string and binary values of all tags, process
+// tags and log fields of span to maxLength bytes. Modified slices are copied,
+// so the values of the original span are left untouched.
+func truncateSpanTagValues(span *model.Span, maxLength int) int {
+	truncated := 0
+
+	var tags []model.KeyValue
+	tags, truncated = truncateKeyValues(span.Tags, maxLength, truncated)
+	span.Tags = tags
+
+	if span.Process != nil {
+		processTags, processTruncated := truncateKeyValues(span.Process.Tags, maxLength, truncated)
+		if processTruncated > truncated {
+			process := *span.Process
+			process.Tags = processTags
+			span.Process = &process
+			truncated = processTruncated
+		}
+	}
+
+	var logs []model.Log
+	for i, log := range span.Logs {
+		fields, logTruncated := truncateKeyValues(log.Fields, maxLength, truncated)
+		if logTruncated == truncated {
+			continue
+		}
+
+		if logs == nil {
+			logs = append([]model.Log{}, span.Logs...)
+		}
+		logs[i] = model.Log{Timestamp: log.Timestamp, Fields: fields}
+		truncated = logTruncated
+	}
+	if logs != nil {
+		span.Logs = logs
+	}
+
+	return truncated
+}
+
+func truncateKeyValues(kvs []model.KeyValue, maxLength int, truncated int) ([]model.KeyValue, int) {
+	var result []model.KeyValue
+	for i, kv := range kvs {
+		switch {
+		case kv.VType == model.StringType && len(kv.VStr) > maxLength:
+			kv = model.String(kv.Key, truncateString(kv.VStr, maxLength))
+		case kv.VType == model.BinaryType && len(kv.VBinary) > maxLength:
+			kv = model.Binary(kv.Key, kv.VBinary[:maxLength])
+		default:
+			continue
+		}
+
+		if result == nil {
+			result = append([]model.KeyValue{}, kvs...)
+		}
+		result[i] = kv
+		truncated++
+	}
+
+	if result == nil {
+		return kvs, truncated
+	}
+	return result, truncated
+}
+
+// truncateString cuts value to at most maxLength bytes without splitting a rune.
+func truncateString(value string, maxLength int) string {
+	for maxLength > 0 && !utf8.RuneStart(value[maxLength]) {
+		maxLength--
+	}
+
+	return value[:maxLength]
+}
@@ -0,0 +1,138 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func NewTestSpanLimiter(t *testing.T, s3Config config.S3) *SpanLimiter {
+	limits, err := NewSpanLimits(s3Config)
+	assert.NoError(t, err)
+
+	codec, err := NewSpanPayloadCodec(PayloadCodecJaegerJSON)
+	assert.NoError(t, err)
+
+	return NewSpanLimiter(hclog.NewNullLogger(), limits, codec)
+}
+
+func TestSpanLimiterTruncates(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := NewTestSpanLimiter(t, config.S3{MaxTagValueLength: 4, MaxLogs: 1})
+
+	span := NewTestCodecSpan()
+	span.Tags = append(span.Tags, model.String("order", "café au lait"))
+	span.Logs = append(span.Logs, span.Logs[0])
+
+	limited, keep := limiter.Limit(span)
+	assert.True(keep)
+
+	tags := kvToMap(limited.Tags)
+	assert.Equal("GET", tags["http.method"])
+	// Runes are never split
+	assert.Equal("caf", tags["order"])
+	assert.Equal("serv", tags["span.kind"])
+	assert.Equal("loca", kvToMap(limited.Process.Tags)["hostname"])
+	assert.Len(limited.Logs, 1)
+	assert.Equal("fail", kvToMap(limited.Logs[0].Fields)["message"])
+	assert.Equal([]string{
+		"span truncated: dropped 1 of 2 logs",
+		"span truncated: cut 5 tag values to 4 bytes",
+	}, limited.Warnings)
+
+	// The original span is left untouched
+	assert.Equal("café au lait", kvToMap(span.Tags)["order"])
+	assert.Equal("localhost", kvToMap(span.Process.Tags)["hostname"])
+	assert.Len(span.Logs, 2)
+	assert.Equal("failed", kvToMap(span.Logs[0].Fields)["message"])
+	assert.Empty(span.Warnings)
+
+	assert.Equal(uint64(1), limiter.Truncated())
+	assert.Equal(uint64(0), limiter.Dropped())
+
+	// Spans within the limits are passed through
+	span = NewTestCodecSpan()
+	span.Tags = nil
+	span.Process.Tags = nil
+	span.Logs = nil
+
+	limited, keep = limiter.Limit(span)
+	assert.True(keep)
+	assert.Same(span, limited)
+	assert.Equal(uint64(1), limiter.Truncated())
+}
+
+func TestSpanLimiterMaxPayloadSize(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := NewTestSpanLimiter(t, config.S3{MaxPayloadSize: 2000})
+
+	// Logs are dropped first
+	span := NewTestCodecSpan()
+	span.Logs[0].Fields = append(span.Logs[0].Fields, model.String("stack", strings.Repeat("a", 10000)))
+
+	limited, keep := limiter.Limit(span)
+	assert.True(keep)
+	assert.Empty(limited.Logs)
+	assert.Equal("GET", kvToMap(limited.Tags)["http.method"])
+
+	// Tag values are cut next
+	span = NewTestCodecSpan()
+	span.Tags = append(span.Tags, model.String("sql", strings.Repeat("a", 10000)))
+
+	limited, keep = limiter.Limit(span)
+	assert.True(keep)
+	assert.Len(kvToMap(limited.Tags)["sql"], truncatedPayloadTagValueLength)
+
+	// Spans still exceeding the limit are dropped
+	span = NewTestCodecSpan()
+	for i := 0; i < 100; i++ {
+		span.Tags = append(span.Tags, model.String(fmt.Sprintf("tag.%d", i), strings.Repeat("a", 1000)))
+	}
+
+	_, keep = limiter.Limit(span)
+	assert.False(keep)
+
+	assert.Equal(uint64(2), limiter.Truncated())
+	assert.Equal(uint64(1), limiter.Dropped())
+}
+
+func TestSpanLimiterDropPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := NewTestSpanLimiter(t, config.S3{MaxLogs: 1, SizeLimitPolicy: SizeLimitPolicyDrop})
+
+	span := NewTestCodecSpan()
+	_, keep := limiter.Limit(span)
+	assert.True(keep)
+
+	span.Logs = append(span.Logs, span.Logs[0])
+	_, keep = limiter.Limit(span)
+	assert.False(keep)
+
+	assert.Equal(uint64(0), limiter.Truncated())
+	assert.Equal(uint64(1), limiter.Dropped())
+
+	var noLimiter *SpanLimiter
+	limited, keep := noLimiter.Limit(span)
+	assert.True(keep)
+	assert.Same(span, limited)
+}
+
+func TestNewSpanLimitsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	limits, err := NewSpanLimits(config.S3{})
+	assert.NoError(err)
+	assert.Equal(SizeLimitPolicyTruncate, limits.Policy)
+	assert.Nil(NewSpanLimiter(hclog.NewNullLogger(), limits, nil))
+
+	_, err = NewSpanLimits(config.S3{SizeLimitPolicy: "ignore"})
+	assert.Error(err)
+}
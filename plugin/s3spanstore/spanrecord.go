@@ -1,29 +1,84 @@
 package s3spanstore
 
 import (
-	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"math"
+	"time"
 
-	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/jaegertracing/jaeger/model"
 )
 
 // SpanRecord contains queryable properties from the span and the span as json payload
 type SpanRecord struct {
-	TraceID       string            `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
-	SpanID        string            `parquet:"name=span_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
-	OperationName string            `parquet:"name=operation_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
-	SpanKind      string            `parquet:"name=span_kind, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
-	StartTime     int64             `parquet:"name=start_time, type=INT64"`
-	Duration      int64             `parquet:"name=duration, type=INT64"`
-	Tags          map[string]string `parquet:"name=tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
-	ServiceName   string            `parquet:"name=service_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	TraceID       string `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	SpanID        string `parquet:"name=span_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	OperationName string `parquet:"name=operation_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	SpanKind      string `parquet:"name=span_kind, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	StartTime     int64  `parquet:"name=start_time, type=INT64"`
+	Duration      int64  `parquet:"name=duration, type=INT64"`
+	// Tags is deprecated and only written if LegacyTagsMap is enabled, rows
+	// written before the tag sources were split only contain this map
+	Tags        map[string]string `parquet:"name=tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	ServiceName string            `parquet:"name=service_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
 
-	// TODO: Write binary
-	SpanPayload string                 `parquet:"name=span_payload, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
-	References  []SpanRecordReferences `parquet:"name=references"`
+	// SpanTags, ProcessTags and LogFields contain the string values by source,
+	// while Tags and the typed maps merge all sources, preferring span tags over
+	// process tags over log fields. The typed maps therefore don't tell the
+	// source, which is only known from the string maps.
+	SpanTags    map[string]string `parquet:"name=span_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	ProcessTags map[string]string `parquet:"name=process_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	LogFields   map[string]string `parquet:"name=log_fields, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+
+	// IntTags, DoubleTags and BoolTags contain the tags of the respective type,
+	// which are additionally stored as string in Tags. NaN and ±Inf floats are
+	// only stored as string
+	IntTags    map[string]int64   `parquet:"name=int_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=INT64"`
+	DoubleTags map[string]float64 `parquet:"name=double_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=DOUBLE"`
+	BoolTags   map[string]bool    `parquet:"name=bool_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BOOLEAN"`
+
+	// PayloadVersion marks the layout of the span payload, files written before it was introduced read as 0
+	PayloadVersion int32 `parquet:"name=payload_version, type=INT32"`
+	// PayloadCodec is the SpanPayloadCodec of PayloadVersionBinary rows
+	PayloadCodec string `parquet:"name=payload_codec, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	// SpanPayload is the base64 encoded payload of PayloadVersionBase64 rows
+	SpanPayload string `parquet:"name=span_payload, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	// SpanPayloadBinary is the raw payload of PayloadVersionBinary rows
+	SpanPayloadBinary string                 `parquet:"name=span_payload_binary, type=BYTE_ARRAY, encoding=PLAIN"`
+	References        []SpanRecordReferences `parquet:"name=references"`
+}
+
+const (
+	// PayloadVersionBase64 rows store the snappy compressed protobuf span base64 encoded in span_payload
+	PayloadVersionBase64 int32 = 1
+	// PayloadVersionBinary rows store the span encoded by PayloadCodec in span_payload_binary
+	PayloadVersionBinary int32 = 2
+)
+
+// spanRecordJSON encodes the binary payload as base64, as JSON strings need to be valid UTF-8.
+type spanRecordJSON struct {
+	*spanRecordFields
+	SpanPayloadBinary []byte
+}
+
+type spanRecordFields SpanRecord
+
+func (r *SpanRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(spanRecordJSON{
+		spanRecordFields:  (*spanRecordFields)(r),
+		SpanPayloadBinary: []byte(r.SpanPayloadBinary),
+	})
+}
+
+func (r *SpanRecord) UnmarshalJSON(data []byte) error {
+	record := spanRecordJSON{spanRecordFields: (*spanRecordFields)(r)}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+
+	r.SpanPayloadBinary = string(record.SpanPayloadBinary)
+	return nil
 }
 
 type SpanRecordReferences struct {
@@ -46,82 +101,131 @@ func NewSpanRecordReferencesFromSpanReferences(span *model.Span) []SpanRecordRef
 	return spanRecordReferences
 }
 
-func EncodeSpanPayload(span *model.Span) (string, error) {
-	spanBytes, err := proto.Marshal(span)
-	if err != nil {
-		return "", fmt.Errorf("failed to serialize item: %w", err)
-	}
-
-	var b bytes.Buffer
-	b64 := base64.NewEncoder(base64.StdEncoding, &b)
-	sn := snappy.NewBufferedWriter(b64)
+// EncodeSpanPayload encodes span with codec.
+func EncodeSpanPayload(span *model.Span, codec SpanPayloadCodec) ([]byte, error) {
+	return codec.Encode(span)
+}
 
-	_, err = sn.Write(spanBytes)
+// DecodeSpanPayload decodes a payload created by EncodeSpanPayload with the named codec.
+func DecodeSpanPayload(codecName string, payload []byte) (*model.Span, error) {
+	codec, err := NewSpanPayloadCodec(codecName)
 	if err != nil {
-		return "", fmt.Errorf("failed to write compress span: %w", err)
+		return nil, err
 	}
 
-	if err = sn.Close(); err != nil {
-		return "", fmt.Errorf("failed to close compress span: %w", err)
-	}
-
-	if err = b64.Close(); err != nil {
-		return "", fmt.Errorf("failed to base64 span: %w", err)
-	}
-
-	return b.String(), nil
+	return codec.Decode(payload)
 }
 
-func DecodeSpanPayload(payload string) (*model.Span, error) {
+// DecodeSpanPayloadColumn decodes the base64 encoded payload of a row with the
+// given payload version and codec, as returned by Athena for SpanPayloadColumns.
+func DecodeSpanPayloadColumn(version int32, codecName string, payload string) (*model.Span, error) {
 	payloadBytes, err := base64.StdEncoding.DecodeString(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode payload: %w", err)
 	}
 
-	b := bytes.NewBuffer(payloadBytes)
-	r := snappy.NewReader(b)
-
-	var resB bytes.Buffer
-	_, err = resB.ReadFrom(r)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decompress payload: %w", err)
-	}
-
-	span := &model.Span{}
-	if err := proto.Unmarshal(resB.Bytes(), span); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal span: %w", err)
+	switch version {
+	// Rows without a version were written before binary payloads
+	case 0, PayloadVersionBase64:
+		return DecodeSpanPayload(PayloadCodecSnappyProto, payloadBytes)
+	case PayloadVersionBinary:
+		return DecodeSpanPayload(codecName, payloadBytes)
+	default:
+		return nil, fmt.Errorf("unknown payload version %d", version)
 	}
-	return span, nil
 }
 
-func NewSpanRecordFromSpan(span *model.Span) (*SpanRecord, error) {
-	searchableTags := append([]model.KeyValue{}, span.Tags...)
-	searchableTags = append(searchableTags, span.Process.Tags...)
+// SpanPayloadColumns selects the payload version, codec and the base64 encoded
+// payload of both old and new rows. Athena returns binary values as hex, so they
+// are converted to base64 like the old payload column.
+const SpanPayloadColumns = `COALESCE(payload_version, 0), COALESCE(payload_codec, ''), COALESCE(to_base64(span_payload_binary), span_payload)`
+
+func NewSpanRecordFromSpan(span *model.Span, codec SpanPayloadCodec) (*SpanRecord, error) {
+	logFields := []model.KeyValue{}
 	for _, log := range span.Logs {
-		searchableTags = append(searchableTags, log.Fields...)
+		logFields = append(logFields, log.Fields...)
 	}
 
-	spanPayload, err := EncodeSpanPayload(span)
+	// Later keys overwrite earlier ones, so span tags take precedence
+	mergedTags := append([]model.KeyValue{}, logFields...)
+	mergedTags = append(mergedTags, span.Process.Tags...)
+	mergedTags = append(mergedTags, span.Tags...)
+
+	spanPayload, err := EncodeSpanPayload(span, codec)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create span payload: %w", err)
 	}
 
 	kind, _ := span.GetSpanKind()
+	intTags, doubleTags, boolTags := kvToTypedMaps(mergedTags)
 
 	return &SpanRecord{
-		TraceID:       span.TraceID.String(),
-		SpanID:        span.SpanID.String(),
-		OperationName: span.OperationName,
-		SpanKind:      kind,
-		StartTime:     span.StartTime.UnixMilli(),
-		Duration:      span.Duration.Nanoseconds(),
-		Tags:          kvToMap(searchableTags),
-		ServiceName:   span.Process.ServiceName,
-		SpanPayload:   spanPayload,
-		References:    NewSpanRecordReferencesFromSpanReferences(span),
+		TraceID:           span.TraceID.String(),
+		SpanID:            span.SpanID.String(),
+		OperationName:     span.OperationName,
+		SpanKind:          kind,
+		StartTime:         recordTimestamp(span.StartTime),
+		Duration:          span.Duration.Nanoseconds(),
+		Tags:              map[string]string{},
+		ServiceName:       span.Process.ServiceName,
+		SpanTags:          kvToMap(span.Tags),
+		ProcessTags:       kvToMap(span.Process.Tags),
+		LogFields:         kvToMap(logFields),
+		IntTags:           intTags,
+		DoubleTags:        doubleTags,
+		BoolTags:          boolTags,
+		PayloadVersion:    PayloadVersionBinary,
+		PayloadCodec:      codec.Name(),
+		SpanPayloadBinary: string(spanPayload),
+		References:        NewSpanRecordReferencesFromSpanReferences(span),
 	}, nil
 }
 
+func (r *SpanRecord) GetServiceName() string {
+	return r.ServiceName
+}
+
+// LegacyTagsMap returns the deprecated merged tags map of the record.
+func (r *SpanRecord) LegacyTagsMap() map[string]string {
+	tags := map[string]string{}
+	for _, source := range []map[string]string{r.LogFields, r.ProcessTags, r.SpanTags} {
+		for key, value := range source {
+			tags[key] = value
+		}
+	}
+
+	return tags
+}
+
+// Tag returns the string value of key, preferring span tags over process tags
+// over log fields. Rows written before the tag sources were split only
+// contain the merged tags map.
+func (r *SpanRecord) Tag(key string) (string, bool) {
+	if r.SpanTags == nil {
+		value, ok := r.Tags[key]
+		return value, ok
+	}
+
+	for _, source := range []map[string]string{r.SpanTags, r.ProcessTags, r.LogFields} {
+		if value, ok := source[key]; ok {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// recordTimestamp converts t into milliseconds since epoch, the unit of all
+// timestamp columns.
+func recordTimestamp(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// recordTime converts a timestamp column value back into a time.
+func recordTime(timestamp int64) time.Time {
+	return time.UnixMilli(timestamp)
+}
+
 func kvToMap(kvs []model.KeyValue) map[string]string {
 	kvMap := map[string]string{}
 	for _, field := range kvs {
@@ -130,3 +234,26 @@ func kvToMap(kvs []model.KeyValue) map[string]string {
 
 	return kvMap
 }
+
+func kvToTypedMaps(kvs []model.KeyValue) (map[string]int64, map[string]float64, map[string]bool) {
+	intMap := map[string]int64{}
+	doubleMap := map[string]float64{}
+	boolMap := map[string]bool{}
+	for _, field := range kvs {
+		switch field.VType {
+		case model.Int64Type:
+			intMap[field.Key] = field.Int64()
+		case model.Float64Type:
+			// JSON can't encode NaN and ±Inf, they are only kept as string
+			if value := field.Float64(); !math.IsNaN(value) && !math.IsInf(value, 0) {
+				doubleMap[field.Key] = value
+			} else {
+				delete(doubleMap, field.Key)
+			}
+		case model.BoolType:
+			boolMap[field.Key] = field.Bool()
+		}
+	}
+
+	return intMap, doubleMap, boolMap
+}
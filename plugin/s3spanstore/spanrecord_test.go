@@ -0,0 +1,96 @@
+package s3spanstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeSpanPayloadColumn(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestSpan(assert)
+
+	snappyPayload, err := EncodeSpanPayload(span, &snappyProtoCodec{})
+	assert.NoError(err)
+	encodedSnappyPayload := base64.StdEncoding.EncodeToString(snappyPayload)
+
+	// Rows written before the payload version was introduced
+	legacySpan, err := DecodeSpanPayloadColumn(0, "", encodedSnappyPayload)
+	assert.NoError(err)
+	assert.Equal(span.OperationName, legacySpan.OperationName)
+
+	binarySpan, err := DecodeSpanPayloadColumn(PayloadVersionBinary, PayloadCodecSnappyProto, encodedSnappyPayload)
+	assert.NoError(err)
+	assert.Equal(span.OperationName, binarySpan.OperationName)
+
+	jsonPayload, err := EncodeSpanPayload(span, &jaegerJSONCodec{})
+	assert.NoError(err)
+
+	jsonSpan, err := DecodeSpanPayloadColumn(PayloadVersionBinary, PayloadCodecJaegerJSON, base64.StdEncoding.EncodeToString(jsonPayload))
+	assert.NoError(err)
+	assert.Equal(span.OperationName, jsonSpan.OperationName)
+
+	_, err = DecodeSpanPayloadColumn(99, "", encodedSnappyPayload)
+	assert.Error(err)
+
+	_, err = DecodeSpanPayloadColumn(PayloadVersionBinary, "unknown", encodedSnappyPayload)
+	assert.Error(err)
+}
+
+func TestSpanRecordJSONKeepsBinaryPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	record, err := NewSpanRecordFromSpan(NewTestSpan(assert), &snappyProtoCodec{})
+	assert.NoError(err)
+
+	data, err := json.Marshal(record)
+	assert.NoError(err)
+
+	decoded := &SpanRecord{}
+	assert.NoError(json.Unmarshal(data, decoded))
+	assert.Equal(record, decoded)
+}
+
+func TestNewSpanRecordFromSpanTagSources(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestCodecSpan()
+	span.Logs[0].Fields = append(span.Logs[0].Fields, model.Bool("error", false))
+	span.Process.Tags = append(span.Process.Tags, model.String("http.method", "POST"))
+
+	record, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.Equal("true", record.SpanTags["error"])
+	assert.Equal("false", record.LogFields["error"])
+	assert.Equal("GET", record.SpanTags["http.method"])
+	assert.Equal("POST", record.ProcessTags["http.method"])
+	assert.Equal(map[string]string{"hostname": "localhost", "http.method": "POST"}, record.ProcessTags)
+	assert.Equal(map[string]string{"event": "error", "message": "failed", "error": "false"}, record.LogFields)
+
+	// Span tags take precedence in the merged maps
+	assert.Empty(record.Tags)
+	assert.Equal("true", record.LegacyTagsMap()["error"])
+	assert.Equal("GET", record.LegacyTagsMap()["http.method"])
+	assert.Equal("localhost", record.LegacyTagsMap()["hostname"])
+	assert.Equal(true, record.BoolTags["error"])
+
+	value, ok := record.Tag("http.method")
+	assert.True(ok)
+	assert.Equal("GET", value)
+	value, ok = record.Tag("hostname")
+	assert.True(ok)
+	assert.Equal("localhost", value)
+	_, ok = record.Tag("unknown")
+	assert.False(ok)
+
+	// Rows written before the tag sources were split
+	legacyRecord := &SpanRecord{Tags: map[string]string{"http.method": "PUT"}}
+	value, ok = legacyRecord.Tag("http.method")
+	assert.True(ok)
+	assert.Equal("PUT", value)
+}
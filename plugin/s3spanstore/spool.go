@@ -0,0 +1,141 @@
+package s3spanstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+const spoolSegmentExtension = ".wal"
+
+// Spool is a local write-ahead log for rows, which are only buffered in memory
+// until their parquet file is uploaded. Every open parquet file has its own
+// segment, which is removed once the file was uploaded successfully.
+type Spool struct {
+	dir     string
+	rowType reflect.Type
+}
+
+type spoolRecord struct {
+	Time time.Time       `json:"time"`
+	Row  json.RawMessage `json:"row"`
+}
+
+func NewSpool(dir string, rowType interface{}) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	return &Spool{
+		dir:     dir,
+		rowType: reflect.TypeOf(rowType).Elem(),
+	}, nil
+}
+
+// Segments lists all segments currently present in the spool directory.
+func (s *Spool) Segments() ([]string, error) {
+	return filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExtension))
+}
+
+func (s *Spool) Create() (*SpoolSegment, error) {
+	path := filepath.Join(s.dir, RandStringBytes(32)+spoolSegmentExtension)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool segment: %w", err)
+	}
+
+	return &SpoolSegment{path: path, file: file}, nil
+}
+
+// ReadSegment calls fn for every row in the segment. Records are only written
+// with their trailing newline, so only a truncated final record, e.g. from a
+// killed process, is ignored. Any other undecodable record fails the read.
+func (s *Spool) ReadSegment(path string, fn func(rowTime time.Time, row interface{}) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read spool segment: %w", err)
+		}
+
+		var record spoolRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("failed to decode spool record: %w", err)
+		}
+
+		row := reflect.New(s.rowType).Interface()
+		if err := json.Unmarshal(record.Row, row); err != nil {
+			return fmt.Errorf("failed to decode spooled row: %w", err)
+		}
+
+		if err := fn(record.Time, row); err != nil {
+			return err
+		}
+	}
+}
+
+type SpoolSegment struct {
+	path string
+	file *os.File
+}
+
+func (s *SpoolSegment) Append(rowTime time.Time, row interface{}) error {
+	rowBytes, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("failed to encode row: %w", err)
+	}
+
+	recordBytes, err := json.Marshal(spoolRecord{Time: rowTime, Row: rowBytes})
+	if err != nil {
+		return fmt.Errorf("failed to encode spool record: %w", err)
+	}
+
+	// Write the record with a single syscall, so it survives a process crash
+	if _, err := s.file.Write(append(recordBytes, '\n')); err != nil {
+		return fmt.Errorf("failed to append to spool segment: %w", err)
+	}
+
+	return nil
+}
+
+// Sync flushes appended records to disk, so they also survive a power loss.
+func (s *SpoolSegment) Sync() error {
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool segment: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SpoolSegment) Close() error {
+	return s.file.Close()
+}
+
+// Remove closes and deletes the segment, once its rows are persisted elsewhere.
+func (s *SpoolSegment) Remove() error {
+	if err := s.file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("failed to close spool segment: %w", err)
+	}
+
+	if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("failed to remove spool segment: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package s3spanstore
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolAppendAndRead(t *testing.T) {
+	assert := assert.New(t)
+
+	spool, err := NewSpool(t.TempDir(), new(OperationRecord))
+	assert.NoError(err)
+
+	segment, err := spool.Create()
+	assert.NoError(err)
+
+	rowTime := time.Date(2021, 1, 30, 6, 34, 58, 0, time.UTC)
+	assert.NoError(segment.Append(rowTime, &OperationRecord{OperationName: "a", ServiceName: "service"}))
+	assert.NoError(segment.Append(rowTime, &OperationRecord{OperationName: "b", ServiceName: "service"}))
+	assert.NoError(segment.Sync())
+	assert.NoError(segment.Close())
+
+	segments, err := spool.Segments()
+	assert.NoError(err)
+	assert.Len(segments, 1)
+
+	rows := []interface{}{}
+	assert.NoError(spool.ReadSegment(segments[0], func(readRowTime time.Time, row interface{}) error {
+		assert.True(rowTime.Equal(readRowTime))
+		rows = append(rows, row)
+		return nil
+	}))
+
+	assert.Equal([]interface{}{
+		&OperationRecord{OperationName: "a", ServiceName: "service"},
+		&OperationRecord{OperationName: "b", ServiceName: "service"},
+	}, rows)
+}
+
+func TestSpoolReadIgnoresPartialRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	spool, err := NewSpool(t.TempDir(), new(OperationRecord))
+	assert.NoError(err)
+
+	segment, err := spool.Create()
+	assert.NoError(err)
+
+	assert.NoError(segment.Append(time.Now(), &OperationRecord{OperationName: "a"}))
+	_, err = segment.file.Write([]byte(`{"time":"2021-01-30T06:34:58Z","row":{"Operat`))
+	assert.NoError(err)
+	assert.NoError(segment.Close())
+
+	rows := 0
+	assert.NoError(spool.ReadSegment(segment.path, func(_ time.Time, _ interface{}) error {
+		rows++
+		return nil
+	}))
+	assert.Equal(1, rows)
+}
+
+func TestSpoolReadFailsOnCorruptRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	spool, err := NewSpool(t.TempDir(), new(OperationRecord))
+	assert.NoError(err)
+
+	segment, err := spool.Create()
+	assert.NoError(err)
+
+	assert.NoError(segment.Append(time.Now(), &OperationRecord{OperationName: "a"}))
+	_, err = segment.file.Write([]byte("{\"time\":\"2021-01-30T06:34:58Z\",\"row\":{\"Operat\n"))
+	assert.NoError(err)
+	assert.NoError(segment.Append(time.Now(), &OperationRecord{OperationName: "b"}))
+	assert.NoError(segment.Close())
+
+	rows := 0
+	assert.Error(spool.ReadSegment(segment.path, func(_ time.Time, _ interface{}) error {
+		rows++
+		return nil
+	}))
+	assert.Equal(1, rows)
+}
+
+func TestParquetWriterReplaysSpool(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	spoolDirectory := t.TempDir()
+
+	spool, err := NewSpool(spoolDirectory, new(SpanRecord))
+	assert.NoError(err)
+
+	span := NewTestSpan(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	segment, err := spool.Create()
+	assert.NoError(err)
+	assert.NoError(segment.Append(span.StartTime, spanRecord))
+	assert.NoError(segment.Close())
+
+	putTest := NewS3PutTest()
+	defer putTest.Clean()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		localTestObjects(putTest, assert)).Times(1)
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		SpoolDirectory: spoolDirectory,
+	})
+
+	// Replayed rows are uploaded right away and the segments removed
+	segments, err := spool.Segments()
+	assert.NoError(err)
+	assert.Empty(segments)
+
+	assert.NotEmpty(putTest.SpansFile())
+	_, err = os.Stat(putTest.SpansFile())
+	assert.NoError(err)
+
+	assert.NoError(writer.Close())
+}
+
+func TestParquetWriterRemovesSpoolSegmentAfterUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	spoolDirectory := t.TempDir()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.PutObjectOutput{}, nil).Times(1)
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		SpoolDirectory: spoolDirectory,
+	})
+
+	span := NewTestSpan(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+
+	segments, err := writer.spool.Segments()
+	assert.NoError(err)
+	assert.Len(segments, 1)
+
+	assert.NoError(writer.Close())
+
+	segments, err = writer.spool.Segments()
+	assert.NoError(err)
+	assert.Empty(segments)
+}
+
+func TestParquetWriterSpoolsNonFiniteFloatTags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.PutObjectOutput{}, nil).Times(1)
+
+	writer := NewTestParquetWriterWithOptions(ctx, assert, mockSvc, ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		SpoolDirectory: t.TempDir(),
+	})
+
+	span := NewTestSpan(assert)
+	span.Tags = append(span.Tags, model.Float64("ratio", math.NaN()), model.Float64("limit", math.Inf(1)), model.Float64("load", 0.5))
+	spanRecord, err := NewSpanRecordFromSpan(span, &snappyProtoCodec{})
+	assert.NoError(err)
+
+	assert.Equal(map[string]float64{"load": 0.5}, spanRecord.DoubleTags)
+	assert.Equal("NaN", spanRecord.SpanTags["ratio"])
+	assert.Equal("+Inf", spanRecord.SpanTags["limit"])
+
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	assert.NoError(writer.Close())
+}
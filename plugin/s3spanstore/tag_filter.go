@@ -0,0 +1,110 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	TagOperatorEqual          = "="
+	TagOperatorNotEqual       = "!="
+	TagOperatorGreater        = ">"
+	TagOperatorGreaterOrEqual = ">="
+	TagOperatorLess           = "<"
+	TagOperatorLessOrEqual    = "<="
+)
+
+// TagFilter is a single tag condition of a trace query
+type TagFilter struct {
+	Key      string
+	Operator string
+	Value    string
+}
+
+// tagKeyOperators are the operators whose `=` the Jaeger UI used to split the tag
+var tagKeyOperators = []struct {
+	suffix   string
+	operator string
+}{
+	{"!", TagOperatorNotEqual},
+	{">", TagOperatorGreaterOrEqual},
+	{"<", TagOperatorLessOrEqual},
+}
+
+// ParseTagFilter parses a tag of a trace query. The Jaeger UI splits tags at
+// the first `=`, so `http.status_code>=500` arrives as key `http.status_code>`
+// and value `500`. `duration_ms>100` doesn't contain `=` and arrives as key
+// `duration_ms>100` with the value `true`, it is only parsed as comparison if
+// the part after the operator is a number. Other keys match by equality.
+func ParseTagFilter(key string, value string) TagFilter {
+	for _, keyOperator := range tagKeyOperators {
+		if len(key) > len(keyOperator.suffix) && strings.HasSuffix(key, keyOperator.suffix) {
+			return TagFilter{Key: key[:len(key)-len(keyOperator.suffix)], Operator: keyOperator.operator, Value: value}
+		}
+	}
+
+	if value == "" || value == "true" {
+		if i := strings.IndexAny(key, "<>"); i > 0 {
+			if _, ok := numericTagLiteral(key[i+1:]); ok {
+				return TagFilter{Key: key[:i], Operator: key[i : i+1], Value: key[i+1:]}
+			}
+		}
+	}
+
+	return TagFilter{Key: key, Operator: TagOperatorEqual, Value: value}
+}
+
+// Condition returns the Athena condition of the filter. Equality matches the
+// string value of any span tag, process tag or log field, other operators
+// compare the typed tags.
+func (f TagFilter) Condition() (string, error) {
+	key := escapeTagLiteral(f.Key)
+
+	if f.Operator == TagOperatorEqual {
+		value := escapeTagLiteral(f.Value)
+
+		// Rows written before the tag sources were split only contain the merged tags
+		return fmt.Sprintf(`(element_at(span_tags, '%[1]s') = '%[2]s' OR element_at(process_tags, '%[1]s') = '%[2]s' OR element_at(log_fields, '%[1]s') = '%[2]s' OR (span_tags IS NULL AND element_at(tags, '%[1]s') = '%[2]s'))`, key, value), nil
+	}
+
+	switch f.Operator {
+	case TagOperatorNotEqual, TagOperatorGreater, TagOperatorGreaterOrEqual, TagOperatorLess, TagOperatorLessOrEqual:
+	default:
+		return "", fmt.Errorf("unknown tag operator %q", f.Operator)
+	}
+
+	if number, ok := numericTagLiteral(f.Value); ok {
+		return fmt.Sprintf(`(element_at(int_tags, '%s') %s %s OR element_at(double_tags, '%s') %s %s)`, key, f.Operator, number, key, f.Operator, number), nil
+	}
+
+	if f.Operator != TagOperatorNotEqual {
+		return "", fmt.Errorf("tag %s %s %s requires a numeric value", f.Key, f.Operator, f.Value)
+	}
+
+	// Only the literals written by the span record are compared as bool
+	if f.Value == "true" || f.Value == "false" {
+		return fmt.Sprintf(`element_at(bool_tags, '%s') != %s`, key, f.Value), nil
+	}
+
+	// Compares the value of the merged sources, rows written before the tag sources were split only contain the merged map
+	return fmt.Sprintf(`COALESCE(element_at(span_tags, '%[1]s'), element_at(process_tags, '%[1]s'), element_at(log_fields, '%[1]s'), element_at(tags, '%[1]s')) != '%[2]s'`, key, escapeTagLiteral(f.Value)), nil
+}
+
+// escapeTagLiteral escapes s for use inside an Athena string literal.
+func escapeTagLiteral(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+func numericTagLiteral(value string) (string, bool) {
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return strconv.FormatInt(number, 10), true
+	}
+
+	if number, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(number) && !math.IsInf(number, 0) {
+		return strconv.FormatFloat(number, 'g', -1, 64), true
+	}
+
+	return "", false
+}
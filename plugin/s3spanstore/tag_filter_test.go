@@ -0,0 +1,74 @@
+package s3spanstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTagFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(TagFilter{Key: "http.method", Operator: TagOperatorEqual, Value: "GET"}, ParseTagFilter("http.method", "GET"))
+	assert.Equal(TagFilter{Key: "http.status_code", Operator: TagOperatorGreaterOrEqual, Value: "500"}, ParseTagFilter("http.status_code>", "500"))
+	assert.Equal(TagFilter{Key: "retries", Operator: TagOperatorLessOrEqual, Value: "3"}, ParseTagFilter("retries<", "3"))
+	assert.Equal(TagFilter{Key: "error", Operator: TagOperatorNotEqual, Value: "true"}, ParseTagFilter("error!", "true"))
+	assert.Equal(TagFilter{Key: "duration_ms", Operator: TagOperatorGreater, Value: "100"}, ParseTagFilter("duration_ms>100", "true"))
+	assert.Equal(TagFilter{Key: "duration_ms", Operator: TagOperatorLess, Value: "1.5"}, ParseTagFilter("duration_ms<1.5", ""))
+
+	// Only numbers are parsed as strict comparisons
+	assert.Equal(TagFilter{Key: "title", Operator: TagOperatorEqual, Value: "true"}, ParseTagFilter("title", "true"))
+	assert.Equal(TagFilter{Key: "a<b", Operator: TagOperatorEqual, Value: "true"}, ParseTagFilter("a<b", "true"))
+	assert.Equal(TagFilter{Key: "duration_ms>100", Operator: TagOperatorEqual, Value: "yes"}, ParseTagFilter("duration_ms>100", "yes"))
+	assert.Equal(TagFilter{Key: ">", Operator: TagOperatorEqual, Value: "1"}, ParseTagFilter(">", "1"))
+	assert.Equal(TagFilter{Key: ">1", Operator: TagOperatorEqual, Value: "true"}, ParseTagFilter(">1", "true"))
+}
+
+func TestTagFilterCondition(t *testing.T) {
+	assert := assert.New(t)
+
+	condition, err := ParseTagFilter("http.method", "GET").Condition()
+	assert.NoError(err)
+	assert.Equal(`(element_at(span_tags, 'http.method') = 'GET' OR element_at(process_tags, 'http.method') = 'GET' OR element_at(log_fields, 'http.method') = 'GET' OR (span_tags IS NULL AND element_at(tags, 'http.method') = 'GET'))`, condition)
+
+	condition, err = ParseTagFilter("http.status_code>", "500").Condition()
+	assert.NoError(err)
+	assert.Equal(`(element_at(int_tags, 'http.status_code') >= 500 OR element_at(double_tags, 'http.status_code') >= 500)`, condition)
+
+	condition, err = ParseTagFilter("duration_ms>1.5", "true").Condition()
+	assert.NoError(err)
+	assert.Equal(`(element_at(int_tags, 'duration_ms') > 1.5 OR element_at(double_tags, 'duration_ms') > 1.5)`, condition)
+
+	condition, err = ParseTagFilter("error!", "true").Condition()
+	assert.NoError(err)
+	assert.Equal(`element_at(bool_tags, 'error') != true`, condition)
+
+	condition, err = ParseTagFilter("http.method!", "GET").Condition()
+	assert.NoError(err)
+	assert.Equal(`COALESCE(element_at(span_tags, 'http.method'), element_at(process_tags, 'http.method'), element_at(log_fields, 'http.method'), element_at(tags, 'http.method')) != 'GET'`, condition)
+
+	_, err = TagFilter{Key: "http.method", Operator: TagOperatorGreater, Value: "GET"}.Condition()
+	assert.Error(err)
+
+	_, err = ParseTagFilter("http.status_code>", "500 OR 1=1").Condition()
+	assert.Error(err)
+
+	_, err = TagFilter{Key: "http.status_code", Operator: "LIKE", Value: "5%"}.Condition()
+	assert.Error(err)
+}
+
+func TestTagFilterConditionEscapesLiterals(t *testing.T) {
+	assert := assert.New(t)
+
+	condition, err := ParseTagFilter("user's", "it's").Condition()
+	assert.NoError(err)
+	assert.Equal(`(element_at(span_tags, 'user''s') = 'it''s' OR element_at(process_tags, 'user''s') = 'it''s' OR element_at(log_fields, 'user''s') = 'it''s' OR (span_tags IS NULL AND element_at(tags, 'user''s') = 'it''s'))`, condition)
+
+	condition, err = ParseTagFilter("user's!", "' OR '1'='1").Condition()
+	assert.NoError(err)
+	assert.Equal(`COALESCE(element_at(span_tags, 'user''s'), element_at(process_tags, 'user''s'), element_at(log_fields, 'user''s'), element_at(tags, 'user''s')) != ''' OR ''1''=''1'`, condition)
+
+	condition, err = ParseTagFilter("it's<3", "true").Condition()
+	assert.NoError(err)
+	assert.Equal(`(element_at(int_tags, 'it''s') < 3 OR element_at(double_tags, 'it''s') < 3)`, condition)
+}
@@ -0,0 +1,60 @@
+package s3spanstore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+type tagKeysGetter interface {
+	GetTagKeys(ctx context.Context, serviceName string) ([]TagKey, error)
+}
+
+// TagKeysHandler serves the tag key catalog of a service as JSON, e.g.
+// GET /api/tag-keys?service=frontend returns {"data":[{"key":"http.method","values":["GET","POST"]}]}
+type TagKeysHandler struct {
+	logger hclog.Logger
+	reader tagKeysGetter
+}
+
+func NewTagKeysHandler(logger hclog.Logger, reader tagKeysGetter) *TagKeysHandler {
+	return &TagKeysHandler{logger: logger, reader: reader}
+}
+
+type tagKeysResponse struct {
+	Data  []TagKey `json:"data"`
+	Error string   `json:"error,omitempty"`
+}
+
+func (h *TagKeysHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		h.writeResponse(rw, http.StatusMethodNotAllowed, tagKeysResponse{Error: "method not allowed"})
+		return
+	}
+
+	serviceName := req.URL.Query().Get("service")
+	if serviceName == "" {
+		h.writeResponse(rw, http.StatusBadRequest, tagKeysResponse{Error: "service is required"})
+		return
+	}
+
+	tagKeys, err := h.reader.GetTagKeys(req.Context(), serviceName)
+	if err != nil {
+		h.logger.Error("failed to get tag keys", "service", serviceName, "error", err)
+		h.writeResponse(rw, http.StatusInternalServerError, tagKeysResponse{Error: "failed to get tag keys"})
+		return
+	}
+
+	h.writeResponse(rw, http.StatusOK, tagKeysResponse{Data: tagKeys})
+}
+
+func (h *TagKeysHandler) writeResponse(rw http.ResponseWriter, status int, response tagKeysResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+
+	if err := json.NewEncoder(rw).Encode(response); err != nil {
+		h.logger.Warn("failed to write tag keys response", "error", err)
+	}
+}
@@ -0,0 +1,55 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTagKeysGetter struct {
+	tagKeys []TagKey
+	err     error
+}
+
+func (g *testTagKeysGetter) GetTagKeys(ctx context.Context, serviceName string) ([]TagKey, error) {
+	return g.tagKeys, g.err
+}
+
+func TestTagKeysHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewTagKeysHandler(hclog.NewNullLogger(), &testTagKeysGetter{tagKeys: []TagKey{
+		{Key: "http.method", Values: []string{"GET", "POST"}},
+		{Key: "http.url"},
+	}})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/tag-keys?service=frontend", nil))
+
+	assert.Equal(200, recorder.Code)
+	assert.Equal("application/json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(`{"data":[{"key":"http.method","values":["GET","POST"]},{"key":"http.url"}]}`, recorder.Body.String())
+}
+
+func TestTagKeysHandlerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewTagKeysHandler(hclog.NewNullLogger(), &testTagKeysGetter{err: errors.New("athena unavailable")})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/tag-keys", nil))
+	assert.Equal(400, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/tag-keys?service=frontend", nil))
+	assert.Equal(405, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/tag-keys?service=frontend", nil))
+	assert.Equal(500, recorder.Code)
+	assert.JSONEq(`{"data":null,"error":"failed to get tag keys"}`, recorder.Body.String())
+}
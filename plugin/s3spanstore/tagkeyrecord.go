@@ -0,0 +1,123 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// TagKeyRecord is a tag key of a service with one of its values. Keys with too
+// many distinct or too long values are only recorded once with HighCardinality set.
+type TagKeyRecord struct {
+	ServiceName     string `parquet:"name=service_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Key             string `parquet:"name=key, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value           string `parquet:"name=value, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	HighCardinality bool   `parquet:"name=high_cardinality, type=BOOLEAN"`
+}
+
+func (r *TagKeyRecord) DedupeKey() string {
+	return fmt.Sprintf("%s/%s/%s/%t", r.ServiceName, r.Key, r.Value, r.HighCardinality)
+}
+
+func (r *TagKeyRecord) GetServiceName() string {
+	return r.ServiceName
+}
+
+const (
+	defaultTagKeysMaxValues      = 20
+	defaultTagKeysMaxValueLength = 64
+	// tagKeysTrackedKeys limits the memory used to count the values of keys
+	tagKeysTrackedKeys = 10000
+)
+
+// TagKeyCatalog creates the tag key records of spans and counts the distinct
+// values of every key, so only values of low-cardinality keys are recorded.
+type TagKeyCatalog struct {
+	maxValues      int
+	maxValueLength int
+
+	// Values seen per service and key, nil once the key has too many values
+	valuesMutex sync.Mutex
+	values      *lru.Cache
+}
+
+func NewTagKeyCatalog(maxValues int) (*TagKeyCatalog, error) {
+	if maxValues <= 0 {
+		maxValues = defaultTagKeysMaxValues
+	}
+
+	values, err := lru.New(tagKeysTrackedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tag values cache: %w", err)
+	}
+
+	return &TagKeyCatalog{
+		maxValues:      maxValues,
+		maxValueLength: defaultTagKeysMaxValueLength,
+		values:         values,
+	}, nil
+}
+
+// Records returns the records of all span tags, process tags and log fields.
+func (c *TagKeyCatalog) Records(span *model.Span) []*TagKeyRecord {
+	serviceName := span.Process.ServiceName
+	records := []*TagKeyRecord{}
+	seen := map[string]bool{}
+
+	add := func(kvs []model.KeyValue) {
+		for _, kv := range kvs {
+			value := kv.AsString()
+			if seen[kv.Key+"\x00"+value] {
+				continue
+			}
+			seen[kv.Key+"\x00"+value] = true
+
+			if c.isLowCardinality(serviceName, kv.Key, value) {
+				records = append(records, &TagKeyRecord{ServiceName: serviceName, Key: kv.Key, Value: value})
+			} else {
+				records = append(records, &TagKeyRecord{ServiceName: serviceName, Key: kv.Key, HighCardinality: true})
+			}
+		}
+	}
+
+	add(span.Tags)
+	add(span.Process.Tags)
+	for _, log := range span.Logs {
+		add(log.Fields)
+	}
+
+	return records
+}
+
+func (c *TagKeyCatalog) isLowCardinality(serviceName string, key string, value string) bool {
+	c.valuesMutex.Lock()
+	defer c.valuesMutex.Unlock()
+
+	cacheKey := serviceName + "\x00" + key
+
+	var values map[string]bool
+	if cached, ok := c.values.Get(cacheKey); ok {
+		values = cached.(map[string]bool)
+		if values == nil {
+			return false
+		}
+	} else {
+		values = map[string]bool{}
+	}
+
+	if values[value] {
+		return true
+	}
+
+	if len(values) >= c.maxValues || len(value) > c.maxValueLength {
+		c.values.Add(cacheKey, map[string]bool(nil))
+		return false
+	}
+
+	values[value] = true
+	c.values.Add(cacheKey, values)
+
+	return true
+}
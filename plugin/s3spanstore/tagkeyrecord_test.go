@@ -0,0 +1,59 @@
+package s3spanstore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagKeyCatalogRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	catalog, err := NewTagKeyCatalog(2)
+	assert.NoError(err)
+
+	span := &model.Span{
+		Process: model.NewProcess("frontend", []model.KeyValue{model.String("hostname", "a")}),
+		Tags: []model.KeyValue{
+			model.String("http.method", "GET"),
+			model.Int64("http.status_code", 200),
+			model.String("http.url", "https://example.com/"+strings.Repeat("a", 64)),
+		},
+		Logs: []model.Log{
+			{Fields: []model.KeyValue{model.String("event", "error")}},
+			{Fields: []model.KeyValue{model.String("event", "error")}},
+		},
+	}
+
+	assert.Equal([]*TagKeyRecord{
+		{ServiceName: "frontend", Key: "http.method", Value: "GET"},
+		{ServiceName: "frontend", Key: "http.status_code", Value: "200"},
+		{ServiceName: "frontend", Key: "http.url", HighCardinality: true},
+		{ServiceName: "frontend", Key: "hostname", Value: "a"},
+		{ServiceName: "frontend", Key: "event", Value: "error"},
+	}, catalog.Records(span))
+
+	// hostname exceeds the max values on the third distinct value
+	for _, hostname := range []string{"b", "a", "c", "a"} {
+		span.Process.Tags = []model.KeyValue{model.String("hostname", hostname)}
+		span.Tags = nil
+		span.Logs = nil
+
+		records := catalog.Records(span)
+		assert.Len(records, 1)
+
+		if hostname == "b" {
+			assert.Equal(&TagKeyRecord{ServiceName: "frontend", Key: "hostname", Value: "b"}, records[0])
+		} else if hostname == "c" {
+			assert.Equal(&TagKeyRecord{ServiceName: "frontend", Key: "hostname", HighCardinality: true}, records[0])
+		}
+	}
+
+	// Values are counted per service
+	span.Process = model.NewProcess("backend", []model.KeyValue{model.String("hostname", "c")})
+	assert.Equal([]*TagKeyRecord{
+		{ServiceName: "backend", Key: "hostname", Value: "c"},
+	}, catalog.Records(span))
+}
@@ -1,6 +1,10 @@
 package s3spanstore
 
-import "time"
+import (
+	"io"
+	"os"
+	"time"
+)
 
 func parseDurationWithDefault(stringDuration string, defaultDuration time.Duration) (time.Duration, error) {
 	var duration time.Duration
@@ -16,3 +20,33 @@ func parseDurationWithDefault(stringDuration string, defaultDuration time.Durati
 
 	return duration, nil
 }
+
+// moveFile renames a file and falls back to copying it, when source and target
+// are on different file systems.
+func moveFile(source string, target string) error {
+	if err := os.Rename(source, target); err == nil {
+		return nil
+	}
+
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	targetFile, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(targetFile, sourceFile); err != nil {
+		targetFile.Close()
+		return err
+	}
+
+	if err := targetFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(source)
+}
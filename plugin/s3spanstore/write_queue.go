@@ -0,0 +1,192 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+const (
+	// WriteQueueFullBlock blocks WriteSpan until the queue has space
+	WriteQueueFullBlock = "block"
+	// WriteQueueFullReject fails WriteSpan with ErrWriteQueueFull
+	WriteQueueFullReject = "reject"
+)
+
+const (
+	defaultWriteQueueWorkers   = 1
+	defaultWriteQueueBatchSize = 100
+)
+
+var (
+	ErrWriteQueueFull   = errors.New("write queue is full")
+	ErrWriteQueueClosed = errors.New("write queue is closed")
+)
+
+// WriteQueueOptions controls the asynchronous span write queue, a zero Size
+// writes spans synchronously.
+type WriteQueueOptions struct {
+	// Size is the maximum number of queued spans
+	Size int
+	// Workers is the number of goroutines writing queued spans
+	Workers int
+	// BatchSize is the maximum number of spans written at once
+	BatchSize int
+	// FullPolicy is either WriteQueueFullBlock or WriteQueueFullReject
+	FullPolicy string
+}
+
+func NewWriteQueueOptions(s3Config config.S3) (WriteQueueOptions, error) {
+	opts := WriteQueueOptions{
+		Size:       s3Config.WriteQueueSize,
+		Workers:    defaultWriteQueueWorkers,
+		BatchSize:  defaultWriteQueueBatchSize,
+		FullPolicy: WriteQueueFullBlock,
+	}
+
+	if s3Config.WriteQueueWorkers > 0 {
+		opts.Workers = s3Config.WriteQueueWorkers
+	}
+
+	if s3Config.WriteQueueBatchSize > 0 {
+		opts.BatchSize = s3Config.WriteQueueBatchSize
+	}
+
+	switch s3Config.WriteQueueFullPolicy {
+	case "":
+	case WriteQueueFullBlock, WriteQueueFullReject:
+		opts.FullPolicy = s3Config.WriteQueueFullPolicy
+	default:
+		return WriteQueueOptions{}, fmt.Errorf("unknown write queue full policy %q", s3Config.WriteQueueFullPolicy)
+	}
+
+	return opts, nil
+}
+
+// WriteQueue buffers spans in memory and writes them in batches using a fixed
+// number of workers, so WriteSpan callers don't contend on the parquet writers.
+// Errors of asynchronous writes can't be returned to the caller, they are
+// logged and the spans of the failed batch are counted as dropped.
+type WriteQueue struct {
+	logger hclog.Logger
+	ctx    context.Context
+	opts   WriteQueueOptions
+	write  func(ctx context.Context, spans []*model.Span) error
+
+	spans chan *model.Span
+	// closing unblocks Enqueue calls waiting for space, so Close can acquire closeLock
+	closing     chan struct{}
+	closingOnce sync.Once
+	closed      bool
+	closeLock   sync.RWMutex
+	workers     sync.WaitGroup
+}
+
+func NewWriteQueue(ctx context.Context, logger hclog.Logger, opts WriteQueueOptions, write func(ctx context.Context, spans []*model.Span) error) *WriteQueue {
+	q := &WriteQueue{
+		logger:  logger,
+		ctx:     ctx,
+		opts:    opts,
+		write:   write,
+		spans:   make(chan *model.Span, opts.Size),
+		closing: make(chan struct{}),
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+
+	return q
+}
+
+// Enqueue adds span to the queue. If the queue is full, it blocks until there
+// is space or ctx is done, or fails with ErrWriteQueueFull, depending on the
+// full policy.
+func (q *WriteQueue) Enqueue(ctx context.Context, span *model.Span) error {
+	q.closeLock.RLock()
+	defer q.closeLock.RUnlock()
+
+	if q.closed {
+		return ErrWriteQueueClosed
+	}
+
+	if q.opts.FullPolicy == WriteQueueFullReject {
+		select {
+		case q.spans <- span:
+			return nil
+		default:
+			spansDroppedTotal.With("queue_full").Inc()
+			return ErrWriteQueueFull
+		}
+	}
+
+	select {
+	case q.spans <- span:
+		return nil
+	case <-q.closing:
+		return ErrWriteQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *WriteQueue) work() {
+	defer q.workers.Done()
+
+	for span := range q.spans {
+		batch := []*model.Span{span}
+
+	fill:
+		for len(batch) < q.opts.BatchSize {
+			select {
+			case span, ok := <-q.spans:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, span)
+			default:
+				break fill
+			}
+		}
+
+		if err := q.write(q.ctx, batch); err != nil {
+			spansDroppedTotal.With("write_failure").Add(float64(len(batch)))
+			q.logger.Error("failed to write queued spans", "spans", len(batch), "error", err)
+		}
+	}
+}
+
+// Close stops accepting spans and waits until all queued spans are written or
+// ctx is done. Spans still queued once ctx is done continue to be written in
+// the background.
+func (q *WriteQueue) Close(ctx context.Context) error {
+	q.closingOnce.Do(func() {
+		close(q.closing)
+	})
+
+	q.closeLock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.spans)
+	}
+	q.closeLock.Unlock()
+
+	written := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to write queued spans: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,184 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSpanBatches struct {
+	lock    sync.Mutex
+	batches [][]*model.Span
+	release chan struct{}
+}
+
+func (b *testSpanBatches) write(ctx context.Context, spans []*model.Span) error {
+	if b.release != nil {
+		<-b.release
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.batches = append(b.batches, spans)
+	return nil
+}
+
+func (b *testSpanBatches) spans() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	spans := 0
+	for _, batch := range b.batches {
+		spans += len(batch)
+	}
+	return spans
+}
+
+func TestWriteQueueWritesBatches(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	batches := &testSpanBatches{release: make(chan struct{})}
+	queue := NewWriteQueue(ctx, hclog.NewNullLogger(), WriteQueueOptions{
+		Size:       10,
+		Workers:    1,
+		BatchSize:  5,
+		FullPolicy: WriteQueueFullBlock,
+	}, batches.write)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(queue.Enqueue(ctx, NewTestCodecSpan()))
+	}
+
+	close(batches.release)
+	assert.NoError(queue.Close(ctx))
+
+	assert.Equal(10, batches.spans())
+	for _, batch := range batches.batches {
+		assert.LessOrEqual(len(batch), 5)
+	}
+
+	assert.ErrorIs(queue.Enqueue(ctx, NewTestCodecSpan()), ErrWriteQueueClosed)
+}
+
+func TestWriteQueueRejectsWhenFull(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	batches := &testSpanBatches{release: make(chan struct{})}
+	queue := NewWriteQueue(ctx, hclog.NewNullLogger(), WriteQueueOptions{
+		Size:       1,
+		Workers:    1,
+		BatchSize:  1,
+		FullPolicy: WriteQueueFullReject,
+	}, batches.write)
+
+	dropped := spansDroppedTotal.With("queue_full").Value()
+
+	// The first span is taken by the blocked worker, the second fills the queue
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = queue.Enqueue(ctx, NewTestCodecSpan())
+	}
+	assert.ErrorIs(err, ErrWriteQueueFull)
+	assert.Equal(dropped+1, spansDroppedTotal.With("queue_full").Value())
+
+	close(batches.release)
+	assert.NoError(queue.Close(context.TODO()))
+}
+
+func TestWriteQueueCountsFailedWrites(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	dropped := spansDroppedTotal.With("write_failure").Value()
+
+	queue := NewWriteQueue(ctx, hclog.NewNullLogger(), WriteQueueOptions{
+		Size:       10,
+		Workers:    1,
+		BatchSize:  5,
+		FullPolicy: WriteQueueFullBlock,
+	}, func(ctx context.Context, spans []*model.Span) error {
+		return errors.New("service unavailable")
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(queue.Enqueue(ctx, NewTestCodecSpan()))
+	}
+	assert.NoError(queue.Close(ctx))
+
+	assert.Equal(dropped+3, spansDroppedTotal.With("write_failure").Value())
+}
+
+func TestWriteQueueBlocksUntilContextDone(t *testing.T) {
+	assert := assert.New(t)
+
+	batches := &testSpanBatches{release: make(chan struct{})}
+	queue := NewWriteQueue(context.TODO(), hclog.NewNullLogger(), WriteQueueOptions{
+		Size:       1,
+		Workers:    1,
+		BatchSize:  1,
+		FullPolicy: WriteQueueFullBlock,
+	}, batches.write)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = queue.Enqueue(ctx, NewTestCodecSpan())
+	}
+	assert.ErrorIs(err, context.Canceled)
+
+	close(batches.release)
+	assert.NoError(queue.Close(context.TODO()))
+}
+
+func TestWriteQueueCloseHonorsContext(t *testing.T) {
+	assert := assert.New(t)
+
+	batches := &testSpanBatches{release: make(chan struct{})}
+	queue := NewWriteQueue(context.TODO(), hclog.NewNullLogger(), WriteQueueOptions{
+		Size:       1,
+		Workers:    1,
+		BatchSize:  1,
+		FullPolicy: WriteQueueFullBlock,
+	}, batches.write)
+
+	// The first span blocks the worker, the second fills the queue and the
+	// third waits for space until the queue is closed
+	assert.NoError(queue.Enqueue(context.TODO(), NewTestCodecSpan()))
+	assert.NoError(queue.Enqueue(context.TODO(), NewTestCodecSpan()))
+	enqueued := make(chan error)
+	go func() {
+		enqueued <- queue.Enqueue(context.TODO(), NewTestCodecSpan())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*50)
+	defer cancel()
+	assert.ErrorIs(queue.Close(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(<-enqueued, ErrWriteQueueClosed)
+
+	close(batches.release)
+	assert.NoError(queue.Close(context.TODO()))
+	assert.Equal(2, batches.spans())
+}
+
+func TestNewWriteQueueOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	opts, err := NewWriteQueueOptions(config.S3{WriteQueueSize: 1000})
+	assert.NoError(err)
+	assert.Equal(WriteQueueOptions{Size: 1000, Workers: 1, BatchSize: 100, FullPolicy: WriteQueueFullBlock}, opts)
+
+	_, err = NewWriteQueueOptions(config.S3{WriteQueueFullPolicy: "drop"})
+	assert.Error(err)
+}
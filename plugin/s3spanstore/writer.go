@@ -2,8 +2,10 @@ package s3spanstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"path/filepath"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -29,10 +31,25 @@ type S3API interface {
 }
 
 type Writer struct {
-	logger hclog.Logger
+	logger       hclog.Logger
+	payloadCodec SpanPayloadCodec
 
 	spanParquetWriter       IParquetWriter
 	operationsParquetWriter *DedupeParquetWriter
+	// eventsParquetWriter is nil, unless an events prefix is configured
+	eventsParquetWriter IParquetWriter
+	// tagKeysParquetWriter is nil, unless a tag keys prefix is configured
+	tagKeysParquetWriter *DedupeParquetWriter
+	tagKeyCatalog        *TagKeyCatalog
+	// dependencyLinker is nil, unless a dependencies prefix is configured
+	dependencyLinker *DependencyLinker
+	// writeQueue is nil, if spans are written synchronously
+	writeQueue  *WriteQueue
+	spanFilter  *SpanFilter
+	redactor    *Redactor
+	spanLimiter *SpanLimiter
+	// legacyTagsMap additionally writes the deprecated merged tags map
+	legacyTagsMap bool
 }
 
 func EmptyBucket(ctx context.Context, svc S3API, bucketName string) error {
@@ -64,6 +81,9 @@ var (
 	defaultBufferDuration                        = time.Second * 60
 	defaultOperationsDedupeDuration              = time.Hour * 12
 	defaultOperationsDedupeRewriteBufferDuration = time.Hour * 1
+	defaultOperationsDedupeStateInterval         = time.Minute * 5
+	defaultSpoolSyncInterval                     = time.Second * 1
+	defaultTagKeysDedupeCacheSize                = 100000
 )
 
 func NewWriter(ctx context.Context, logger hclog.Logger, svc S3API, s3Config config.S3) (*Writer, error) {
@@ -89,31 +109,213 @@ func NewWriter(ctx context.Context, logger hclog.Logger, svc S3API, s3Config con
 		return nil, fmt.Errorf("failed to parse operation dedupe rewrite buffer duration: %w", err)
 	}
 
+	operationsDedupeStateInterval, err := parseDurationWithDefault(s3Config.OperationsDedupeStateInterval, defaultOperationsDedupeStateInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse operations dedupe state interval: %w", err)
+	}
+
+	spoolSyncInterval, err := parseDurationWithDefault(s3Config.SpoolSyncInterval, defaultSpoolSyncInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse spool sync interval: %w", err)
+	}
+
 	if s3Config.EmptyBucket {
 		if err := EmptyBucket(ctx, svc, s3Config.BucketName); err != nil {
 			return nil, fmt.Errorf("failed to empty s3 bucket: %w", err)
 		}
 	}
 
-	spanParquetWriter, err := NewParquetWriter(ctx, logger, svc, bufferDuration, s3Config.BucketName, s3Config.SpansPrefix, new(SpanRecord))
+	retryOptions, err := NewRetryOptions(s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upload retry options: %w", err)
+	}
+
+	deadLetterQueue, err := NewDeadLetterQueue(svc, s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dead letter queue: %w", err)
+	}
+
+	objectOptions, err := NewObjectOptions(s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse object options: %w", err)
+	}
+
+	payloadCodec, err := NewSpanPayloadCodec(s3Config.PayloadCodec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create payload codec: %w", err)
+	}
+
+	partitionScheme, err := NewPartitionScheme(s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse partition scheme: %w", err)
+	}
+
+	parquetOptions, err := NewParquetOptions(s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parquet options: %w", err)
+	}
+
+	spanFilter, err := NewSpanFilter(s3Config.SpanFilters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse span filters: %w", err)
+	}
+
+	redactor, err := NewRedactor(s3Config.RedactionRules, s3Config.RedactionHashKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redaction rules: %w", err)
+	}
+
+	notifier, err := NewFileNotifier(ctx, s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file notifier: %w", err)
+	}
+
+	spanLimits, err := NewSpanLimits(s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse span limits: %w", err)
+	}
+
+	writeQueueOptions, err := NewWriteQueueOptions(s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse write queue options: %w", err)
+	}
+
+	promotedTags, err := NewPromotedTagColumns(s3Config.PromotedTags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse promoted tags: %w", err)
+	}
+
+	parquetWriterOptions := ParquetWriterOptions{
+		PartitionScheme: partitionScheme,
+		BufferDuration:  bufferDuration,
+		MaxBytes:        s3Config.BufferMaxBytes,
+		MaxRows:         s3Config.BufferMaxRows,
+		SpoolSync:       spoolSyncInterval,
+		RetryOptions:    retryOptions,
+		ObjectOptions:   objectOptions,
+		DeadLetterQueue: deadLetterQueue,
+		ParquetOptions:  parquetOptions,
+		InstanceID:      s3Config.InstanceID,
+		ManifestsPrefix: s3Config.ManifestsPrefix,
+		Notifier:        notifier,
+	}
+
+	spanParquetWriterOptions := parquetWriterOptions
+	operationsParquetWriterOptions := parquetWriterOptions
+	eventsParquetWriterOptions := parquetWriterOptions
+	tagKeysParquetWriterOptions := parquetWriterOptions
+	dependenciesParquetWriterOptions := parquetWriterOptions
+	// Operations are always queried across all services
+	operationsParquetWriterOptions.PartitionScheme = partitionScheme.WithoutServicePartitioning()
+	tagKeysParquetWriterOptions.PartitionScheme = partitionScheme.WithoutServicePartitioning()
+	dependenciesParquetWriterOptions.PartitionScheme = partitionScheme.WithoutServicePartitioning()
+	if promotedTags != nil {
+		spanParquetWriterOptions.RowMapper = promotedTags
+	}
+	if s3Config.SpoolDirectory != "" {
+		spanParquetWriterOptions.SpoolDirectory = filepath.Join(s3Config.SpoolDirectory, "spans")
+		operationsParquetWriterOptions.SpoolDirectory = filepath.Join(s3Config.SpoolDirectory, "operations")
+		eventsParquetWriterOptions.SpoolDirectory = filepath.Join(s3Config.SpoolDirectory, "events")
+		tagKeysParquetWriterOptions.SpoolDirectory = filepath.Join(s3Config.SpoolDirectory, "tag-keys")
+		dependenciesParquetWriterOptions.SpoolDirectory = filepath.Join(s3Config.SpoolDirectory, "dependencies")
+	}
+	if s3Config.BufferDirectory != "" {
+		spanParquetWriterOptions.BufferDirectory = filepath.Join(s3Config.BufferDirectory, "spans")
+		operationsParquetWriterOptions.BufferDirectory = filepath.Join(s3Config.BufferDirectory, "operations")
+		eventsParquetWriterOptions.BufferDirectory = filepath.Join(s3Config.BufferDirectory, "events")
+		tagKeysParquetWriterOptions.BufferDirectory = filepath.Join(s3Config.BufferDirectory, "tag-keys")
+		dependenciesParquetWriterOptions.BufferDirectory = filepath.Join(s3Config.BufferDirectory, "dependencies")
+	}
+
+	spanParquetWriter, err := NewParquetWriter(ctx, logger, svc, spanParquetWriterOptions, s3Config.BucketName, s3Config.SpansPrefix, new(SpanRecord))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
 	}
 
-	operationsParquetWriter, err := NewParquetWriter(ctx, logger, svc, bufferDuration, s3Config.BucketName, s3Config.OperationsPrefix, new(OperationRecord))
+	operationsParquetWriter, err := NewParquetWriter(ctx, logger, svc, operationsParquetWriterOptions, s3Config.BucketName, s3Config.OperationsPrefix, new(OperationRecord))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
 	}
 
-	operationsDedupeParquetWriter, err := NewDedupeParquetWriter(logger, operationsDedupeDuration, operationsDedupeRewriteBufferDuration, operationsDedupeCacheSize, operationsParquetWriter)
+	operationsDedupeParquetWriter, err := NewDedupeParquetWriter(logger, "operations", operationsDedupeDuration, operationsDedupeRewriteBufferDuration, operationsDedupeCacheSize, operationsParquetWriter)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
 	}
 
+	if s3Config.OperationsDedupeStatePrefix != "" {
+		stateStore := NewDedupeStateStore(logger, svc, s3Config.BucketName, s3Config.OperationsDedupeStatePrefix, s3Config.InstanceID, operationsDedupeDuration, objectOptions)
+		operationsDedupeParquetWriter.WarmStart(ctx, stateStore, operationsDedupeStateInterval)
+	}
+
 	w := &Writer{
 		logger:                  logger,
+		payloadCodec:            payloadCodec,
 		operationsParquetWriter: operationsDedupeParquetWriter,
 		spanParquetWriter:       spanParquetWriter,
+		spanFilter:              spanFilter,
+		redactor:                redactor,
+		spanLimiter:             NewSpanLimiter(logger, spanLimits, payloadCodec),
+		legacyTagsMap:           s3Config.LegacyTagsMap,
+	}
+
+	if s3Config.EventsPrefix != "" {
+		eventsParquetWriter, err := NewParquetWriter(ctx, logger, svc, eventsParquetWriterOptions, s3Config.BucketName, s3Config.EventsPrefix, new(EventRecord))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create parquet writer: %w", err)
+		}
+		w.eventsParquetWriter = eventsParquetWriter
+	}
+
+	if s3Config.TagKeysPrefix != "" {
+		tagKeysDedupeCacheSize := defaultTagKeysDedupeCacheSize
+		if s3Config.TagKeysDedupeCacheSize > 0 {
+			tagKeysDedupeCacheSize = s3Config.TagKeysDedupeCacheSize
+		}
+
+		tagKeyCatalog, err := NewTagKeyCatalog(s3Config.TagKeysMaxValues)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tag key catalog: %w", err)
+		}
+
+		tagKeysParquetWriter, err := NewParquetWriter(ctx, logger, svc, tagKeysParquetWriterOptions, s3Config.BucketName, s3Config.TagKeysPrefix, new(TagKeyRecord))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create parquet writer: %w", err)
+		}
+
+		tagKeysDedupeParquetWriter, err := NewDedupeParquetWriter(logger, "tag_keys", operationsDedupeDuration, operationsDedupeRewriteBufferDuration, tagKeysDedupeCacheSize, tagKeysParquetWriter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create parquet writer: %w", err)
+		}
+
+		w.tagKeysParquetWriter = tagKeysDedupeParquetWriter
+		w.tagKeyCatalog = tagKeyCatalog
+	}
+
+	if s3Config.DependenciesPrefix != "" {
+		linkTimeout, err := parseDurationWithDefault(s3Config.DependenciesLinkTimeout, defaultDependenciesLinkTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dependencies link timeout: %w", err)
+		}
+
+		dependenciesParquetWriter, err := NewParquetWriter(ctx, logger, svc, dependenciesParquetWriterOptions, s3Config.BucketName, s3Config.DependenciesPrefix, new(DependencyRecord))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create parquet writer: %w", err)
+		}
+
+		dependencyLinker, err := NewDependencyLinker(ctx, logger, DependencyLinkerOptions{
+			SpanCacheSize:   s3Config.DependenciesSpanCacheSize,
+			LinkTimeout:     linkTimeout,
+			FlushInterval:   bufferDuration,
+			PartitionScheme: dependenciesParquetWriterOptions.PartitionScheme,
+		}, dependenciesParquetWriter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create dependency linker: %w", err)
+		}
+		w.dependencyLinker = dependencyLinker
+	}
+
+	if writeQueueOptions.Size > 0 {
+		w.writeQueue = NewWriteQueue(ctx, logger, writeQueueOptions, w.writeSpans)
 	}
 
 	return w, nil
@@ -122,55 +324,165 @@ func NewWriter(ctx context.Context, logger hclog.Logger, svc S3API, s3Config con
 func (w *Writer) WriteSpan(ctx context.Context, span *model.Span) error {
 	// s.logger.Debug("WriteSpan", span)
 
+	if !w.spanFilter.Keep(span) {
+		spansDroppedTotal.With("filter").Inc()
+		return nil
+	}
+
+	// Redact before the span is queued, encoded or flattened into records
+	span = w.redactor.Redact(span)
+
+	span, keep := w.spanLimiter.Limit(span)
+	if !keep {
+		return nil
+	}
+
+	if w.writeQueue != nil {
+		return w.writeQueue.Enqueue(ctx, span)
+	}
+
+	return w.writeSpans(ctx, []*model.Span{span})
+}
+
+func (w *Writer) writeSpans(ctx context.Context, spans []*model.Span) error {
 	g, gCtx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
-		operationRecord, err := NewOperationRecordFromSpan(span)
-		if err != nil {
-			return fmt.Errorf("failed to create operation record: %w", err)
-		}
+		for _, span := range spans {
+			operationRecord, err := NewOperationRecordFromSpan(span)
+			if err != nil {
+				return fmt.Errorf("failed to create operation record: %w", err)
+			}
 
-		if err := w.operationsParquetWriter.Write(gCtx, span.StartTime, span.StartTime, operationRecord); err != nil {
-			return fmt.Errorf("failed to write operation item: %w", err)
+			if err := w.operationsParquetWriter.Write(gCtx, span.StartTime, span.StartTime, operationRecord); err != nil {
+				return fmt.Errorf("failed to write operation item: %w", err)
+			}
 		}
 
 		return nil
 	})
 
 	g.Go(func() error {
-		spanRecord, err := NewSpanRecordFromSpan(span)
-		if err != nil {
-			return fmt.Errorf("failed to create span record: %w", err)
+		rows := make([]ParquetRow, len(spans))
+		for i, span := range spans {
+			spanRecord, err := NewSpanRecordFromSpan(span, w.payloadCodec)
+			if err != nil {
+				return fmt.Errorf("failed to create span record: %w", err)
+			}
+			if w.legacyTagsMap {
+				spanRecord.Tags = spanRecord.LegacyTagsMap()
+			}
+
+			rows[i] = ParquetRow{Time: span.StartTime, MaxBufferUntil: span.StartTime, Row: spanRecord}
 		}
 
-		if err := w.spanParquetWriter.Write(gCtx, span.StartTime, span.StartTime, spanRecord); err != nil {
+		if err := w.spanParquetWriter.WriteRows(gCtx, rows); err != nil {
 			return fmt.Errorf("failed to write span item: %w", err)
 		}
 
 		return nil
 	})
 
-	return g.Wait()
+	if w.tagKeysParquetWriter != nil {
+		g.Go(func() error {
+			for _, span := range spans {
+				for _, tagKeyRecord := range w.tagKeyCatalog.Records(span) {
+					if err := w.tagKeysParquetWriter.Write(gCtx, span.StartTime, span.StartTime, tagKeyRecord); err != nil {
+						return fmt.Errorf("failed to write tag key item: %w", err)
+					}
+				}
+			}
+
+			return nil
+		})
+	}
+
+	if w.eventsParquetWriter != nil {
+		g.Go(func() error {
+			rows := []ParquetRow{}
+			for _, span := range spans {
+				for _, eventRecord := range NewEventRecordsFromSpan(span) {
+					rows = append(rows, ParquetRow{Time: recordTime(eventRecord.Timestamp), MaxBufferUntil: span.StartTime, Row: eventRecord})
+				}
+			}
+
+			if len(rows) == 0 {
+				return nil
+			}
+
+			if err := w.eventsParquetWriter.WriteRows(gCtx, rows); err != nil {
+				return fmt.Errorf("failed to write event item: %w", err)
+			}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if w.dependencyLinker != nil {
+		w.dependencyLinker.Add(spans)
+	}
+
+	spansWrittenTotal.With().Add(float64(len(spans)))
+
+	return nil
 }
 
 func (w *Writer) Close() error {
-	g := errgroup.Group{}
+	return w.Shutdown(context.Background())
+}
 
-	g.Go(func() error {
-		if err := w.spanParquetWriter.Close(); err != nil {
-			return fmt.Errorf("failed to close parquet writer: %w", err)
-		}
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
 
-		return nil
-	})
+// Shutdown writes all queued spans and flushes the spans, operations and events
+// files in parallel. Spans still queued and uploads still running once ctx is
+// done are aborted.
+func (w *Writer) Shutdown(ctx context.Context) error {
+	shutdownErrs := []error{}
 
-	g.Go(func() error {
-		if err := w.operationsParquetWriter.Close(); err != nil {
-			return fmt.Errorf("failed to close parquet writer: %w", err)
+	// Write all queued spans before closing the parquet writers
+	if w.writeQueue != nil {
+		if err := w.writeQueue.Close(ctx); err != nil {
+			shutdownErrs = append(shutdownErrs, err)
 		}
+	}
 
-		return nil
-	})
+	parquetWriters := map[string]shutdowner{
+		"spans":      w.spanParquetWriter,
+		"operations": w.operationsParquetWriter,
+	}
+	if w.eventsParquetWriter != nil {
+		parquetWriters["events"] = w.eventsParquetWriter
+	}
+	if w.tagKeysParquetWriter != nil {
+		parquetWriters["tag keys"] = w.tagKeysParquetWriter
+	}
+	if w.dependencyLinker != nil {
+		parquetWriters["dependencies"] = w.dependencyLinker
+	}
+
+	errs := make(chan error, len(parquetWriters))
+	for name, parquetWriter := range parquetWriters {
+		go func(name string, parquetWriter shutdowner) {
+			if err := parquetWriter.Shutdown(ctx); err != nil {
+				errs <- fmt.Errorf("failed to close %s parquet writer: %w", name, err)
+				return
+			}
+
+			errs <- nil
+		}(name, parquetWriter)
+	}
+
+	for range parquetWriters {
+		if err := <-errs; err != nil {
+			shutdownErrs = append(shutdownErrs, err)
+		}
+	}
 
-	return g.Wait()
+	return errors.Join(shutdownErrs...)
 }
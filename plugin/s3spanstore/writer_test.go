@@ -2,6 +2,7 @@ package s3spanstore
 
 import (
 	"context"
+	"encoding/base64"
 	"io"
 	"os"
 	"strings"
@@ -202,7 +203,9 @@ func TestWriteSpan(t *testing.T) {
 	assert.Equal(int64(100000), record.Duration)
 	assert.Equal(map[string]string{}, record.Tags)
 	assert.Equal("example-service-1", record.ServiceName)
-	assert.Equal("/wYAAHNOYVBwWQBZAAB5D7oLeggKEAA2AQAIERIIDRGwAxoTZXhhbXBsZS1vcGVyYXRpb24tMTIMCOfPqMQFELjvjrECOgQQoI0GSg4KMhYAAEo6EAAMUhMKERFLIHNlcnZpY2UtMQ==", record.SpanPayload)
+	assert.Equal(PayloadVersionBinary, record.PayloadVersion)
+	assert.Equal("", record.SpanPayload)
+	assert.Equal("/wYAAHNOYVBwWQBZAAB5D7oLeggKEAA2AQAIERIIDRGwAxoTZXhhbXBsZS1vcGVyYXRpb24tMTIMCOfPqMQFELjvjrECOgQQoI0GSg4KMhYAAEo6EAAMUhMKERFLIHNlcnZpY2UtMQ==", base64.StdEncoding.EncodeToString([]byte(record.SpanPayloadBinary)))
 	assert.Equal([]SpanRecordReferences{}, record.References)
 
 	pr.ReadStop()
@@ -233,6 +236,10 @@ func (p *S3PutTest) OperationsFile() string {
 	return p.FileWithPrefix("/operations")
 }
 
+func (p *S3PutTest) EventsFile() string {
+	return p.FileWithPrefix("/events")
+}
+
 func (p *S3PutTest) FileWithPrefix(prefix string) string {
 	spansFile := ""
 	for _, object := range p.objects {
@@ -348,7 +355,13 @@ func TestWriteSpanWithTagsAndReferences(t *testing.T) {
 	assert.Equal(int64(2000), record.Duration)
 	assert.Equal(map[string]string{
 		"blob": "00003039", "sameplacetag1": "sameplacevalue", "sameplacetag2": "123", "sameplacetag3": "72.5", "sameplacetag4": "true",
-	}, record.Tags)
+	}, record.SpanTags)
+	assert.Empty(record.Tags)
+	assert.Equal(map[string]string{}, record.ProcessTags)
+	assert.Equal(map[string]string{}, record.LogFields)
+	assert.Equal(map[string]int64{"sameplacetag2": 123}, record.IntTags)
+	assert.Equal(map[string]float64{"sameplacetag3": 72.5}, record.DoubleTags)
+	assert.Equal(map[string]bool{"sameplacetag4": true}, record.BoolTags)
 	assert.Equal("query12-service", record.ServiceName)
 	assert.Equal([]SpanRecordReferences{
 		{TraceID: "00000000000000ff", SpanID: "00000000000000ff", RefType: 0},
@@ -358,6 +371,202 @@ func TestWriteSpanWithTagsAndReferences(t *testing.T) {
 	assert.NoError(localFileReader.Close())
 }
 
+func TestWriteSpanWithLegacyTagsMap(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	putTest := NewS3PutTest()
+	defer putTest.Clean()
+
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		localTestObjects(putTest, assert)).Times(2)
+
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), mockSvc, config.S3{
+		BucketName:       "jaeger-spans",
+		SpansPrefix:      "/spans/",
+		OperationsPrefix: "/operations/",
+		LegacyTagsMap:    true,
+	})
+	assert.NoError(err)
+
+	assert.NoError(writer.WriteSpan(ctx, NewTestSpanWithTagsAndReferences(assert)))
+	assert.NoError(writer.Close())
+
+	localFileReader, err := local.NewLocalFileReader(putTest.SpansFile())
+	assert.NoError(err)
+	pr, err := reader.NewParquetReader(localFileReader, new(SpanRecord), 1)
+	assert.NoError(err)
+
+	records := make([]SpanRecord, 1)
+	assert.NoError(pr.Read(&records))
+
+	assert.Equal(map[string]string{
+		"blob": "00003039", "sameplacetag1": "sameplacevalue", "sameplacetag2": "123", "sameplacetag3": "72.5", "sameplacetag4": "true",
+	}, records[0].Tags)
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+}
+
+func TestWriteSpanEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	putTest := NewS3PutTest()
+	defer putTest.Clean()
+
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		localTestObjects(putTest, assert)).Times(3)
+
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), mockSvc, config.S3{
+		BucketName:       "jaeger-spans",
+		SpansPrefix:      "/spans/",
+		OperationsPrefix: "/operations/",
+		EventsPrefix:     "/events/",
+	})
+	assert.NoError(err)
+
+	assert.NoError(writer.WriteSpan(ctx, NewTestCodecSpan()))
+	assert.NoError(writer.Close())
+
+	eventsFile := putTest.EventsFile()
+	assert.NotEmpty(eventsFile)
+
+	localFileReader, err := local.NewLocalFileReader(eventsFile)
+	assert.NoError(err)
+	pr, err := reader.NewParquetReader(localFileReader, new(EventRecord), 1)
+	assert.NoError(err)
+
+	records := make([]EventRecord, pr.GetNumRows())
+	assert.NoError(pr.Read(&records))
+
+	assert.Equal([]EventRecord{
+		{
+			TraceID:       "00000000000000010000000000000011",
+			SpanID:        "0000000000000003",
+			OperationName: "example-operation-1",
+			ServiceName:   "example-service-1",
+			Timestamp:     int64(1485449191640),
+			Name:          "error",
+			Fields:        map[string]string{"event": "error", "message": "failed"},
+		},
+	}, records)
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+}
+
+func TestWriteSpanEventsPartitionedByLogTime(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	putTest := NewS3PutTest()
+	defer putTest.Clean()
+
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		localTestObjects(putTest, assert)).Times(3)
+
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), mockSvc, config.S3{
+		BucketName:       "jaeger-spans",
+		SpansPrefix:      "/spans/",
+		OperationsPrefix: "/operations/",
+		EventsPrefix:     "/events/",
+	})
+	assert.NoError(err)
+
+	span := NewTestCodecSpan()
+	span.Logs[0].Timestamp = span.StartTime.Add(time.Minute * 30)
+
+	// Spans without logs don't write events
+	spanWithoutLogs := NewTestCodecSpan()
+	spanWithoutLogs.SpanID = model.NewSpanID(4)
+	spanWithoutLogs.Logs = nil
+
+	assert.NoError(writer.WriteSpan(ctx, span))
+	assert.NoError(writer.WriteSpan(ctx, spanWithoutLogs))
+	assert.NoError(writer.Close())
+
+	eventKeys := []string{}
+	for _, object := range putTest.objects {
+		if strings.HasPrefix(object.key, "/events/") {
+			eventKeys = append(eventKeys, object.key)
+		} else if strings.HasPrefix(object.key, "/spans/") {
+			assert.True(strings.HasPrefix(object.key, "/spans/2017/01/26/16/"), object.key)
+		}
+	}
+	assert.Len(eventKeys, 1)
+	assert.True(strings.HasPrefix(eventKeys[0], "/events/2017/01/26/17/"), eventKeys[0])
+
+	localFileReader, err := local.NewLocalFileReader(putTest.EventsFile())
+	assert.NoError(err)
+	pr, err := reader.NewParquetReader(localFileReader, new(EventRecord), 1)
+	assert.NoError(err)
+
+	records := make([]EventRecord, pr.GetNumRows())
+	assert.NoError(pr.Read(&records))
+	assert.Len(records, 1)
+	assert.Equal(recordTimestamp(span.Logs[0].Timestamp), records[0].Timestamp)
+	assert.Equal(span.SpanID.String(), records[0].SpanID)
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+}
+
+func TestWriteSpanQueued(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	putTest := NewS3PutTest()
+	defer putTest.Clean()
+
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		localTestObjects(putTest, assert)).Times(2)
+
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), mockSvc, config.S3{
+		BucketName:       "jaeger-spans",
+		SpansPrefix:      "/spans/",
+		OperationsPrefix: "/operations/",
+		WriteQueueSize:   10,
+	})
+	assert.NoError(err)
+
+	assert.NoError(writer.WriteSpan(ctx, NewTestSpan(assert)))
+	assert.NoError(writer.WriteSpan(ctx, NewTestSpanWithTagsAndReferences(assert)))
+
+	// Close writes all queued spans
+	assert.NoError(writer.Close())
+
+	localFileReader, err := local.NewLocalFileReader(putTest.SpansFile())
+	assert.NoError(err)
+	pr, err := reader.NewParquetReader(localFileReader, new(SpanRecord), 1)
+	assert.NoError(err)
+
+	assert.Equal(int64(2), pr.GetNumRows())
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+}
+
 func BenchmarkWriteSpan(b *testing.B) {
 	ctrl := gomock.NewController(b)
 	defer ctrl.Finish()
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -13,11 +15,35 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/glue"
 	glueTypes "github.com/aws/aws-sdk-go-v2/service/glue/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	pConfig "github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore"
 )
 
 func main() {
 	ctx := context.Background()
 
+	partitionGranularity := flag.String("partition-granularity", "", "Partition granularity (day, hour or 15m), defaults to hour")
+	partitionLayout := flag.String("partition-layout", "", "Partition layout (path or hive), defaults to path")
+	servicePartitioning := flag.String("service-partitioning", "", "Service partitioning of spans (none, name or bucket), defaults to none")
+	servicePartitionBuckets := flag.Int("service-partition-buckets", 0, "Number of service hash buckets, defaults to 16")
+	promotedTagsFlag := flag.String("promoted-tags", "", "Comma separated tags written into their own columns as key:type (string, int64, double or bool), e.g. http.status_code:int64,http.route")
+	flag.Parse()
+
+	partitionScheme, err := s3spanstore.NewPartitionScheme(pConfig.S3{
+		PartitionGranularity:    *partitionGranularity,
+		PartitionLayout:         *partitionLayout,
+		ServicePartitioning:     *servicePartitioning,
+		ServicePartitionBuckets: *servicePartitionBuckets,
+	})
+	if err != nil {
+		log.Fatalf("invalid partition scheme, %v", err)
+	}
+
+	promotedTags, err := s3spanstore.NewPromotedTagColumns(parsePromotedTags(*promotedTagsFlag))
+	if err != nil {
+		log.Fatalf("invalid promoted tags, %v", err)
+	}
+
 	cfg, err := config.LoadDefaultConfig(ctx, func(lo *config.LoadOptions) error {
 		return nil
 	})
@@ -76,23 +102,8 @@ func main() {
 		TableInput: &glueTypes.TableInput{
 			Name: aws.String("jaeger_spans"),
 
-			Parameters: map[string]string{
-				"classification":                    "parquet",
-				"projection.enabled":                "true",
-				"projection.datehour.type":          "date",
-				"projection.datehour.format":        "yyyy/MM/dd/HH",
-				"projection.datehour.range":         "2022/01/01/00,NOW",
-				"projection.datehour.interval":      "1",
-				"projection.datehour.interval.unit": "HOURS",
-				"storage.location.template":         fmt.Sprintf("s3://%s/spans/${datehour}/", bucketName),
-			},
-
-			PartitionKeys: []glueTypes.Column{
-				{
-					Name: aws.String("datehour"),
-					Type: aws.String("string"),
-				},
-			},
+			Parameters:    tableParameters(partitionScheme, fmt.Sprintf("s3://%s/spans/", bucketName)),
+			PartitionKeys: partitionKeys(partitionScheme),
 
 			StorageDescriptor: &glueTypes.StorageDescriptor{
 				Location:     aws.String(fmt.Sprintf("s3://%s/spans/", bucketName)),
@@ -106,7 +117,7 @@ func main() {
 					},
 				},
 
-				Columns: []glueTypes.Column{
+				Columns: append([]glueTypes.Column{
 					{
 						Name: aws.String("trace_id"),
 						Type: aws.String("string"),
@@ -135,19 +146,55 @@ func main() {
 						Name: aws.String("tags"),
 						Type: aws.String("map<string,string>"),
 					},
+					{
+						Name: aws.String("span_tags"),
+						Type: aws.String("map<string,string>"),
+					},
+					{
+						Name: aws.String("process_tags"),
+						Type: aws.String("map<string,string>"),
+					},
+					{
+						Name: aws.String("log_fields"),
+						Type: aws.String("map<string,string>"),
+					},
+					{
+						Name: aws.String("int_tags"),
+						Type: aws.String("map<string,bigint>"),
+					},
+					{
+						Name: aws.String("double_tags"),
+						Type: aws.String("map<string,double>"),
+					},
+					{
+						Name: aws.String("bool_tags"),
+						Type: aws.String("map<string,boolean>"),
+					},
 					{
 						Name: aws.String("service_name"),
 						Type: aws.String("string"),
 					},
+					{
+						Name: aws.String("payload_version"),
+						Type: aws.String("int"),
+					},
+					{
+						Name: aws.String("payload_codec"),
+						Type: aws.String("string"),
+					},
 					{
 						Name: aws.String("span_payload"),
 						Type: aws.String("string"),
 					},
+					{
+						Name: aws.String("span_payload_binary"),
+						Type: aws.String("binary"),
+					},
 					{
 						Name: aws.String("references"),
 						Type: aws.String("array<struct<trace_id:string,span_id:string,ref_type:tinyint>>"),
 					},
-				},
+				}, promotedTagColumns(promotedTags)...),
 			},
 		},
 	})
@@ -173,23 +220,8 @@ func main() {
 		TableInput: &glueTypes.TableInput{
 			Name: aws.String("jaeger_operations"),
 
-			Parameters: map[string]string{
-				"classification":                    "parquet",
-				"projection.enabled":                "true",
-				"projection.datehour.type":          "date",
-				"projection.datehour.format":        "yyyy/MM/dd/HH",
-				"projection.datehour.range":         "2022/01/01/00,NOW",
-				"projection.datehour.interval":      "1",
-				"projection.datehour.interval.unit": "HOURS",
-				"storage.location.template":         fmt.Sprintf("s3://%s/operations/${datehour}/", bucketName),
-			},
-
-			PartitionKeys: []glueTypes.Column{
-				{
-					Name: aws.String("datehour"),
-					Type: aws.String("string"),
-				},
-			},
+			Parameters:    tableParameters(partitionScheme.WithoutServicePartitioning(), fmt.Sprintf("s3://%s/operations/", bucketName)),
+			PartitionKeys: partitionKeys(partitionScheme.WithoutServicePartitioning()),
 
 			StorageDescriptor: &glueTypes.StorageDescriptor{
 				Location:     aws.String(fmt.Sprintf("s3://%s/operations/", bucketName)),
@@ -228,6 +260,196 @@ func main() {
 		log.Fatalf("unable to create glue table, %v", err)
 	}
 
+	_, err = glueSvc.DeleteTable(ctx, &glue.DeleteTableInput{
+		DatabaseName: aws.String("default"),
+
+		Name: aws.String("jaeger_events"),
+	})
+	if err != nil {
+		var bne *glueTypes.EntityNotFoundException
+		if !errors.As(err, &bne) {
+			log.Fatalf("unable to delete glue table, %v", err)
+		}
+	}
+
+	_, err = glueSvc.CreateTable(ctx, &glue.CreateTableInput{
+		DatabaseName: aws.String("default"),
+
+		TableInput: &glueTypes.TableInput{
+			Name: aws.String("jaeger_events"),
+
+			Parameters:    tableParameters(partitionScheme, fmt.Sprintf("s3://%s/events/", bucketName)),
+			PartitionKeys: partitionKeys(partitionScheme),
+
+			StorageDescriptor: &glueTypes.StorageDescriptor{
+				Location:     aws.String(fmt.Sprintf("s3://%s/events/", bucketName)),
+				InputFormat:  aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"),
+				OutputFormat: aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"),
+
+				SerdeInfo: &glueTypes.SerDeInfo{
+					SerializationLibrary: aws.String("org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe"),
+					Parameters: map[string]string{
+						"serialization.format": "1",
+					},
+				},
+
+				Columns: []glueTypes.Column{
+					{
+						Name: aws.String("trace_id"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("span_id"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("operation_name"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("service_name"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("timestamp"),
+						Type: aws.String("timestamp"),
+					},
+					{
+						Name: aws.String("name"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("fields"),
+						Type: aws.String("map<string,string>"),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Fatalf("unable to create glue table, %v", err)
+	}
+
+	_, err = glueSvc.DeleteTable(ctx, &glue.DeleteTableInput{
+		DatabaseName: aws.String("default"),
+
+		Name: aws.String("jaeger_tag_keys"),
+	})
+	if err != nil {
+		var bne *glueTypes.EntityNotFoundException
+		if !errors.As(err, &bne) {
+			log.Fatalf("unable to delete glue table, %v", err)
+		}
+	}
+
+	_, err = glueSvc.CreateTable(ctx, &glue.CreateTableInput{
+		DatabaseName: aws.String("default"),
+
+		TableInput: &glueTypes.TableInput{
+			Name: aws.String("jaeger_tag_keys"),
+
+			Parameters:    tableParameters(partitionScheme.WithoutServicePartitioning(), fmt.Sprintf("s3://%s/tag-keys/", bucketName)),
+			PartitionKeys: partitionKeys(partitionScheme.WithoutServicePartitioning()),
+
+			StorageDescriptor: &glueTypes.StorageDescriptor{
+				Location:     aws.String(fmt.Sprintf("s3://%s/tag-keys/", bucketName)),
+				InputFormat:  aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"),
+				OutputFormat: aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"),
+
+				SerdeInfo: &glueTypes.SerDeInfo{
+					SerializationLibrary: aws.String("org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe"),
+					Parameters: map[string]string{
+						"serialization.format": "1",
+					},
+				},
+
+				Columns: []glueTypes.Column{
+					{
+						Name: aws.String("service_name"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("key"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("value"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("high_cardinality"),
+						Type: aws.String("boolean"),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Fatalf("unable to create glue table, %v", err)
+	}
+
+	_, err = glueSvc.DeleteTable(ctx, &glue.DeleteTableInput{
+		DatabaseName: aws.String("default"),
+
+		Name: aws.String("jaeger_dependencies"),
+	})
+	if err != nil {
+		var bne *glueTypes.EntityNotFoundException
+		if !errors.As(err, &bne) {
+			log.Fatalf("unable to delete glue table, %v", err)
+		}
+	}
+
+	_, err = glueSvc.CreateTable(ctx, &glue.CreateTableInput{
+		DatabaseName: aws.String("default"),
+
+		TableInput: &glueTypes.TableInput{
+			Name: aws.String("jaeger_dependencies"),
+
+			Parameters:    tableParameters(partitionScheme.WithoutServicePartitioning(), fmt.Sprintf("s3://%s/dependencies/", bucketName)),
+			PartitionKeys: partitionKeys(partitionScheme.WithoutServicePartitioning()),
+
+			StorageDescriptor: &glueTypes.StorageDescriptor{
+				Location:     aws.String(fmt.Sprintf("s3://%s/dependencies/", bucketName)),
+				InputFormat:  aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"),
+				OutputFormat: aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"),
+
+				SerdeInfo: &glueTypes.SerDeInfo{
+					SerializationLibrary: aws.String("org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe"),
+					Parameters: map[string]string{
+						"serialization.format": "1",
+					},
+				},
+
+				Columns: []glueTypes.Column{
+					{
+						Name: aws.String("parent"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("child"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("call_count"),
+						Type: aws.String("bigint"),
+					},
+					{
+						Name: aws.String("ref_trace_id"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("ref_span_id"),
+						Type: aws.String("string"),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Fatalf("unable to create glue table, %v", err)
+	}
+
 	_, err = athenaSvc.CreateWorkGroup(ctx, &athena.CreateWorkGroupInput{
 		Name: aws.String("jaeger"),
 		Configuration: &athenaTypes.WorkGroupConfiguration{
@@ -243,3 +465,54 @@ func main() {
 		}
 	}
 }
+
+func tableParameters(partitionScheme s3spanstore.PartitionScheme, location string) map[string]string {
+	parameters := partitionScheme.GlueParameters(location)
+	parameters["classification"] = "parquet"
+
+	return parameters
+}
+
+func parsePromotedTags(value string) []pConfig.PromotedTag {
+	promotedTags := []pConfig.PromotedTag{}
+	for _, promotedTag := range strings.Split(value, ",") {
+		if promotedTag == "" {
+			continue
+		}
+
+		// Keys might contain colons, so the type is separated by the last one
+		key, tagType := promotedTag, ""
+		if i := strings.LastIndex(promotedTag, ":"); i >= 0 {
+			key, tagType = promotedTag[:i], promotedTag[i+1:]
+		}
+
+		promotedTags = append(promotedTags, pConfig.PromotedTag{Key: key, Type: tagType})
+	}
+
+	return promotedTags
+}
+
+func promotedTagColumns(promotedTags *s3spanstore.PromotedTagColumns) []glueTypes.Column {
+	columns := []glueTypes.Column{}
+	for _, promotedTag := range promotedTags.Tags() {
+		columns = append(columns, glueTypes.Column{
+			Name: aws.String(promotedTag.Column),
+			Type: aws.String(promotedTag.AthenaType()),
+		})
+	}
+
+	return columns
+}
+
+func partitionKeys(partitionScheme s3spanstore.PartitionScheme) []glueTypes.Column {
+	columns := partitionScheme.Columns()
+	partitionKeys := make([]glueTypes.Column, len(columns))
+	for i, column := range columns {
+		partitionKeys[i] = glueTypes.Column{
+			Name: aws.String(column.Name),
+			Type: aws.String("string"),
+		}
+	}
+
+	return partitionKeys
+}